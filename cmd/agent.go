@@ -1,35 +1,71 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"oneplay-videostream-browser/internal/api"
 	"oneplay-videostream-browser/internal/encoders"
+	"oneplay-videostream-browser/internal/raudio"
+	"oneplay-videostream-browser/internal/rauth"
+	"oneplay-videostream-browser/internal/rclipboard"
+	"oneplay-videostream-browser/internal/rconsent"
 	"oneplay-videostream-browser/internal/rdisplay"
+	"oneplay-videostream-browser/internal/rgamepad"
+	"oneplay-videostream-browser/internal/rhls"
+	"oneplay-videostream-browser/internal/rinput"
+	"oneplay-videostream-browser/internal/rlog"
+	"oneplay-videostream-browser/internal/rmask"
+	"oneplay-videostream-browser/internal/rrecord"
+	"oneplay-videostream-browser/internal/rreplay"
+	"oneplay-videostream-browser/internal/rtls"
+	"oneplay-videostream-browser/internal/rtrace"
 	"oneplay-videostream-browser/rtc"
 
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	httpDefaultPort   = "9000"
 	defaultStunServer = "turn:13.250.13.83:3478?transport=udp"
+
+	defaultFilesMaxSize = 100 << 20
+	defaultGamepadSlots = 4
+
+	defaultRecordMaxSize     = 1 << 30
+	defaultRecordMaxDuration = time.Hour
+
+	defaultReplayFps = 30
+
+	defaultSignalURL = "ws://oneplay-heroku.herokuapp.com/host"
+
+	defaultJoinTTL = 10 * time.Minute
+
+	defaultConsentTimeout = 30 * time.Second
+
+	traceService         = "oneplay-agent"
+	traceShutdownTimeout = 5 * time.Second
+
+	defaultHLSSegment  = 2 * time.Second
+	defaultHLSPart     = 200 * time.Millisecond
+	defaultHLSSegments = 6
 )
 
 func main() {
 
-	socketUrl := "ws://oneplay-heroku.herokuapp.com" + "/host"
 	// socketUrl := "ws://localhost:8080" + "/ws"
-	ws, _, err := websocket.DefaultDialer.Dial(socketUrl, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
 
 	// sigStr := "host"
 	// sigData := make([]byte, len(sigStr))
@@ -47,35 +83,315 @@ func main() {
 	// }
 	// fmt.Println(pMsg)
 
-	//httpPort := flag.String("http.port", httpDefaultPort, "HTTP listen port")
+	httpPort := flag.String("http.port", "", "HTTP API listen port (e.g. "+httpDefaultPort+"), empty disables the API")
+	httpTLS := flag.Bool("http.tls", false, "Serve the HTTP API over HTTPS, with a self-signed certificate unless -http.cert is set")
+	httpCert := flag.String("http.cert", "", "PEM certificate of the HTTPS API, enables HTTPS")
+	httpKey := flag.String("http.key", "", "PEM private key of -http.cert")
 	stunServer := flag.String("stun.server", defaultStunServer, "STUN server URL (stun:)")
+	audioEnabled := flag.Bool("audio", true, "Stream the host audio output alongside the video")
+	audioDevice := flag.String("audio.device", "", "PulseAudio/PipeWire source to capture, the default sink monitor when empty")
+	gamepadSlots := flag.Int("gamepad.slots", defaultGamepadSlots, "Virtual gamepads the host accepts across every session, 0 disables gamepads")
+	gamepadViewers := flag.Bool("gamepad.viewers", false, "Let viewers without control play with a gamepad")
+	filesDir := flag.String("files.dir", "", "Landing directory of file transfers, empty disables them")
+	filesMaxSize := flag.Int64("files.maxsize", defaultFilesMaxSize, "Largest file accepted by file transfers, in bytes")
+	recordDir := flag.String("record.dir", "", "Directory of session recordings, empty disables recording")
+	recordMaxSize := flag.Int64("record.maxsize", defaultRecordMaxSize, "Size in bytes after which a recording moves on to a new file, 0 for no limit")
+	recordMaxDuration := flag.Duration("record.maxduration", defaultRecordMaxDuration, "Duration after which a recording moves on to a new file, 0 for no limit")
+	replayFile := flag.String("replay", "", "H.264 recording, MP4 or Annex-B, streamed instead of the screen")
+	replayFps := flag.Int("replay.fps", defaultReplayFps, "Frame rate of Annex-B replays, MP4 ones keep their recorded timing")
+	replayLoop := flag.Bool("replay.loop", true, "Start the replay over once it is over")
+	hlsEnabled := flag.Bool("hls", false, "Serve the screens as LL-HLS under /hls/ of the HTTP API, for viewers that can't use WebRTC")
+	hlsSegment := flag.Duration("hls.segment", defaultHLSSegment, "Target duration of the HLS segments")
+	hlsPart := flag.Duration("hls.part", defaultHLSPart, "Target duration of the LL-HLS parts")
+	signalURL := flag.String("signal.url", defaultSignalURL, "Host endpoint of the signaling server (ws: or wss:)")
+	signalKey := flag.String("signal.key", "", "PEM public key of the signaling server, required to register and to accept viewers only with a session grant")
+	signalIssuer := flag.String("signal.issuer", "", "Expected issuer of the signaling server tokens, not checked when empty")
+	hostTokenFile := flag.String("host.tokenfile", "", "File holding the token the host authenticates with")
+	signalCA := flag.String("signal.ca", "", "PEM CA bundle verifying wss: signaling servers, the system CAs when empty")
+	signalPins := flag.String("signal.pin", "", "Comma separated pins of the signaling server certificate: SHA-256 fingerprints in hex or sha256/<base64 SPKI hash>")
+	hostCert := flag.String("host.cert", "", "PEM client certificate the host authenticates with over wss:")
+	hostKey := flag.String("host.key", "", "PEM private key of -host.cert")
+	apiAuth := flag.Bool("api.auth", true, "Require a bearer token on the HTTP API")
+	apiIssuers := flag.String("api.issuers", "", "Trusted issuers of API tokens, comma separated name=keyfile pairs of PEM public keys")
+	apiAudience := flag.String("api.audience", "", "Expected audience of API tokens, not checked when empty")
+	joinTTL := flag.Duration("join.ttl", defaultJoinTTL, "Validity of the one-time join links")
+	consentMode := flag.String("consent", "auto", "How viewers are approved: auto accepts everyone, allowlist only the -consent.allow viewers, dialog asks on the host display")
+	consentAllow := flag.String("consent.allow", "", "Comma separated viewer identities, or patterns like ops-*, approved without asking")
+	consentTimeout := flag.Duration("consent.timeout", defaultConsentTimeout, "Time the host has to answer the approval dialog before the viewer is rejected")
+	logLevel := flag.String("log.level", "info", "Least severe log level written: debug, info, warn or error")
+	logJSON := flag.Bool("log.json", false, "Write the logs as a JSON object per line")
+	logRedact := flag.Bool("log.redact", true, "Hide IP addresses and credentials in the logs")
+	indicatorEnabled := flag.Bool("indicator", true, "Show a banner on the host display while someone is watching")
+	maskEnabled := flag.Bool("mask", true, "Hide the areas matching the privacy masking rules, which the API can change at runtime")
+	maskRules := flag.String("mask.rules", "", "JSON file of the privacy masking rules applied from the start")
+	traceEndpoint := flag.String("trace.endpoint", "", "OTLP/HTTP collector receiving the traces of session setup, host:port or URL, empty disables tracing")
+	traceInsecure := flag.Bool("trace.insecure", false, "Send the traces over plain HTTP")
+	traceRatio := flag.Float64("trace.ratio", 1, "Share of the signaling messages and sessions traced, from 0 to 1")
+	metricsAddr := flag.String("metrics.addr", "", "Listen address of the Prometheus /metrics endpoint (e.g. :9100), empty disables it")
 	flag.Parse()
 
+	agentLog = rlog.New(os.Stderr, rlog.Config{
+		Level:  rlog.ParseLevel(*logLevel),
+		JSON:   *logJSON,
+		Redact: *logRedact,
+	})
+	// The packages still using the standard logger go through it too
+	log.SetFlags(0)
+	log.SetOutput(agentLog.Writer(rlog.LevelInfo))
+
+	shutdownTracing, err := rtrace.Setup(rtrace.Config{
+		Endpoint: *traceEndpoint,
+		Insecure: *traceInsecure,
+		Service:  traceService,
+		Ratio:    *traceRatio,
+	})
+	if err != nil {
+		agentLog.Fatalf("Can't set up tracing: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), traceShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			agentLog.Warnf("Can't flush the traces: %v", err)
+		}
+	}()
+
+	credentials := rauth.Credentials{
+		TokenFile: *hostTokenFile,
+		CertFile:  *hostCert,
+		KeyFile:   *hostKey,
+	}
+	ws, err := dialSignaling(*signalURL, credentials, *signalCA, strings.Split(*signalPins, ","))
+	if err != nil {
+		agentLog.Fatalf("Can't reach the signaling server: %v", err)
+	}
+
+	var auth *hostAuth
+	if *signalKey != "" {
+		key, err := rauth.LoadPublicKey(*signalKey)
+		if err != nil {
+			agentLog.Fatalf("Can't load signaling key: %v", err)
+		}
+		auth, err = register(ws, rauth.NewVerifier(key, *signalIssuer))
+		if err != nil {
+			agentLog.Fatalf("Host registration failed: %v", err)
+		}
+		agentLog.Infof("Registered as host %s", auth.identity.HostID)
+	} else {
+		agentLog.Warnf("No signaling key: viewer offers are accepted without a session grant")
+		if *httpPort == "" {
+			agentLog.Warnf("No HTTP API: control can only be granted to a viewer with signaling authentication")
+		}
+	}
+
 	var video rdisplay.Service
-	video, err = rdisplay.NewVideoProvider()
+	if *replayFile != "" {
+		video, err = rreplay.NewReplayProvider(*replayFile, *replayFps, *replayLoop)
+	} else {
+		video, err = rdisplay.NewVideoProvider(agentLog)
+	}
 	if err != nil {
-		log.Fatalf("Can't init video: %v", err)
+		agentLog.Fatalf("Can't init video: %v", err)
 	}
 	_, err = video.Screens()
 	if err != nil {
-		log.Fatalf("Can't get screens: %v", err)
+		agentLog.Fatalf("Can't get screens: %v", err)
+	}
+
+	enc := encoders.NewEncoderService(agentLog)
+	if err != nil {
+		agentLog.Fatalf("Can't create encoder service: %v", err)
+	}
+
+	var audio raudio.Service
+	if *audioEnabled {
+		if !enc.SupportsAudio(encoders.OpusCodec) {
+			agentLog.Warnf("Audio disabled: agent built without the opus encoder")
+		} else if audio, err = raudio.NewAudioProvider(*audioDevice); err != nil {
+			agentLog.Warnf("Audio disabled: %v", err)
+			audio = nil
+		}
+	}
+
+	var input rinput.Service
+	input, err = rinput.NewInputProvider()
+	if err != nil {
+		agentLog.Warnf("Remote input disabled: %v", err)
+		input = nil
 	}
 
-	var enc encoders.Service = &encoders.EncoderService{}
+	var clipboard rclipboard.Service
+	clipboard, err = rclipboard.NewClipboardProvider()
 	if err != nil {
-		log.Fatalf("Can't create encoder service: %v", err)
+		agentLog.Warnf("Clipboard sync disabled: %v", err)
+		clipboard = nil
+	}
+
+	var gamepad rgamepad.Service
+	if *gamepadSlots > 0 {
+		if gamepad, err = rgamepad.NewGamepadProvider(); err != nil {
+			agentLog.Warnf("Gamepads disabled: %v", err)
+			gamepad = nil
+		}
+	}
+	gamepads := rtc.GamepadConfig{
+		Slots:   *gamepadSlots,
+		Viewers: *gamepadViewers,
 	}
 
 	var webrtc rtc.Service
-	fmt.Println(*stunServer, video, enc)
-	webrtc = rtc.NewRemoteScreenService(*stunServer, video, enc)
+	files := rtc.FileTransferConfig{
+		Dir:     *filesDir,
+		MaxSize: *filesMaxSize,
+	}
+	if files.Dir != "" {
+		if err = os.MkdirAll(files.Dir, 0700); err != nil {
+			agentLog.Fatalf("Can't create file transfer directory: %v", err)
+		}
+	}
 
-	//mux := http.NewServeMux()
+	records := rrecord.Config{
+		Dir:         *recordDir,
+		MaxSize:     *recordMaxSize,
+		MaxDuration: *recordMaxDuration,
+	}
+
+	var hls rhls.Config
+	if *hlsEnabled {
+		if *httpPort == "" {
+			agentLog.Warnf("HLS disabled: no HTTP API port")
+		} else {
+			hls = rhls.Config{
+				SegmentDuration: *hlsSegment,
+				PartDuration:    *hlsPart,
+				Segments:        defaultHLSSegments,
+			}
+		}
+	}
+
+	var consent rtc.ConsentConfig
+	allowlist := rconsent.ParseAllowlist(*consentAllow)
+	switch *consentMode {
+	case "auto":
+		consent.Approver = rconsent.AutoApprover{}
+	case "allowlist":
+		consent.Approver = rconsent.NewAllowlistApprover(allowlist, nil)
+	case "dialog":
+		dialog, err := rconsent.NewDialogApprover(*consentTimeout)
+		if err != nil {
+			agentLog.Fatalf("Can't ask for approval: %v", err)
+		}
+		consent.Approver = dialog
+		if len(allowlist) > 0 {
+			consent.Approver = rconsent.NewAllowlistApprover(allowlist, dialog)
+		}
+	default:
+		agentLog.Fatalf("Unknown consent mode %q", *consentMode)
+	}
+	if *indicatorEnabled {
+		indicator, err := rconsent.NewIndicator()
+		if err != nil {
+			agentLog.Warnf("Watching indicator disabled: %v", err)
+		} else {
+			defer indicator.Close()
+			consent.Indicator = indicator
+		}
+	}
+
+	var masker *rmask.Masker
+	if *maskEnabled {
+		var rules []rmask.Rule
+		if *maskRules != "" {
+			if rules, err = rmask.LoadRules(*maskRules); err != nil {
+				agentLog.Fatalf("Can't load masking rules: %v", err)
+			}
+		}
+		var windows rmask.WindowLister
+		if lister, err := rmask.NewWindowLister(); err != nil {
+			agentLog.Warnf("Window masking disabled: %v", err)
+		} else {
+			defer lister.Close()
+			windows = lister
+		}
+		// Starting without the rules would show what they are meant to hide
+		if masker, err = rmask.NewMasker(windows, rules); err != nil {
+			agentLog.Fatalf("Can't apply masking rules: %v", err)
+		}
+		defer masker.Close()
+	}
+
+	webrtc = rtc.NewRemoteScreenService(rtc.ServiceConfig{
+		STUN:      *stunServer,
+		Video:     video,
+		Encoders:  enc,
+		Audio:     audio,
+		Input:     input,
+		Clipboard: clipboard,
+		Gamepad:   gamepad,
+		Gamepads:  gamepads,
+		Files:     files,
+		Records:   records,
+		HLS:       hls,
+		Consent:   consent,
+		Masker:    masker,
+		Log:       agentLog,
+	})
+
+	// Join links are the only way in without a trusted issuer
+	var authorizer *rauth.Authorizer
+	if *apiAuth && *httpPort != "" {
+		issuers, err := rauth.ParseIssuers(*apiIssuers)
+		if err != nil {
+			agentLog.Fatalf("Can't load API issuers: %v", err)
+		}
+		if authorizer, err = rauth.NewAuthorizer(issuers, *apiAudience); err != nil {
+			agentLog.Fatalf("Can't create API authorizer: %v", err)
+		}
+	} else if *httpPort != "" {
+		agentLog.Warnf("HTTP API open to anyone reaching port %s", *httpPort)
+	}
+
+	errors := make(chan error, 3)
+	if *httpPort != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/api/", http.StripPrefix("/api", api.MakeHandler(webrtc, video, authorizer, *joinTTL)))
+		if hls.SegmentDuration > 0 {
+			mux.Handle("/hls/", http.StripPrefix("/hls", api.MakeHLSHandler(webrtc, authorizer)))
+		}
+		server := &http.Server{
+			Addr:     fmt.Sprintf(":%s", *httpPort),
+			Handler:  mux,
+			ErrorLog: log.New(agentLog.Writer(rlog.LevelWarn), "", 0),
+		}
+		if *httpTLS || *httpCert != "" {
+			var fingerprint string
+			server.TLSConfig, fingerprint, err = rtls.ServerConfig(*httpCert, *httpKey)
+			if err != nil {
+				agentLog.Fatalf("Can't set up HTTPS: %v", err)
+			}
+			agentLog.Infof("HTTPS certificate fingerprint (SHA-256): %s", fingerprint)
+		}
+		go func() {
+			agentLog.Infof("Starting HTTP API on port %s", *httpPort)
+			if server.TLSConfig != nil {
+				errors <- server.ListenAndServeTLS("", "")
+				return
+			}
+			errors <- server.ListenAndServe()
+		}()
+	}
+
+	if *metricsAddr != "" {
+		server := newMetricsServer(*metricsAddr, webrtc)
+		go func() {
+			agentLog.Infof("Serving metrics on %s", *metricsAddr)
+			errors <- server.ListenAndServe()
+		}()
+	}
 
-	// // Endpoint to create a new speech to text session
-	// mux.Handle("/api/", http.StripPrefix("/api", api.MakeHandler(webrtc, video)))
 	// fmt.Println("Finding Panic Error : 4")
-	reader(ws, webrtc, video)
+	reader(ws, webrtc, video, auth)
+	signalingDisconnects.Inc()
 	// fmt.Println("Finding Panic Error : 5")
 
 	// // Serve static assets
@@ -88,27 +404,33 @@ func main() {
 	// 	http.ServeFile(w, r, "./web/index.html")
 	// })
 
-	errors := make(chan error, 2)
-	// go func() {
-	// 	log.Printf("Starting signaling server on port %s", *httpPort)
-	// 	errors <- http.ListenAndServe(fmt.Sprintf(":%s", *httpPort), mux)
-	// }()
-
 	go func() {
-		interrupt := make(chan os.Signal)
+		interrupt := make(chan os.Signal, 1)
 		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 		errors <- fmt.Errorf("Received %v signal", <-interrupt)
 	}()
 
 	err = <-errors
-	log.Printf("%s, exiting.", err)
+	agentLog.Infof("%s, exiting.", err)
 }
 
 type Message struct {
-	WSType string
-	Screen int
-	SDP    string
-	ICE    webrtc.ICECandidateInit
+	WSType  string
+	Screen  int
+	SDP     string
+	ICE     webrtc.ICECandidateInit
+	Cursor  string
+	Latency string
+	Marker  bool
+	// Session is the session the message is about, the answer to an offer
+	// names it and the ICE candidates of the viewer must name it too
+	Session   string
+	Clipboard bool
+	Gamepad   bool
+	Format    string
+	// Grant is the session grant of the message, see grantRoles
+	Grant    string
+	Identity string
 	// wsSDP  *webrtc.SessionDescription `json:"wsSDP"`
 }
 
@@ -116,39 +438,68 @@ type screenPayload struct {
 	Index int `json:"index"`
 }
 
-type screensResponse struct {
-	WSType string
-	Screen []screenPayload
-	SDP    string
+type controlRequest struct {
+	WSType  string
+	Session string
+	Screen  int
 }
 
-var ICEinfo webrtc.ICECandidateInit
-var peer rtc.RemoteScreenConnection
+type roleResponse struct {
+	WSType  string
+	Session string
+	Role    string
+}
 
-var flag_sdp bool
-var flag_ice bool
+type recordingResponse struct {
+	WSType  string
+	Session string
+	State   string
+	Files   []string
+}
 
-func reader(conn *websocket.Conn, rtcService rtc.Service, display rdisplay.Service) {
-	flag_sdp = false
-	flag_ice = false
-	fmt.Println("Finding Panic Error : 1")
-	for {
-		// read in a message
+type rejectedResponse struct {
+	WSType string
+	Reason string
+}
 
-		messageType, p, err := conn.ReadMessage()
+type screensResponse struct {
+	WSType string
+	Screen []screenPayload
+	SDP    string
+}
 
-		if err != nil {
-			log.Println(err)
-			return
-		}
+// agentLog is the logger of the agent, every component gets it or a logger
+// derived from it
+var agentLog *rlog.Logger
 
-		var msg *Message
+// signalingSession is a session opened by an offer over signaling
+type signalingSession struct {
+	peer rtc.RemoteScreenConnection
+	// grant is the id of the grant of the offer, the ICE candidates of the
+	// session come with that grant. Empty without signaling authentication.
+	grant string
+}
 
-		err = json.Unmarshal(p, &msg)
+func reader(conn *websocket.Conn, rtcService rtc.Service, display rdisplay.Service, auth *hostAuth) {
+	// sessions are the sessions opened over signaling by id, only the
+	// reader loop uses it
+	sessions := make(map[string]*signalingSession)
+	// reject tells the signaling server a message was refused
+	reject := func(ctx context.Context, messageType int, msgLog *rlog.Logger, err error) {
+		msgLog.Warnf("Rejected: %v", err)
+		writeJSON(conn, messageType, rejectedResponse{
+			WSType: "Rejected",
+			Reason: err.Error(),
+		})
+		rtrace.Fail(trace.SpanFromContext(ctx), err)
+	}
+	// handle answers a message, the failures it returns are logged by the
+	// loop and recorded on the span of the message
+	handle := func(ctx context.Context, messageType int, msg *Message, msgLog *rlog.Logger) error {
+		grant, err := authorizeMessage(auth, msg)
 		if err != nil {
-			fmt.Println("Error occurred in Unmarshal")
-			log.Fatal(err)
-			return
+			reject(ctx, messageType, msgLog, err)
+			return nil
 		}
 
 		if msg.WSType == "Screen" {
@@ -156,8 +507,8 @@ func reader(conn *websocket.Conn, rtcService rtc.Service, display rdisplay.Servi
 			screens, err := display.Screens()
 
 			if err != nil {
-				log.Fatal(err)
-				return
+				msgLog.Fatalf("Can't list the screens: %v", err)
+				return nil
 			}
 
 			screensPayload := make([]screenPayload, len(screens))
@@ -171,8 +522,8 @@ func reader(conn *websocket.Conn, rtcService rtc.Service, display rdisplay.Servi
 				SDP:    "",
 			})
 			if err != nil {
-				log.Fatal(err)
-				return
+				msgLog.Fatalf("Can't encode the screens: %v", err)
+				return nil
 			}
 
 			// conn.WriteMessage(messageType, payload)
@@ -180,32 +531,288 @@ func reader(conn *websocket.Conn, rtcService rtc.Service, display rdisplay.Servi
 			conn.WriteMessage(messageType, payload)
 		} else if msg.WSType == "SDP" {
 
-			var err error
-			peer, err = rtcService.CreateRemoteScreenConnection(msg.Screen, 60)
+			pruneSessions(sessions, rtcService)
+			role := rtc.RoleViewer
+			viewer := ""
+			grantID := ""
+			if grant != nil {
+				if !grant.AllowsScreen(msg.Screen) {
+					reject(ctx, messageType, msgLog, fmt.Errorf("Session grant doesn't cover screen %d", msg.Screen))
+					return nil
+				}
+				role = rtc.ParseRole(grant.Role)
+				viewer = grant.Viewer
+				grantID = grant.ID
+			}
+
+			peer, err := rtcService.CreateRemoteScreenConnection(msg.Screen, 60, rtc.SessionOptions{
+				Cursor:        rdisplay.ParseCursorMode(msg.Cursor),
+				Latency:       encoders.ParseProfile(msg.Latency),
+				LatencyMarker: msg.Marker,
+				Clipboard:     msg.Clipboard,
+				Gamepad:       msg.Gamepad,
+				Role:          role,
+				Viewer:        viewer,
+			})
+			if err == rtc.ErrNotApproved {
+				msgLog.With(rlog.F("peer", viewer)).Infof("Rejected viewer offer: %v", err)
+				writeJSON(conn, messageType, rejectedResponse{
+					WSType: "Rejected",
+					Reason: err.Error(),
+				})
+				rtrace.Fail(trace.SpanFromContext(ctx), err)
+				return nil
+			}
 			if err != nil {
-				log.Fatal(err)
-				return
+				msgLog.Fatalf("Can't create the session: %v", err)
+				return nil
 			}
 
-			flag_sdp = true
+			_, err = peer.ProcessOffer(ctx, msg.SDP, func(reply interface{}) error {
+				payload, err := json.Marshal(reply)
+				if err != nil {
+					return err
+				}
+				return conn.WriteMessage(messageType, payload)
+			})
+			if err != nil {
+				peer.Close()
+				return fmt.Errorf("Can't answer the offer: %v", err)
+			}
+			sessions[peer.ID()] = &signalingSession{peer: peer, grant: grantID}
+		} else if msg.WSType == "ICE" {
 
-			peer.ProcessOffer(msg.SDP, conn, messageType)
+			msgLog.Debugf("Remote ICE candidate: %s", msg.ICE.Candidate)
+			session, err := iceSession(auth, sessions, rtcService, msg)
+			if err != nil {
+				reject(ctx, messageType, msgLog, err)
+				return nil
+			}
+			if err := session.peer.ProcessICE(ctx, msg.ICE); err != nil {
+				return err
+			}
+		} else if msg.WSType == "RequestControl" {
 
-			if flag_ice {
-				peer.ProcessICE(ICEinfo)
+			if err := ownSession(rtcService, grant, msg.Session); err != nil {
+				reject(ctx, messageType, msgLog, err)
+				return nil
+			}
+			screen, err := rtcService.RequestControl(msg.Session)
+			if err != nil {
+				return err
 			}
-		} else if msg.WSType == "ICE" {
 
-			fmt.Println("ICE Confirmation")
+			// Forwarded to the host/admin, who answers with GrantControl
+			// or DenyControl
+			writeJSON(conn, messageType, controlRequest{
+				WSType:  "ControlRequest",
+				Session: msg.Session,
+				Screen:  screen,
+			})
+		} else if msg.WSType == "GrantControl" {
+
+			changes, err := rtcService.GrantControl(msg.Session)
+			if err != nil {
+				return err
+			}
+			sendRoleChanges(conn, messageType, changes)
+		} else if msg.WSType == "DenyControl" {
+
+			if err := rtcService.DenyControl(msg.Session); err != nil {
+				return err
+			}
+			writeJSON(conn, messageType, roleResponse{
+				WSType:  "ControlDenied",
+				Session: msg.Session,
+				Role:    rtc.RoleViewer.String(),
+			})
+		} else if msg.WSType == "ReleaseControl" {
+
+			// Only the viewer of the session gives its control back
+			if err := ownSession(rtcService, grant, msg.Session); err != nil {
+				reject(ctx, messageType, msgLog, err)
+				return nil
+			}
+			changes, err := rtcService.RevokeControl(msg.Session)
+			if err != nil {
+				return err
+			}
+			sendRoleChanges(conn, messageType, changes)
+		} else if msg.WSType == "RevokeControl" {
 
-			fmt.Println(msg.ICE)
-			ICEinfo = msg.ICE
+			changes, err := rtcService.RevokeControl(msg.Session)
+			if err != nil {
+				return err
+			}
+			sendRoleChanges(conn, messageType, changes)
+		} else if msg.WSType == "StartRecording" {
 
-			flag_ice = true
+			if err := rtcService.StartRecording(msg.Session, rrecord.ParseFormat(msg.Format)); err != nil {
+				return err
+			}
+			writeJSON(conn, messageType, recordingResponse{
+				WSType:  "Recording",
+				Session: msg.Session,
+				State:   "started",
+			})
+		} else if msg.WSType == "StopRecording" {
 
-			if flag_sdp {
-				peer.ProcessICE(ICEinfo)
+			files, err := rtcService.StopRecording(msg.Session)
+			if err != nil {
+				return err
 			}
+			writeJSON(conn, messageType, recordingResponse{
+				WSType:  "Recording",
+				Session: msg.Session,
+				State:   "stopped",
+				Files:   files,
+			})
 		}
+		return nil
+	}
+
+	for {
+		// read in a message
+
+		messageType, p, err := conn.ReadMessage()
+
+		if err != nil {
+			agentLog.Errorf("Signaling connection lost: %v", err)
+			return
+		}
+
+		var msg *Message
+
+		err = json.Unmarshal(p, &msg)
+		if err != nil {
+			agentLog.Fatalf("Bad signaling message: %v", err)
+			return
+		}
+
+		msgLog := agentLog.With(rlog.F("type", msg.WSType))
+		if msg.Session != "" {
+			msgLog = msgLog.With(rlog.F("session", msg.Session))
+		}
+		msgLog.Debugf("Signaling message received")
+
+		ctx, span := rtrace.Tracer().Start(context.Background(), "signaling.message", trace.WithAttributes(
+			attribute.String("type", msg.WSType),
+			attribute.String("session", msg.Session),
+		))
+		if err := handle(ctx, messageType, msg, msgLog); err != nil {
+			msgLog.Warnf("%v", err)
+			rtrace.Fail(span, err)
+		}
+		span.End()
+	}
+}
+
+// grantRoles is the role the session grant of a signaling message must
+// include, the messages missing here need no grant. Grants are single use,
+// ICE candidates ride on the grant of their offer, see iceSession.
+var grantRoles = map[string]string{
+	"SDP": rauth.ViewerRole,
+	// Viewers ask for control of their own sessions, see ownSession
+	"RequestControl": rauth.ViewerRole,
+	// A controller may give its own control back, taking it away from
+	// someone else is up to the host
+	"ReleaseControl": rauth.ControllerRole,
+	"GrantControl":   rauth.AdminRole,
+	"DenyControl":    rauth.AdminRole,
+	"RevokeControl":  rauth.AdminRole,
+	"StartRecording": rauth.AdminRole,
+	"StopRecording":  rauth.AdminRole,
+}
+
+// authorizeMessage verifies the session grant of msg against the role its
+// type needs. Without signaling authentication there is no grant, and only
+// the messages a viewer may send are let through.
+func authorizeMessage(auth *hostAuth, msg *Message) (*rauth.SessionGrant, error) {
+	role, found := grantRoles[msg.WSType]
+	if !found {
+		return nil, nil
+	}
+	if auth == nil {
+		if role == rauth.ViewerRole {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s needs signaling authentication", msg.WSType)
+	}
+	grant, err := auth.verifier.Grant(msg.Grant, auth.identity)
+	if err != nil {
+		return nil, err
+	}
+	if !grant.Allows(role) {
+		return nil, fmt.Errorf("%s needs the %s role, the grant has %q", msg.WSType, role, grant.Role)
+	}
+	return grant, nil
+}
+
+// ownSession checks the grant of a viewer message is for a session the
+// viewer opened, admins may name any session. Without signaling
+// authentication there is no grant to check.
+func ownSession(rtcService rtc.Service, grant *rauth.SessionGrant, session string) error {
+	if grant == nil || grant.Allows(rauth.AdminRole) {
+		return nil
+	}
+	info, err := rtcService.Session(session)
+	if err != nil {
+		return err
+	}
+	if grant.Viewer == "" || info.Viewer != grant.Viewer {
+		return fmt.Errorf("Session %s belongs to another viewer", session)
+	}
+	return nil
+}
+
+// iceSession returns the session an ICE candidate is for. With signaling
+// authentication the candidate comes with the grant of the offer of the
+// session, which the offer used already.
+func iceSession(auth *hostAuth, sessions map[string]*signalingSession, rtcService rtc.Service, msg *Message) (*signalingSession, error) {
+	pruneSessions(sessions, rtcService)
+	session, found := sessions[msg.Session]
+	if !found {
+		return nil, fmt.Errorf("ICE candidate for unknown session %q", msg.Session)
+	}
+	if auth == nil {
+		return session, nil
+	}
+	grant, err := auth.verifier.UsedGrant(msg.Grant, auth.identity)
+	if err != nil {
+		return nil, err
+	}
+	if grant.ID != session.grant {
+		return nil, fmt.Errorf("ICE candidate with the grant of another session")
+	}
+	return session, nil
+}
+
+// pruneSessions forgets the sessions closed since they were opened
+func pruneSessions(sessions map[string]*signalingSession, rtcService rtc.Service) {
+	for id := range sessions {
+		if _, err := rtcService.Session(id); err == rtc.ErrUnknownSession {
+			delete(sessions, id)
+		}
+	}
+}
+
+func sendRoleChanges(conn *websocket.Conn, messageType int, changes []rtc.RoleChange) {
+	for _, change := range changes {
+		writeJSON(conn, messageType, roleResponse{
+			WSType:  "Role",
+			Session: change.Session,
+			Role:    change.Role.String(),
+		})
+	}
+}
+
+func writeJSON(conn *websocket.Conn, messageType int, msg interface{}) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		agentLog.Errorf("Can't encode a signaling message: %v", err)
+		return
+	}
+	if err := conn.WriteMessage(messageType, payload); err != nil {
+		agentLog.Errorf("Can't send a signaling message: %v", err)
 	}
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"oneplay-videostream-browser/internal/rlog"
+	"oneplay-videostream-browser/rtc"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// signalingDisconnects counts the signaling connections lost. The agent
+// doesn't reconnect, so it goes to one when the host drops off signaling.
+var signalingDisconnects = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "oneplay",
+	Subsystem: "signaling",
+	Name:      "disconnects_total",
+	Help:      "Signaling connections lost",
+})
+
+// newMetricsServer serves the session metrics of service, the signaling
+// metrics of the agent and the Go runtime and process metrics at /metrics
+func newMetricsServer(addr string, service rtc.Service) *http.Server {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		service.Metrics(),
+		signalingDisconnects,
+	)
+	errorLog := log.New(agentLog.Writer(rlog.LevelWarn), "", 0)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{ErrorLog: errorLog}))
+	return &http.Server{
+		Addr:     addr,
+		Handler:  mux,
+		ErrorLog: errorLog,
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"oneplay-videostream-browser/internal/rauth"
+	"oneplay-videostream-browser/internal/rtls"
+
+	"github.com/gorilla/websocket"
+)
+
+// registrationTimeout bounds the wait for the host identity
+const registrationTimeout = 10 * time.Second
+
+// hostAuth is the registered identity of the host and the verifier of the
+// session grants of its viewers
+type hostAuth struct {
+	verifier *rauth.Verifier
+	identity *rauth.HostIdentity
+}
+
+// dialSignaling connects to the host endpoint of the signaling server with
+// the host credentials. wss:// servers are verified against the CAs of
+// caFile, the system ones when empty, and the pins if any.
+func dialSignaling(url string, credentials rauth.Credentials, caFile string, pins []string) (*websocket.Conn, error) {
+	header, err := credentials.Header()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := rtls.ClientConfig(caFile, pins)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig.Certificates, err = credentials.Certificates(); err != nil {
+		return nil, err
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+	ws, _, err := dialer.Dial(url, header)
+	return ws, err
+}
+
+// register waits for the signed host identity the signaling server sends
+// once it authenticated the host
+func register(ws *websocket.Conn, verifier *rauth.Verifier) (*hostAuth, error) {
+	ws.SetReadDeadline(time.Now().Add(registrationTimeout))
+	defer ws.SetReadDeadline(time.Time{})
+
+	_, p, err := ws.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	var msg Message
+	if err = json.Unmarshal(p, &msg); err != nil {
+		return nil, err
+	}
+	if msg.WSType != "Registered" {
+		return nil, fmt.Errorf("Expected Registered, got %q", msg.WSType)
+	}
+	identity, err := verifier.HostIdentity(msg.Identity)
+	if err != nil {
+		return nil, err
+	}
+	return &hostAuth{
+		verifier: verifier,
+		identity: identity,
+	}, nil
+}
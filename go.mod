@@ -3,19 +3,33 @@ module oneplay-videostream-browser
 go 1.12
 
 require (
-	github.com/BurntSushi/xgb v0.0.0-20160522181843-27f122750802 // indirect
+	github.com/BurntSushi/xgb v0.0.0-20160522181843-27f122750802
+	github.com/Eyevinn/mp4ff v0.40.2
+	github.com/asticode/go-astits v1.13.0
+	github.com/at-wat/ebml-go v0.17.1
+	github.com/datarhei/gosrt v0.9.0
 	github.com/gen2brain/shm v0.0.0-20180314170312-6c18ff7f8b90 // indirect
 	github.com/gen2brain/x264-go v0.2.0
-	github.com/gen2brain/x264-go/x264c v0.0.0-20210523185153-54bdbefd1212 // indirect
+	github.com/gen2brain/x264-go/x264c v0.0.0-20210523185153-54bdbefd1212
 	github.com/gen2brain/x264-go/yuv v0.0.0-20210523185153-54bdbefd1212 // indirect
+	github.com/golang-jwt/jwt/v4 v4.5.0
 	github.com/google/uuid v1.3.0
-	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/gorilla/websocket v1.5.0
 	github.com/kbinani/screenshot v0.0.0-20190612115439-c3c7d93696f3
 	github.com/lxn/win v0.0.0-20190618153233-9c04a4e8d0b8 // indirect
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
+	github.com/pion/interceptor v0.1.11
+	github.com/pion/rtcp v1.2.9
+	github.com/pion/rtp v1.7.13
 	github.com/pion/sdp v1.3.0
-	github.com/pion/sdp/v3 v3.0.5 // indirect
+	github.com/pion/sdp/v3 v3.0.5
 	github.com/pion/webrtc/v2 v2.1.0
-	github.com/pion/webrtc/v3 v3.1.43 // indirect
-	golang.org/x/net v0.0.0-20220725212005-46097bf591d3 // indirect
+	github.com/pion/webrtc/v3 v3.1.43
+	github.com/prometheus/client_golang v1.11.1
+	github.com/yutopp/go-rtmp v0.0.7
+	go.opentelemetry.io/otel v1.11.2
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.11.2
+	go.opentelemetry.io/otel/sdk v1.11.2
+	go.opentelemetry.io/otel/trace v1.11.2
+	gopkg.in/hraban/opus.v2 v2.0.0-20230925203106-0188a62cb302
 )
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"oneplay-videostream-browser/internal/rauth"
+)
+
+// tokenCookie carries the token of a join link, for players like native
+// HLS that can't set headers
+const tokenCookie = "oneplay_token"
+
+// authorizedHandler is a handler given what the token of the request allows
+type authorizedHandler func(w http.ResponseWriter, r *http.Request, access *rauth.Access)
+
+// guard checks the bearer tokens of the requests, every request has full
+// access when auth is nil
+type guard struct {
+	auth *rauth.Authorizer
+}
+
+// require lets the requests whose token includes role through
+func (g guard) require(role string, next authorizedHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		access := rauth.FullAccess
+		if g.auth != nil {
+			token := bearerToken(r)
+			if token == "" {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			var err error
+			if access, err = g.auth.Authorize(token); err != nil {
+				log.Printf("Unauthorized: %v", err)
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		if !access.Allows(role) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next(w, r, access)
+	}
+}
+
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	if cookie, err := r.Cookie(tokenCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
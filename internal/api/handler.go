@@ -3,21 +3,32 @@ package api
 import (
 	"encoding/json"
 	"fmt"
+	"image"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"oneplay-videostream-browser/internal/encoders"
+	"oneplay-videostream-browser/internal/rauth"
 	"oneplay-videostream-browser/internal/rdisplay"
+	"oneplay-videostream-browser/internal/rmask"
+	"oneplay-videostream-browser/internal/rrecord"
 	"oneplay-videostream-browser/rtc"
 )
 
 func handleError(w http.ResponseWriter, err error) {
-	fmt.Printf("Error: %v", err)
+	log.Printf("API error: %v", err)
 	w.WriteHeader(http.StatusInternalServerError)
 }
 
-// MakeHandler returns an HTTP handler for the session service
-func MakeHandler(webrtc rtc.Service, display rdisplay.Service) http.Handler {
+// MakeHandler returns an HTTP handler for the session service. Requests need
+// a bearer token of auth, and join links can be created, unless auth is nil.
+func MakeHandler(webrtc rtc.Service, display rdisplay.Service, auth *rauth.Authorizer, joinTTL time.Duration) http.Handler {
+	g := guard{auth: auth}
 	mux := http.NewServeMux()
-	mux.HandleFunc("/session", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/session", g.require(rauth.ViewerRole, func(w http.ResponseWriter, r *http.Request, access *rauth.Access) {
 		if r.Method != http.MethodPost {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
@@ -30,21 +41,46 @@ func MakeHandler(webrtc rtc.Service, display rdisplay.Service) http.Handler {
 			return
 		}
 
-		peer, err := webrtc.CreateRemoteScreenConnection(req.Screen, 60)
+		if !access.AllowsScreen(req.Screen) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		// The token caps the role the viewer asks for
+		role := rtc.ParseRole(req.Role)
+		if !access.Allows(rauth.ControllerRole) {
+			role = rtc.RoleViewer
+		}
+
+		peer, err := webrtc.CreateRemoteScreenConnection(req.Screen, 60, rtc.SessionOptions{
+			Cursor:        rdisplay.ParseCursorMode(req.Cursor),
+			Latency:       encoders.ParseProfile(req.Latency),
+			Role:          role,
+			LatencyMarker: req.Marker,
+			Clipboard:     req.Clipboard,
+			Gamepad:       req.Gamepad,
+			Viewer:        access.Subject,
+		})
+		if err == rtc.ErrNotApproved {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
 		if err != nil {
 			handleError(w, err)
 			return
 		}
 
-		peer.ProcessOffer(req.Offer, nil, 0)
-
+		// No trickle over HTTP, the answer waits for every local candidate
+		answer, err := peer.ProcessOffer(r.Context(), req.Offer, nil)
 		if err != nil {
+			peer.Close()
 			handleError(w, err)
 			return
 		}
 
 		payload, err := json.Marshal(newSessionResponse{
-			Answer: "answer",
+			Answer:  answer,
+			Session: peer.ID(),
+			Role:    peer.Role().String(),
 		})
 		if err != nil {
 			handleError(w, err)
@@ -52,9 +88,9 @@ func MakeHandler(webrtc rtc.Service, display rdisplay.Service) http.Handler {
 		}
 
 		w.Write(payload)
-	})
+	}))
 
-	mux.HandleFunc("/screens", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/screens", g.require(rauth.ViewerRole, func(w http.ResponseWriter, r *http.Request, access *rauth.Access) {
 		if r.Method != http.MethodGet {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
@@ -67,10 +103,11 @@ func MakeHandler(webrtc rtc.Service, display rdisplay.Service) http.Handler {
 			return
 		}
 
-		screensPayload := make([]screenPayload, len(screens))
-
-		for i, s := range screens {
-			screensPayload[i].Index = s.Index
+		screensPayload := []screenPayload{}
+		for _, s := range screens {
+			if access.AllowsScreen(s.Index) {
+				screensPayload = append(screensPayload, screenPayload{Index: s.Index})
+			}
 		}
 		payload, err := json.Marshal(screensResponse{
 			Screens: screensPayload,
@@ -81,6 +118,480 @@ func MakeHandler(webrtc rtc.Service, display rdisplay.Service) http.Handler {
 		}
 
 		w.Write(payload)
-	})
+	}))
+
+	mux.HandleFunc("/recording/start", g.require(rauth.AdminRole, func(w http.ResponseWriter, r *http.Request, access *rauth.Access) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		req := recordingRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			handleError(w, err)
+			return
+		}
+
+		if err := webrtc.StartRecording(req.Session, rrecord.ParseFormat(req.Format)); err != nil {
+			handleError(w, err)
+			return
+		}
+		writeJSON(w, recordingResponse{Session: req.Session})
+	}))
+
+	mux.HandleFunc("/recording/stop", g.require(rauth.AdminRole, func(w http.ResponseWriter, r *http.Request, access *rauth.Access) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		req := recordingRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			handleError(w, err)
+			return
+		}
+
+		files, err := webrtc.StopRecording(req.Session)
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		writeJSON(w, recordingResponse{Session: req.Session, Files: files})
+	}))
+
+	mux.HandleFunc("/recordings", g.require(rauth.AdminRole, func(w http.ResponseWriter, r *http.Request, access *rauth.Access) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		recordings, err := webrtc.Recordings()
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+
+		recordingsPayload := make([]recordingPayload, len(recordings))
+		for i, rec := range recordings {
+			recordingsPayload[i] = recordingPayload{
+				Name:     rec.Name,
+				Size:     rec.Size,
+				Modified: rec.Modified,
+			}
+		}
+		writeJSON(w, recordingsResponse{Recordings: recordingsPayload})
+	}))
+
+	// Downloads a recording, GET /recordings/<name>
+	mux.HandleFunc("/recordings/", g.require(rauth.AdminRole, func(w http.ResponseWriter, r *http.Request, access *rauth.Access) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := strings.TrimPrefix(r.URL.Path, "/recordings/")
+		path, err := webrtc.RecordingPath(name)
+		if err != nil {
+			log.Printf("API error: %v", err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		http.ServeFile(w, r, path)
+	}))
+
+	mux.HandleFunc("/egress/start", g.require(rauth.AdminRole, func(w http.ResponseWriter, r *http.Request, access *rauth.Access) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		req := egressRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			handleError(w, err)
+			return
+		}
+
+		if !access.AllowsScreen(req.Screen) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		id, err := webrtc.StartEgress(req.Screen, req.Fps, req.Target)
+		if err == rtc.ErrNotApproved {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		writeJSON(w, egressResponse{ID: id})
+	}))
+
+	mux.HandleFunc("/egress/stop", g.require(rauth.AdminRole, func(w http.ResponseWriter, r *http.Request, access *rauth.Access) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		req := egressRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			handleError(w, err)
+			return
+		}
+
+		if err := webrtc.StopEgress(req.ID); err != nil {
+			handleError(w, err)
+			return
+		}
+		writeJSON(w, egressResponse{ID: req.ID})
+	}))
+
+	mux.HandleFunc("/egresses", g.require(rauth.AdminRole, func(w http.ResponseWriter, r *http.Request, access *rauth.Access) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		egresses := webrtc.Egresses()
+		egressesPayload := make([]egressPayload, len(egresses))
+		for i, e := range egresses {
+			egressesPayload[i] = egressPayload{
+				ID:      e.ID,
+				Screen:  e.Screen,
+				Target:  e.Target,
+				Started: e.Started,
+				Sent:    e.Sent,
+				Dropped: e.Dropped,
+			}
+			if e.Err != nil {
+				egressesPayload[i].Error = e.Err.Error()
+			}
+		}
+		writeJSON(w, egressesResponse{Egresses: egressesPayload})
+	}))
+
+	// Lists the privacy masking rules with GET, replaces them with PUT
+	mux.HandleFunc("/masks", g.require(rauth.AdminRole, func(w http.ResponseWriter, r *http.Request, access *rauth.Access) {
+		switch r.Method {
+		case http.MethodGet:
+			rules, err := webrtc.MaskRules()
+			if err != nil {
+				handleError(w, err)
+				return
+			}
+			rulesPayload := make([]maskRulePayload, len(rules))
+			for i, rule := range rules {
+				rulesPayload[i] = maskRulePayload{
+					Class:  rule.Class,
+					Title:  rule.Title,
+					X:      rule.Rect.Min.X,
+					Y:      rule.Rect.Min.Y,
+					Width:  rule.Rect.Dx(),
+					Height: rule.Rect.Dy(),
+					Style:  rule.Style.String(),
+				}
+			}
+			writeJSON(w, masksPayload{Rules: rulesPayload})
+		case http.MethodPut:
+			req := masksPayload{}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				handleError(w, err)
+				return
+			}
+			rules := make([]rmask.Rule, len(req.Rules))
+			for i, rule := range req.Rules {
+				rules[i] = rmask.Rule{
+					Class: rule.Class,
+					Title: rule.Title,
+					Rect:  image.Rect(rule.X, rule.Y, rule.X+rule.Width, rule.Y+rule.Height),
+					Style: rmask.ParseStyle(rule.Style),
+				}
+			}
+			if err := webrtc.SetMaskRules(rules); err != nil {
+				log.Printf("API error: %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, req)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+
+	mux.HandleFunc("/sessions", g.require(rauth.AdminRole, func(w http.ResponseWriter, r *http.Request, access *rauth.Access) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		sessions := webrtc.Sessions()
+		sessionsPayload := make([]sessionPayload, len(sessions))
+		for i, session := range sessions {
+			sessionsPayload[i] = newSessionPayload(session)
+		}
+		writeJSON(w, sessionsResponse{Sessions: sessionsPayload})
+	}))
+
+	// Inspects a session with GET /sessions/<id>, closes it with DELETE and
+	// returns its stats with GET /sessions/<id>/stats
+	mux.HandleFunc("/sessions/", g.require(rauth.AdminRole, func(w http.ResponseWriter, r *http.Request, access *rauth.Access) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/", 2)
+		id := parts[0]
+		if len(parts) == 2 && parts[1] != "stats" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var err error
+		switch {
+		case len(parts) == 2 && r.Method == http.MethodGet:
+			var stats rtc.SessionStats
+			if stats, err = webrtc.SessionStats(id); err == nil {
+				writeJSON(w, newSessionStatsPayload(id, stats))
+			}
+		case len(parts) == 1 && r.Method == http.MethodGet:
+			var info rtc.SessionInfo
+			if info, err = webrtc.Session(id); err == nil {
+				stats, _ := webrtc.SessionStats(id)
+				writeJSON(w, sessionResponse{
+					sessionPayload: newSessionPayload(info),
+					Stats:          newSessionStatsPayload(id, stats),
+				})
+			}
+		case len(parts) == 1 && r.Method == http.MethodDelete:
+			if err = webrtc.CloseSession(id); err == nil {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err == rtc.ErrUnknownSession {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			handleError(w, err)
+		}
+	}))
+
+	// A viewer asks for control of its own session with POST
+	// /control/request, the host answers with /control/grant or
+	// /control/deny and takes control back with /control/revoke
+	mux.HandleFunc("/control/request", g.require(rauth.ViewerRole, func(w http.ResponseWriter, r *http.Request, access *rauth.Access) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		req := controlRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			handleError(w, err)
+			return
+		}
+
+		info, err := webrtc.Session(req.Session)
+		if err == rtc.ErrUnknownSession {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		if !access.Allows(rauth.AdminRole) && info.Viewer != access.Subject {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if _, err := webrtc.RequestControl(req.Session); err != nil {
+			handleError(w, err)
+			return
+		}
+		writeJSON(w, controlResponse{Session: req.Session})
+	}))
+
+	mux.HandleFunc("/control/", g.require(rauth.AdminRole, func(w http.ResponseWriter, r *http.Request, access *rauth.Access) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		req := controlRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			handleError(w, err)
+			return
+		}
+
+		var changes []rtc.RoleChange
+		var err error
+		switch strings.TrimPrefix(r.URL.Path, "/control/") {
+		case "grant":
+			changes, err = webrtc.GrantControl(req.Session)
+		case "deny":
+			err = webrtc.DenyControl(req.Session)
+		case "revoke":
+			changes, err = webrtc.RevokeControl(req.Session)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		res := controlResponse{Session: req.Session}
+		for _, change := range changes {
+			res.Changes = append(res.Changes, roleChangePayload{
+				Session: change.Session,
+				Role:    change.Role.String(),
+			})
+		}
+		writeJSON(w, res)
+	}))
+
+	if auth != nil {
+		mux.HandleFunc("/join", g.require(rauth.AdminRole, func(w http.ResponseWriter, r *http.Request, access *rauth.Access) {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			req := joinLinkRequest{}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				handleError(w, err)
+				return
+			}
+
+			link, err := auth.CreateJoinLink(req.Screens, req.Role, joinTTL)
+			if err != nil {
+				handleError(w, err)
+				return
+			}
+			writeJSON(w, joinLinkResponse{
+				Path:    "/api/join/" + link.Code,
+				Expires: link.Expires,
+			})
+		}))
+
+		// Uses a join link, GET /join/<code>. The token is also set as a
+		// cookie for the players that can't send it.
+		mux.HandleFunc("/join/", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+
+			token, access, err := auth.Join(strings.TrimPrefix(r.URL.Path, "/join/"))
+			if err != nil {
+				log.Printf("API error: %v", err)
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     tokenCookie,
+				Value:    token,
+				Path:     "/",
+				Expires:  access.Expires,
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteStrictMode,
+			})
+			writeJSON(w, joinResponse{
+				Token:   token,
+				Screens: access.Screens,
+				Role:    access.Role,
+				Expires: access.Expires,
+			})
+		})
+	}
 	return mux
 }
+
+// MakeHLSHandler returns an HTTP handler serving the LL-HLS stream of every
+// screen, the playlist of a screen is /<screen>/index.m3u8. Requests need a
+// bearer token of auth covering the screen unless auth is nil.
+func MakeHLSHandler(webrtc rtc.Service, auth *rauth.Authorizer) http.Handler {
+	g := guard{auth: auth}
+	return g.require(rauth.ViewerRole, func(w http.ResponseWriter, r *http.Request, access *rauth.Access) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, "/")
+		slash := strings.Index(path, "/")
+		if slash < 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		screen, err := strconv.Atoi(path[:slash])
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !access.AllowsScreen(screen) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		stream, err := webrtc.HLSHandler(screen)
+		if err == rtc.ErrNotApproved {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		http.StripPrefix("/"+path[:slash], stream).ServeHTTP(w, r)
+	})
+}
+
+func newSessionPayload(info rtc.SessionInfo) sessionPayload {
+	return sessionPayload{
+		ID:      info.ID,
+		Viewer:  info.Viewer,
+		Screen:  info.Screen,
+		Codec:   info.Codec,
+		Latency: info.Latency,
+		Role:    info.Role.String(),
+		Started: info.Started,
+		State:   info.State,
+	}
+}
+
+func newSessionStatsPayload(session string, stats rtc.SessionStats) sessionStatsPayload {
+	return sessionStatsPayload{
+		Session:         session,
+		Time:            stats.Time,
+		Width:           stats.Width,
+		Height:          stats.Height,
+		CaptureFps:      stats.CaptureFps,
+		EncodeFps:       stats.EncodeFps,
+		SendFps:         stats.SendFps,
+		Bitrate:         stats.Bitrate,
+		Captured:        stats.Stream.Captured,
+		Dropped:         stats.Stream.Dropped,
+		Encoded:         stats.Stream.Encoded,
+		Sent:            stats.Transport.FramesSent,
+		PacketsSent:     stats.Transport.PacketsSent,
+		BytesSent:       stats.Transport.BytesSent,
+		NACKs:           stats.Transport.NACKs,
+		PLIs:            stats.Transport.PLIs,
+		FIRs:            stats.Transport.FIRs,
+		PacketsLost:     stats.Transport.PacketsLost,
+		FractionLost:    stats.Transport.FractionLost,
+		RTT:             millis(stats.Transport.RoundTrip),
+		ICERTT:          millis(stats.ICERoundTrip),
+		LocalCandidate:  stats.LocalCandidate,
+		RemoteCandidate: stats.RemoteCandidate,
+	}
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func writeJSON(w http.ResponseWriter, msg interface{}) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
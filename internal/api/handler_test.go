@@ -0,0 +1,286 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"oneplay-videostream-browser/internal/encoders"
+	"oneplay-videostream-browser/internal/rdisplay"
+	"oneplay-videostream-browser/rtc"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// testScreen is the single screen of the fake display
+var testScreen = rdisplay.Screen{Index: 0, Bounds: image.Rect(0, 0, 64, 48)}
+
+type fakeDisplay struct{}
+
+func (fakeDisplay) CreateScreenGrabber(screen rdisplay.Screen, fps int, cursor rdisplay.CursorMode, queue int) (rdisplay.ScreenGrabber, error) {
+	return &fakeGrabber{
+		screen: screen,
+		fps:    fps,
+		frames: make(chan *rdisplay.Frame),
+		cursor: make(chan *rdisplay.Cursor),
+		stop:   make(chan struct{}),
+	}, nil
+}
+
+func (fakeDisplay) Screens() ([]rdisplay.Screen, error) {
+	return []rdisplay.Screen{testScreen}, nil
+}
+
+type fakeGrabber struct {
+	screen rdisplay.Screen
+	fps    int
+	frames chan *rdisplay.Frame
+	cursor chan *rdisplay.Cursor
+	stop   chan struct{}
+}
+
+func (g *fakeGrabber) Start() {
+	go func() {
+		ticker := time.NewTicker(time.Second / time.Duration(g.fps))
+		defer func() {
+			ticker.Stop()
+			close(g.frames)
+			close(g.cursor)
+		}()
+		for {
+			select {
+			case <-g.stop:
+				return
+			case now := <-ticker.C:
+				frame := &rdisplay.Frame{Image: image.NewRGBA(g.screen.Bounds), Captured: now}
+				select {
+				case g.frames <- frame:
+				default:
+				}
+			}
+		}
+	}()
+}
+
+func (g *fakeGrabber) Frames() <-chan *rdisplay.Frame  { return g.frames }
+func (g *fakeGrabber) Cursor() <-chan *rdisplay.Cursor { return g.cursor }
+func (g *fakeGrabber) Stop()                           { close(g.stop) }
+func (g *fakeGrabber) Fps() int                        { return g.fps }
+func (g *fakeGrabber) Screen() *rdisplay.Screen        { return &g.screen }
+func (g *fakeGrabber) Stats() rdisplay.CaptureStats    { return rdisplay.CaptureStats{} }
+
+type fakeEncoders struct{}
+
+func (fakeEncoders) NewEncoder(codec encoders.VideoCodec, size image.Point, frameRate int, profile encoders.Profile) (encoders.Encoder, error) {
+	return &fakeEncoder{size: size}, nil
+}
+
+func (fakeEncoders) Supports(codec encoders.VideoCodec) bool {
+	return codec == encoders.H264Codec
+}
+
+func (fakeEncoders) NewAudioEncoder(codec encoders.AudioCodec, sampleRate int, channels int) (encoders.AudioEncoder, error) {
+	return nil, fmt.Errorf("Audio codec not supported")
+}
+
+func (fakeEncoders) SupportsAudio(codec encoders.AudioCodec) bool {
+	return false
+}
+
+type fakeEncoder struct {
+	size image.Point
+}
+
+// Encode returns an H.264 access unit delimiter, enough for the packetizer
+func (e *fakeEncoder) Encode(*image.RGBA) ([]byte, error) {
+	return []byte{0, 0, 0, 1, 0x09, 0xf0}, nil
+}
+
+func (e *fakeEncoder) VideoSize() (image.Point, error) { return e.size, nil }
+func (e *fakeEncoder) RequestKeyframe()                {}
+func (e *fakeEncoder) Close() error                    { return nil }
+
+// newViewer returns a peer connection receiving H.264 video and its offer,
+// with every local candidate since there is no trickle over HTTP
+func newViewer(t *testing.T) (*webrtc.PeerConnection, string) {
+	mediaEngine := &webrtc.MediaEngine{}
+	err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeH264,
+			ClockRate:   90000,
+			SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+		},
+		PayloadType: 102,
+	}, webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer, err := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = viewer.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := viewer.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(viewer)
+	if err = viewer.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	return viewer, viewer.LocalDescription().SDP
+}
+
+func TestSession(t *testing.T) {
+	tests := []struct {
+		name   string
+		offer  func(t *testing.T) (*webrtc.PeerConnection, string)
+		status int
+	}{
+		{"offer", newViewer, http.StatusOK},
+		{"malformed offer", func(t *testing.T) (*webrtc.PeerConnection, string) {
+			return nil, "v=0\r\nnot an offer"
+		}, http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := rtc.NewRemoteScreenService(rtc.ServiceConfig{
+				STUN:     "stun:127.0.0.1:3478",
+				Video:    fakeDisplay{},
+				Encoders: fakeEncoders{},
+			})
+			server := httptest.NewServer(MakeHandler(service, fakeDisplay{}, nil, time.Hour))
+			defer server.Close()
+
+			viewer, offer := test.offer(t)
+			if viewer != nil {
+				defer viewer.Close()
+			}
+			body, _ := json.Marshal(newSessionRequest{Offer: offer, Screen: testScreen.Index})
+			res, err := http.Post(server.URL+"/session", "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != test.status {
+				t.Fatalf("status = %d, want %d", res.StatusCode, test.status)
+			}
+
+			if test.status != http.StatusOK {
+				if sessions := service.Sessions(); len(sessions) != 0 {
+					t.Fatalf("%d sessions left after a failed offer", len(sessions))
+				}
+				return
+			}
+
+			var session newSessionResponse
+			if err := json.NewDecoder(res.Body).Decode(&session); err != nil {
+				t.Fatal(err)
+			}
+			if session.Session == "" {
+				t.Fatal("no session in the response")
+			}
+			if !strings.Contains(session.Answer, "a=candidate:") {
+				t.Fatalf("answer without candidates:\n%s", session.Answer)
+			}
+
+			connected := make(chan struct{})
+			viewer.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+				if state == webrtc.ICEConnectionStateConnected {
+					close(connected)
+				}
+			})
+			err = viewer.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: session.Answer})
+			if err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-connected:
+			case <-time.After(10 * time.Second):
+				t.Fatal("viewer never connected")
+			}
+			if err := service.CloseSession(session.Session); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestControl(t *testing.T) {
+	service := rtc.NewRemoteScreenService(rtc.ServiceConfig{
+		STUN:     "stun:127.0.0.1:3478",
+		Video:    fakeDisplay{},
+		Encoders: fakeEncoders{},
+	})
+	server := httptest.NewServer(MakeHandler(service, fakeDisplay{}, nil, time.Hour))
+	defer server.Close()
+
+	controller, err := service.CreateRemoteScreenConnection(testScreen.Index, 30, rtc.SessionOptions{Role: rtc.RoleController})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer controller.Close()
+	viewer, err := service.CreateRemoteScreenConnection(testScreen.Index, 30, rtc.SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer viewer.Close()
+
+	// The steps run in order on the same sessions
+	tests := []struct {
+		name    string
+		path    string
+		session string
+		status  int
+		changes int
+	}{
+		{"grant without a request", "/control/grant", viewer.ID(), http.StatusInternalServerError, 0},
+		{"request", "/control/request", viewer.ID(), http.StatusOK, 0},
+		{"grant", "/control/grant", viewer.ID(), http.StatusOK, 2},
+		{"deny without a request", "/control/deny", controller.ID(), http.StatusInternalServerError, 0},
+		{"revoke", "/control/revoke", viewer.ID(), http.StatusOK, 1},
+		{"unknown action", "/control/take", viewer.ID(), http.StatusNotFound, 0},
+		{"unknown session", "/control/request", "nobody", http.StatusNotFound, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body, _ := json.Marshal(controlRequest{Session: test.session})
+			res, err := http.Post(server.URL+test.path, "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != test.status {
+				t.Fatalf("status = %d, want %d", res.StatusCode, test.status)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			var control controlResponse
+			if err := json.NewDecoder(res.Body).Decode(&control); err != nil {
+				t.Fatal(err)
+			}
+			if len(control.Changes) != test.changes {
+				t.Errorf("%d role changes, want %d", len(control.Changes), test.changes)
+			}
+		})
+	}
+
+	if controller.Role() != rtc.RoleViewer || viewer.Role() != rtc.RoleViewer {
+		t.Errorf("roles %v and %v after the revoke, want viewers", controller.Role(), viewer.Role())
+	}
+}
@@ -1,12 +1,22 @@
 package api
 
+import "time"
+
 type newSessionRequest struct {
-	Offer  string `json:"offer"`
-	Screen int    `json:"screen"`
+	Offer     string `json:"offer"`
+	Screen    int    `json:"screen"`
+	Cursor    string `json:"cursor"`
+	Latency   string `json:"latency"`
+	Role      string `json:"role"`
+	Marker    bool   `json:"marker"`
+	Clipboard bool   `json:"clipboard"`
+	Gamepad   bool   `json:"gamepad"`
 }
 
 type newSessionResponse struct {
-	Answer string `json:"answer"`
+	Answer  string `json:"answer"`
+	Session string `json:"session"`
+	Role    string `json:"role"`
 }
 
 type screenPayload struct {
@@ -16,3 +26,144 @@ type screenPayload struct {
 type screensResponse struct {
 	Screens []screenPayload `json:"screens"`
 }
+
+type recordingRequest struct {
+	Session string `json:"session"`
+	Format  string `json:"format"`
+}
+
+type recordingResponse struct {
+	Session string   `json:"session"`
+	Files   []string `json:"files,omitempty"`
+}
+
+type recordingPayload struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+type recordingsResponse struct {
+	Recordings []recordingPayload `json:"recordings"`
+}
+
+type egressRequest struct {
+	ID     string `json:"id"`
+	Screen int    `json:"screen"`
+	Fps    int    `json:"fps"`
+	Target string `json:"target"`
+}
+
+type egressResponse struct {
+	ID string `json:"id"`
+}
+
+type egressPayload struct {
+	ID      string    `json:"id"`
+	Screen  int       `json:"screen"`
+	Target  string    `json:"target"`
+	Started time.Time `json:"started"`
+	Sent    uint64    `json:"sent"`
+	Dropped uint64    `json:"dropped"`
+	Error   string    `json:"error,omitempty"`
+}
+
+type egressesResponse struct {
+	Egresses []egressPayload `json:"egresses"`
+}
+
+type controlRequest struct {
+	Session string `json:"session"`
+}
+
+type roleChangePayload struct {
+	Session string `json:"session"`
+	Role    string `json:"role"`
+}
+
+// controlResponse lists the sessions whose role changed, for the caller to
+// tell their viewers
+type controlResponse struct {
+	Session string              `json:"session"`
+	Changes []roleChangePayload `json:"changes,omitempty"`
+}
+
+type joinLinkRequest struct {
+	Screens []int  `json:"screens"`
+	Role    string `json:"role"`
+}
+
+type joinLinkResponse struct {
+	Path    string    `json:"path"`
+	Expires time.Time `json:"expires"`
+}
+
+type joinResponse struct {
+	Token   string    `json:"token"`
+	Screens []int     `json:"screens,omitempty"`
+	Role    string    `json:"role"`
+	Expires time.Time `json:"expires"`
+}
+
+type maskRulePayload struct {
+	Class  string `json:"class,omitempty"`
+	Title  string `json:"title,omitempty"`
+	X      int    `json:"x,omitempty"`
+	Y      int    `json:"y,omitempty"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	Style  string `json:"style"`
+}
+
+type masksPayload struct {
+	Rules []maskRulePayload `json:"rules"`
+}
+
+type sessionPayload struct {
+	ID      string    `json:"id"`
+	Viewer  string    `json:"viewer,omitempty"`
+	Screen  int       `json:"screen"`
+	Codec   string    `json:"codec,omitempty"`
+	Latency string    `json:"latency"`
+	Role    string    `json:"role"`
+	Started time.Time `json:"started"`
+	State   string    `json:"state"`
+}
+
+type sessionsResponse struct {
+	Sessions []sessionPayload `json:"sessions"`
+}
+
+// sessionResponse describes a session along with its last stats sample
+type sessionResponse struct {
+	sessionPayload
+	Stats sessionStatsPayload `json:"stats"`
+}
+
+// sessionStatsPayload is the last stats sample of a session, round trip
+// times are in milliseconds and the bitrate in bits per second
+type sessionStatsPayload struct {
+	Session         string    `json:"session"`
+	Time            time.Time `json:"time"`
+	Width           int       `json:"width"`
+	Height          int       `json:"height"`
+	CaptureFps      float64   `json:"captureFps"`
+	EncodeFps       float64   `json:"encodeFps"`
+	SendFps         float64   `json:"sendFps"`
+	Bitrate         float64   `json:"bitrate"`
+	Captured        uint64    `json:"captured"`
+	Dropped         uint64    `json:"dropped"`
+	Encoded         uint64    `json:"encoded"`
+	Sent            uint64    `json:"sent"`
+	PacketsSent     uint64    `json:"packetsSent"`
+	BytesSent       uint64    `json:"bytesSent"`
+	NACKs           uint64    `json:"nacks"`
+	PLIs            uint64    `json:"plis"`
+	FIRs            uint64    `json:"firs"`
+	PacketsLost     int64     `json:"packetsLost"`
+	FractionLost    float64   `json:"fractionLost"`
+	RTT             float64   `json:"rtt"`
+	ICERTT          float64   `json:"iceRtt"`
+	LocalCandidate  string    `json:"localCandidate,omitempty"`
+	RemoteCandidate string    `json:"remoteCandidate,omitempty"`
+}
@@ -0,0 +1,50 @@
+package encoders
+
+import (
+	"encoding/binary"
+
+	"github.com/Eyevinn/mp4ff/avc"
+)
+
+// AccessUnit is an encoded H.264 frame split for containers and protocols
+// that carry the parameter sets apart from the samples
+type AccessUnit struct {
+	// Sample holds the NAL units prefixed with their 4 bytes length
+	Sample   []byte
+	SPS      [][]byte
+	PPS      [][]byte
+	Keyframe bool
+}
+
+// SplitAccessUnit converts an Annex-B frame as output by the H.264 encoder,
+// access unit delimiters are dropped
+func SplitAccessUnit(frame []byte) AccessUnit {
+	var au AccessUnit
+	for _, nalu := range avc.ExtractNalusFromByteStream(frame) {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch avc.GetNaluType(nalu[0]) {
+		case avc.NALU_SPS:
+			au.SPS = append(au.SPS, nalu)
+			continue
+		case avc.NALU_PPS:
+			au.PPS = append(au.PPS, nalu)
+			continue
+		case avc.NALU_AUD:
+			continue
+		case avc.NALU_IDR:
+			au.Keyframe = true
+		}
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(nalu)))
+		au.Sample = append(au.Sample, length[:]...)
+		au.Sample = append(au.Sample, nalu...)
+	}
+	return au
+}
+
+// StartsStream reports whether a decoder can start with the access unit
+func (au AccessUnit) StartsStream() bool {
+	return au.Keyframe && len(au.SPS) > 0 && len(au.PPS) > 0
+}
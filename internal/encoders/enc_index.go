@@ -3,31 +3,45 @@ package encoders
 import (
 	"fmt"
 	"image"
+
+	"oneplay-videostream-browser/internal/rlog"
 )
 
-type encoderFactory = func(size image.Point, frameRate int) (Encoder, error)
+type encoderFactory = func(size image.Point, frameRate int, profile Profile, log *rlog.Logger) (Encoder, error)
+
+type audioEncoderFactory = func(sampleRate int, channels int, log *rlog.Logger) (AudioEncoder, error)
 
 // Index of supported codecs, each encoder should register itself
 // It's implemented this way to support conditional compilation
 // of each encoder.
 var registeredEncoders = make(map[VideoCodec]encoderFactory, 2)
 
+var registeredAudioEncoders = make(map[AudioCodec]audioEncoderFactory, 1)
+
 //EncoderService creates instances of encoders
 type EncoderService struct {
+	log *rlog.Logger
 }
 
-//NewEncoderService creates an encoder factory
-func NewEncoderService() Service {
-	return &EncoderService{}
+//NewEncoderService creates an encoder factory, log can be nil
+func NewEncoderService(log *rlog.Logger) Service {
+	return &EncoderService{log: log}
 }
 
 //NewEncoder creates an instance of an encoder of the selected codec
-func (*EncoderService) NewEncoder(codec VideoCodec, size image.Point, frameRate int) (Encoder, error) {
+func (s *EncoderService) NewEncoder(codec VideoCodec, size image.Point, frameRate int, profile Profile) (Encoder, error) {
 	factory, found := registeredEncoders[codec]
 	if !found {
 		return nil, fmt.Errorf("Codec not supported")
 	}
-	return factory(size, frameRate)
+	log := s.log.With(rlog.F("codec", codecName(codec)))
+	encoder, err := factory(size, frameRate, profile, log)
+	if err != nil {
+		log.Errorf("Can't create the encoder: %v", err)
+		return nil, err
+	}
+	log.Infof("Encoder created for %dx%d at %d fps", size.X, size.Y, frameRate)
+	return encoder, nil
 }
 
 //Supports returns a boolean indicating if the codec is supported
@@ -35,3 +49,35 @@ func (*EncoderService) Supports(codec VideoCodec) bool {
 	_, found := registeredEncoders[codec]
 	return found
 }
+
+//NewAudioEncoder creates an instance of an audio encoder of the selected codec
+func (s *EncoderService) NewAudioEncoder(codec AudioCodec, sampleRate int, channels int) (AudioEncoder, error) {
+	factory, found := registeredAudioEncoders[codec]
+	if !found {
+		return nil, fmt.Errorf("Audio codec not supported")
+	}
+	log := s.log.With(rlog.F("codec", "opus"))
+	encoder, err := factory(sampleRate, channels, log)
+	if err != nil {
+		log.Errorf("Can't create the audio encoder: %v", err)
+		return nil, err
+	}
+	return encoder, nil
+}
+
+//codecName names a codec in the logs
+func codecName(codec VideoCodec) string {
+	switch codec {
+	case H264Codec:
+		return "h264"
+	case VP8Codec:
+		return "vp8"
+	}
+	return "none"
+}
+
+//SupportsAudio returns a boolean indicating if the audio codec is supported
+func (*EncoderService) SupportsAudio(codec AudioCodec) bool {
+	_, found := registeredAudioEncoders[codec]
+	return found
+}
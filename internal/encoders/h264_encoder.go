@@ -4,75 +4,173 @@
 package encoders
 
 import (
-	"bytes"
 	"fmt"
 	"image"
 	"math"
+	"strconv"
+	"sync/atomic"
+	"unsafe"
+
+	"oneplay-videostream-browser/internal/rlog"
 
 	"github.com/gen2brain/x264-go"
+	"github.com/gen2brain/x264-go/x264c"
 )
 
-//H264Encoder h264 encoder
+// H264Encoder h264 encoder
 type H264Encoder struct {
-	buffer   *bytes.Buffer
-	encoder  *x264.Encoder
+	// keyframe is set atomically by RequestKeyframe
+	keyframe int32
+	encoder  *x264c.T
+	// picture is allocated on its own, cgo rejects pointers into memory
+	// holding Go pointers
+	picture  *x264c.Picture
+	yuv      *x264.YCbCr
+	nals     []*x264c.Nal
+	pts      int64
 	realSize image.Point
 }
 
 const h264SupportedProfile = "3.1"
 
-func newH264Encoder(size image.Point, frameRate int) (Encoder, error) {
-	buffer := bytes.NewBuffer(make([]byte, 0))
+// h264SliceMaxSize keeps every low latency slice in a single RTP packet, so
+// the decoder can start on a frame before all of it arrived
+const h264SliceMaxSize = 1200
+
+// h264ProfileOptions are the x264 options of each profile on top of the
+// preset, the stream stays constrained baseline as negotiated in the SDP so
+// neither profile uses B-frames
+func h264ProfileOptions(profile Profile, frameRate int) (preset string, tune string, options [][2]string) {
+	if profile == QualityProfile {
+		return "faster", "", [][2]string{
+			{"bframes", "0"},
+			{"keyint", strconv.Itoa(2 * frameRate)},
+			{"rc-lookahead", strconv.Itoa(frameRate / 2)},
+		}
+	}
+	// zerolatency disables lookahead and frame threads, intra refresh
+	// spreads the keyframe cost over a second instead of periodic IDR
+	// spikes and IDR frames are only sent on request
+	return "veryfast", "zerolatency", [][2]string{
+		{"bframes", "0"},
+		{"rc-lookahead", "0"},
+		{"sync-lookahead", "0"},
+		{"sliced-threads", "1"},
+		{"slice-max-size", strconv.Itoa(h264SliceMaxSize)},
+		{"intra-refresh", "1"},
+		{"keyint", "infinite"},
+		{"scenecut", "0"},
+	}
+}
+
+func newH264Encoder(size image.Point, frameRate int, profile Profile, log *rlog.Logger) (Encoder, error) {
 	realSize, err := findBestSizeForH264Profile(h264SupportedProfile, size)
 	if err != nil {
 		return nil, err
 	}
-	opts := x264.Options{
-		Width:     realSize.X,
-		Height:    realSize.Y,
-		FrameRate: frameRate,
-		Tune:      "zerolatency",
-		Preset:    "veryfast",
-		Profile:   "baseline",
-		LogLevel:  x264.LogWarning,
+	if realSize != size {
+		log.Infof("Scaling %dx%d down to %dx%d for level %s", size.X, size.Y, realSize.X, realSize.Y, h264SupportedProfile)
 	}
-	encoder, err := x264.NewEncoder(buffer, &opts)
-	if err != nil {
-		return nil, err
+
+	param := x264c.Param{}
+	preset, tune, options := h264ProfileOptions(profile, frameRate)
+	log.Debugf("x264 preset %s, tune %s, options %v", preset, tune, options)
+	if x264c.ParamDefaultPreset(&param, preset, tune) < 0 {
+		return nil, fmt.Errorf("x264: invalid preset/tune name")
 	}
-	return &H264Encoder{
-		buffer:   buffer,
-		encoder:  encoder,
+	param.IWidth = int32(realSize.X)
+	param.IHeight = int32(realSize.Y)
+	param.ICsp = x264c.CspI420
+	param.IBitdepth = 8
+	param.ILogLevel = x264c.LogWarning
+	param.BVfrInput = 0
+	param.BRepeatHeaders = 1
+	param.BAnnexb = 1
+	param.IFpsNum = uint32(frameRate)
+	param.IFpsDen = 1
+	for _, option := range options {
+		if x264c.ParamParse(&param, option[0], option[1]) < 0 {
+			return nil, fmt.Errorf("x264: invalid option %s=%s", option[0], option[1])
+		}
+	}
+	if x264c.ParamApplyProfile(&param, "baseline") < 0 {
+		return nil, fmt.Errorf("x264: invalid profile name")
+	}
+
+	e := &H264Encoder{
+		yuv:      x264.NewYCbCr(image.Rect(0, 0, realSize.X, realSize.Y)),
+		picture:  &x264c.Picture{},
+		nals:     make([]*x264c.Nal, 3),
 		realSize: realSize,
-	}, nil
+	}
+	x264c.PictureInit(e.picture)
+	if x264c.PictureAlloc(e.picture, x264c.CspI420, param.IWidth, param.IHeight) < 0 {
+		return nil, fmt.Errorf("x264: cannot allocate the picture")
+	}
+	e.encoder = x264c.EncoderOpen(&param)
+	if e.encoder == nil {
+		x264c.PictureClean(e.picture)
+		return nil, fmt.Errorf("x264: cannot open the encoder")
+	}
+	return e, nil
 }
 
-//Encode encodes a frame into a h264 payload
+// RequestKeyframe makes the next Encode call output an IDR frame
+func (e *H264Encoder) RequestKeyframe() {
+	atomic.StoreInt32(&e.keyframe, 1)
+}
+
+// Encode encodes a frame into a h264 payload, it returns nil while the
+// encoder is buffering frames for its lookahead
 func (e *H264Encoder) Encode(frame *image.RGBA) ([]byte, error) {
-	err := e.encoder.Encode(frame)
-	if err != nil {
-		return nil, err
+	e.yuv.ToYCbCr(frame)
+	copyPlane(e.picture.Img.Plane[0], e.yuv.Y)
+	copyPlane(e.picture.Img.Plane[1], e.yuv.Cb)
+	copyPlane(e.picture.Img.Plane[2], e.yuv.Cr)
+
+	e.picture.IType = x264c.TypeAuto
+	if atomic.CompareAndSwapInt32(&e.keyframe, 1, 0) {
+		// SPS and PPS are repeated in front of every IDR frame
+		e.picture.IType = x264c.TypeIdr
 	}
-	err = e.encoder.Flush()
-	if err != nil {
-		return nil, err
+	e.picture.IPts = e.pts
+	e.pts++
+
+	var picOut x264c.Picture
+	var nnals int32
+	size := x264c.EncoderEncode(e.encoder, e.nals, &nnals, e.picture, &picOut)
+	if size < 0 {
+		return nil, fmt.Errorf("x264: cannot encode picture")
 	}
-	payload := e.buffer.Bytes()
-	e.buffer.Reset()
+	if size == 0 {
+		return nil, nil
+	}
+	// The NAL units of a frame are contiguous in memory and only valid
+	// until the next call
+	payload := make([]byte, size)
+	copy(payload, (*[1 << 30]byte)(e.nals[0].PPayload)[:size:size])
 	return payload, nil
 }
 
-//VideoSize returns the size the other side is expecting
+// copyPlane copies a plane of the converted frame into the C memory of the
+// x264 picture
+func copyPlane(dst unsafe.Pointer, src []byte) {
+	copy((*[1 << 30]byte)(dst)[:len(src):len(src)], src)
+}
+
+// VideoSize returns the size the other side is expecting
 func (e *H264Encoder) VideoSize() (image.Point, error) {
 	return e.realSize, nil
 }
 
-//Close flushes and closes the inner x264 encoder
+// Close closes the inner x264 encoder
 func (e *H264Encoder) Close() error {
-	return e.encoder.Close()
+	x264c.EncoderClose(e.encoder)
+	x264c.PictureClean(e.picture)
+	return nil
 }
 
-//findBestSizeForH264Profile finds the best match given the size constraint and H264 profile
+// findBestSizeForH264Profile finds the best match given the size constraint and H264 profile
 func findBestSizeForH264Profile(profile string, constraints image.Point) (image.Point, error) {
 	profileSizes := map[string][]image.Point{
 		"3.1": []image.Point{
@@ -0,0 +1,57 @@
+//go:build opusenc
+// +build opusenc
+
+package encoders
+
+import (
+	"oneplay-videostream-browser/internal/rlog"
+
+	"gopkg.in/hraban/opus.v2"
+)
+
+// opusMaxPacket is the largest Opus packet recommended by the spec
+const opusMaxPacket = 1275
+
+//OpusEncoder opus encoder
+type OpusEncoder struct {
+	encoder *opus.Encoder
+	buffer  []byte
+}
+
+func newOpusEncoder(sampleRate int, channels int, log *rlog.Logger) (AudioEncoder, error) {
+	encoder, err := opus.NewEncoder(sampleRate, channels, opus.AppAudio)
+	if err != nil {
+		return nil, err
+	}
+	if err = encoder.SetBitrate(128000); err != nil {
+		return nil, err
+	}
+	if err = encoder.SetInBandFEC(true); err != nil {
+		return nil, err
+	}
+	log.Debugf("Opus encoder at %d Hz, %d channels, 128 kbps with in-band FEC", sampleRate, channels)
+	return &OpusEncoder{
+		encoder: encoder,
+		buffer:  make([]byte, opusMaxPacket),
+	}, nil
+}
+
+//Encode encodes a frame of interleaved PCM into an opus packet
+func (e *OpusEncoder) Encode(pcm []int16) ([]byte, error) {
+	n, err := e.encoder.Encode(pcm, e.buffer)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, n)
+	copy(payload, e.buffer[:n])
+	return payload, nil
+}
+
+//Close releases the encoder, libopus state is garbage collected
+func (e *OpusEncoder) Close() error {
+	return nil
+}
+
+func init() {
+	registeredAudioEncoders[OpusCodec] = newOpusEncoder
+}
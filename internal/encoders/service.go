@@ -3,12 +3,15 @@ package encoders
 import (
 	"image"
 	"io"
+	"strings"
 )
 
 // Service creates encoder instances
 type Service interface {
-	NewEncoder(codec VideoCodec, size image.Point, frameRate int) (Encoder, error)
+	NewEncoder(codec VideoCodec, size image.Point, frameRate int, profile Profile) (Encoder, error)
 	Supports(codec VideoCodec) bool
+	NewAudioEncoder(codec AudioCodec, sampleRate int, channels int) (AudioEncoder, error)
+	SupportsAudio(codec AudioCodec) bool
 }
 
 // Encoder takes an image/frame and encodes it
@@ -16,6 +19,9 @@ type Encoder interface {
 	io.Closer
 	Encode(*image.RGBA) ([]byte, error)
 	VideoSize() (image.Point, error)
+	// RequestKeyframe makes the next encoded frame a keyframe, safe to call
+	// from any goroutine
+	RequestKeyframe()
 }
 
 //VideoCodec can be either h264 or vp8
@@ -29,3 +35,38 @@ const (
 	//VP8Codec vp8
 	VP8Codec
 )
+
+//Profile trades latency against picture quality
+type Profile = int
+
+const (
+	//LowLatencyProfile no lookahead, sliced encoding and intra refresh
+	LowLatencyProfile Profile = iota
+	//QualityProfile lookahead and periodic keyframes, adds a few frames of delay
+	QualityProfile
+)
+
+//ParseProfile maps the signaling/API names to a Profile, unknown values fall
+//back to LowLatencyProfile
+func ParseProfile(profile string) Profile {
+	if strings.ToLower(profile) == "quality" {
+		return QualityProfile
+	}
+	return LowLatencyProfile
+}
+
+// AudioEncoder takes a frame of interleaved PCM samples and encodes it
+type AudioEncoder interface {
+	io.Closer
+	Encode(pcm []int16) ([]byte, error)
+}
+
+//AudioCodec only opus for now
+type AudioCodec = int
+
+const (
+	//NoAudioCodec "zero-value"
+	NoAudioCodec AudioCodec = iota
+	//OpusCodec opus
+	OpusCodec
+)
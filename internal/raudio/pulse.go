@@ -0,0 +1,113 @@
+package raudio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strconv"
+)
+
+// defaultMonitorDevice is the monitor of the default sink, what is being
+// played on the host. PipeWire exposes it through pipewire-pulse as well.
+const defaultMonitorDevice = "@DEFAULT_MONITOR@"
+
+// audioBacklog is how many frames may wait for the encoder, 100ms
+const audioBacklog = 5
+
+// PulseAudioProvider implements the raudio.Service interface by recording
+// a PulseAudio/PipeWire monitor source with parec
+type PulseAudioProvider struct {
+	device string
+}
+
+// PulseAudioSource records a monitor source through a parec process
+type PulseAudioSource struct {
+	device string
+	cmd    *exec.Cmd
+	frames chan []int16
+}
+
+// NewAudioProvider returns a PulseAudio-based audio provider capturing
+// device, the default sink monitor when empty
+func NewAudioProvider(device string) (Service, error) {
+	if _, err := exec.LookPath("parec"); err != nil {
+		return nil, fmt.Errorf("parec not found, install pulseaudio-utils: %v", err)
+	}
+	if device == "" {
+		device = defaultMonitorDevice
+	}
+	return &PulseAudioProvider{device: device}, nil
+}
+
+// CreateAudioSource creates a recorder of the provider's device
+func (p *PulseAudioProvider) CreateAudioSource() (AudioSource, error) {
+	return &PulseAudioSource{
+		device: p.device,
+		frames: make(chan []int16, audioBacklog),
+	}, nil
+}
+
+// Frames returns a channel that will receive the audio frames
+func (s *PulseAudioSource) Frames() <-chan []int16 {
+	return s.frames
+}
+
+// Start launches parec and the frame reading loop
+func (s *PulseAudioSource) Start() error {
+	s.cmd = exec.Command("parec",
+		"--device="+s.device,
+		"--format=s16le",
+		"--rate="+strconv.Itoa(SampleRate),
+		"--channels="+strconv.Itoa(Channels),
+		"--latency-msec=20",
+		"--raw",
+	)
+	stdout, err := s.cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = s.cmd.Start(); err != nil {
+		return err
+	}
+	go s.read(bufio.NewReader(stdout))
+	return nil
+}
+
+func (s *PulseAudioSource) read(r io.Reader) {
+	defer close(s.frames)
+	raw := make([]byte, FrameSamples*Channels*2)
+	for {
+		if _, err := io.ReadFull(r, raw); err != nil {
+			if err != io.EOF {
+				log.Printf("Audio capture: %v", err)
+			}
+			return
+		}
+		frame := make([]int16, FrameSamples*Channels)
+		for i := range frame {
+			frame[i] = int16(binary.LittleEndian.Uint16(raw[i*2:]))
+		}
+		// Once the backlog is full the oldest frame is dropped so audio
+		// doesn't lag behind
+		select {
+		case s.frames <- frame:
+		default:
+			select {
+			case <-s.frames:
+			default:
+			}
+			s.frames <- frame
+		}
+	}
+}
+
+// Stop kills the parec process, which ends the reading loop
+func (s *PulseAudioSource) Stop() {
+	if s.cmd != nil && s.cmd.Process != nil {
+		s.cmd.Process.Kill()
+		s.cmd.Wait()
+	}
+}
@@ -0,0 +1,23 @@
+package raudio
+
+const (
+	// SampleRate of the captured PCM, the Opus native rate
+	SampleRate = 48000
+	// Channels of the captured PCM
+	Channels = 2
+	// FrameSamples is the number of samples per channel in a 20ms frame
+	FrameSamples = SampleRate / 50
+)
+
+// AudioSource captures the host audio output as 20ms frames of interleaved
+// signed 16 bits PCM
+type AudioSource interface {
+	Start() error
+	Frames() <-chan []int16
+	Stop()
+}
+
+// Service creates audio sources
+type Service interface {
+	CreateAudioSource() (AudioSource, error)
+}
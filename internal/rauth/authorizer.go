@@ -0,0 +1,278 @@
+package rauth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Roles of the API tokens, each one includes the ones before it
+const (
+	ViewerRole     = "viewer"
+	ControllerRole = "controller"
+	// AdminRole also manages recordings, egresses and join links
+	AdminRole = "admin"
+)
+
+const (
+	// agentIssuer is the issuer of the tokens the agent signs itself when a
+	// join link is used
+	agentIssuer = "oneplay-agent"
+	// joinTokenLifetime is how long the token of a join link lets its
+	// viewer use the API
+	joinTokenLifetime = 8 * time.Hour
+	// joinCodeSize is the entropy of join links, in bytes
+	joinCodeSize = 16
+)
+
+// Issuer is a token issuer the API trusts
+type Issuer struct {
+	Name string
+	Key  crypto.PublicKey
+}
+
+// ParseIssuers parses a comma separated list of name=keyfile pairs
+func ParseIssuers(list string) ([]Issuer, error) {
+	var issuers []Issuer
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		eq := strings.Index(item, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("Invalid issuer %q, expected name=keyfile", item)
+		}
+		key, err := LoadPublicKey(item[eq+1:])
+		if err != nil {
+			return nil, err
+		}
+		issuers = append(issuers, Issuer{Name: item[:eq], Key: key})
+	}
+	return issuers, nil
+}
+
+// Access is what a token allows on the API
+type Access struct {
+	Subject string
+	Screens []int
+	Role    string
+	Expires time.Time
+}
+
+// FullAccess is the access of every request when the API doesn't require
+// tokens
+var FullAccess = &Access{Role: AdminRole}
+
+// AllowsScreen reports whether the token covers screen, a token without
+// screens covers all of them
+func (a *Access) AllowsScreen(screen int) bool {
+	return allowsScreen(a.Screens, screen)
+}
+
+// Allows reports whether the role of the token includes role
+func (a *Access) Allows(role string) bool {
+	return roleRank(a.Role) >= roleRank(role)
+}
+
+// JoinLink lets one viewer in without a token of a trusted issuer, the
+// code is only good once and until Expires
+type JoinLink struct {
+	Code    string
+	Screens []int
+	Role    string
+	Expires time.Time
+}
+
+// apiClaims are the claims of an API token
+type apiClaims struct {
+	jwt.RegisteredClaims
+	Screens []int  `json:"screens,omitempty"`
+	Role    string `json:"role,omitempty"`
+}
+
+// Authorizer checks the bearer tokens of the API. It trusts the keys of the
+// configured issuers and signs the tokens of its own join links.
+type Authorizer struct {
+	issuers  map[string]crypto.PublicKey
+	audience string
+	secret   []byte
+
+	mu    sync.Mutex
+	links map[string]*JoinLink
+}
+
+// NewAuthorizer trusts the tokens of issuers, audience is the expected aud
+// claim and isn't checked when empty
+func NewAuthorizer(issuers []Issuer, audience string) (*Authorizer, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	a := &Authorizer{
+		issuers:  make(map[string]crypto.PublicKey),
+		audience: audience,
+		secret:   secret,
+		links:    make(map[string]*JoinLink),
+	}
+	for _, issuer := range issuers {
+		if issuer.Name == agentIssuer {
+			return nil, fmt.Errorf("Issuer name %q is reserved", agentIssuer)
+		}
+		a.issuers[issuer.Name] = issuer.Key
+	}
+	return a, nil
+}
+
+// Authorize verifies token and returns what it allows
+func (a *Authorizer) Authorize(token string) (*Access, error) {
+	claims := &apiClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if claims.Issuer == agentIssuer {
+			if t.Method != jwt.SigningMethodHS256 {
+				return nil, fmt.Errorf("Unexpected signing method %s", t.Method.Alg())
+			}
+			return a.secret, nil
+		}
+		key, found := a.issuers[claims.Issuer]
+		if !found {
+			return nil, fmt.Errorf("Unknown issuer %q", claims.Issuer)
+		}
+		if !hasElement(signingMethods(key), t.Method.Alg()) {
+			return nil, fmt.Errorf("Unexpected signing method %s", t.Method.Alg())
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("Token without expiry")
+	}
+	if a.audience != "" && claims.Issuer != agentIssuer && !claims.VerifyAudience(a.audience, true) {
+		return nil, fmt.Errorf("Token issued for another audience")
+	}
+	if roleRank(claims.Role) < 0 {
+		return nil, fmt.Errorf("Unknown role %q", claims.Role)
+	}
+	role := claims.Role
+	if role == "" {
+		role = ViewerRole
+	}
+	return &Access{
+		Subject: claims.Subject,
+		Screens: claims.Screens,
+		Role:    role,
+		Expires: claims.ExpiresAt.Time,
+	}, nil
+}
+
+// CreateJoinLink creates a one-time link for a viewer of screens, all of
+// them when empty, that expires after ttl
+func (a *Authorizer) CreateJoinLink(screens []int, role string, ttl time.Duration) (*JoinLink, error) {
+	if role == "" {
+		role = ViewerRole
+	}
+	// A join link can't hand out the management of the host
+	if roleRank(role) < 0 || roleRank(role) > roleRank(ControllerRole) {
+		return nil, fmt.Errorf("Invalid join link role %q", role)
+	}
+	code := make([]byte, joinCodeSize)
+	if _, err := rand.Read(code); err != nil {
+		return nil, err
+	}
+	link := &JoinLink{
+		Code:    base64.RawURLEncoding.EncodeToString(code),
+		Screens: screens,
+		Role:    role,
+		Expires: time.Now().Add(ttl),
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.expireLinks()
+	a.links[link.Code] = link
+	return link, nil
+}
+
+// Join consumes a join link and returns the token of its viewer
+func (a *Authorizer) Join(code string) (string, *Access, error) {
+	a.mu.Lock()
+	a.expireLinks()
+	link, found := a.links[code]
+	delete(a.links, code)
+	a.mu.Unlock()
+	if !found {
+		return "", nil, fmt.Errorf("Unknown or expired join link")
+	}
+
+	access := &Access{
+		Subject: "join-" + code[:8],
+		Screens: link.Screens,
+		Role:    link.Role,
+		Expires: time.Now().Add(joinTokenLifetime),
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &apiClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    agentIssuer,
+			Subject:   access.Subject,
+			ExpiresAt: jwt.NewNumericDate(access.Expires),
+		},
+		Screens: access.Screens,
+		Role:    access.Role,
+	}).SignedString(a.secret)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, access, nil
+}
+
+// expireLinks drops the links past their expiry, a.mu must be held
+func (a *Authorizer) expireLinks() {
+	now := time.Now()
+	for code, link := range a.links {
+		if now.After(link.Expires) {
+			delete(a.links, code)
+		}
+	}
+}
+
+// roleRank orders the roles, unknown ones are negative
+func roleRank(role string) int {
+	switch role {
+	case "", ViewerRole:
+		return 0
+	case ControllerRole:
+		return 1
+	case AdminRole:
+		return 2
+	}
+	return -1
+}
+
+func allowsScreen(screens []int, screen int) bool {
+	if len(screens) == 0 {
+		return true
+	}
+	for _, s := range screens {
+		if s == screen {
+			return true
+		}
+	}
+	return false
+}
+
+func hasElement(haystack []string, needle string) bool {
+	for _, item := range haystack {
+		if item == needle {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package rauth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestAuthorize(t *testing.T) {
+	public, private := newKey(t)
+	_, otherPrivate := newKey(t)
+	authorizer, err := NewAuthorizer([]Issuer{{Name: testIssuer, Key: public}}, "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := func(edit func(*apiClaims)) *apiClaims {
+		c := &apiClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    testIssuer,
+				Subject:   "alice",
+				Audience:  jwt.ClaimStrings{"agent"},
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			},
+			Screens: []int{0},
+			Role:    AdminRole,
+		}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		role  string
+	}{
+		{"valid", sign(t, private, claims(nil)), AdminRole},
+		{"default role", sign(t, private, claims(func(c *apiClaims) { c.Role = "" })), ViewerRole},
+		{"expired", sign(t, private, claims(func(c *apiClaims) {
+			c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Second))
+		})), ""},
+		{"without expiry", sign(t, private, claims(func(c *apiClaims) { c.ExpiresAt = nil })), ""},
+		{"other audience", sign(t, private, claims(func(c *apiClaims) { c.Audience = jwt.ClaimStrings{"elsewhere"} })), ""},
+		{"unknown issuer", sign(t, private, claims(func(c *apiClaims) { c.Issuer = "someone" })), ""},
+		{"unknown role", sign(t, private, claims(func(c *apiClaims) { c.Role = "root" })), ""},
+		{"other key", sign(t, otherPrivate, claims(nil)), ""},
+		// The agent only trusts its own secret for its issuer
+		{"agent issuer", sign(t, private, claims(func(c *apiClaims) { c.Issuer = agentIssuer })), ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			access, err := authorizer.Authorize(test.token)
+			if test.role == "" {
+				if err == nil {
+					t.Fatal("accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("rejected: %v", err)
+			}
+			if access.Subject != "alice" || access.Role != test.role {
+				t.Errorf("unexpected access %+v", access)
+			}
+		})
+	}
+}
+
+func TestJoinLink(t *testing.T) {
+	tests := []struct {
+		name  string
+		role  string
+		ttl   time.Duration
+		valid bool
+	}{
+		{"viewer", ViewerRole, time.Minute, true},
+		{"controller", ControllerRole, time.Minute, true},
+		{"expired", ViewerRole, -time.Second, true},
+		{"admin", AdminRole, time.Minute, false},
+		{"unknown role", "root", time.Minute, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authorizer, err := NewAuthorizer(nil, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			link, err := authorizer.CreateJoinLink([]int{2}, test.role, test.ttl)
+			if !test.valid {
+				if err == nil {
+					t.Fatal("created")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token, access, err := authorizer.Join(link.Code)
+			if test.ttl < 0 {
+				if err == nil {
+					t.Fatal("expired link joined")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if access.Role != test.role || !access.AllowsScreen(2) || access.AllowsScreen(0) {
+				t.Errorf("unexpected access %+v", access)
+			}
+			if _, _, err := authorizer.Join(link.Code); err == nil {
+				t.Error("joined twice")
+			}
+			verified, err := authorizer.Authorize(token)
+			if err != nil {
+				t.Fatalf("join token rejected: %v", err)
+			}
+			if verified.Subject != access.Subject || verified.Role != test.role {
+				t.Errorf("join token gives %+v, want %+v", verified, access)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package rauth
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Credentials authenticate the host to the signaling server, with a bearer
+// token, a TLS client certificate or both
+type Credentials struct {
+	// TokenFile holds the host token, kept out of the command line
+	TokenFile string
+	CertFile  string
+	KeyFile   string
+}
+
+// Header returns the headers of the signaling handshake
+func (c Credentials) Header() (http.Header, error) {
+	header := http.Header{}
+	if c.TokenFile == "" {
+		return header, nil
+	}
+	token, err := ioutil.ReadFile(c.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+	header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	return header, nil
+}
+
+// Certificates returns the client certificate for wss:// URLs, none
+// without a certificate file
+func (c Credentials) Certificates() ([]tls.Certificate, error) {
+	if c.CertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return []tls.Certificate{cert}, nil
+}
@@ -0,0 +1,97 @@
+package rauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Token kinds, the kind claim keeps a token issued for one purpose from
+// being accepted for another
+const (
+	HostKind  = "host"
+	GrantKind = "grant"
+)
+
+// HostIdentity is the identity the signaling server hands out to a host
+// once it authenticated
+type HostIdentity struct {
+	HostID  string
+	Issuer  string
+	Expires time.Time
+}
+
+// SessionGrant is what the signaling server allows a viewer to do on a
+// host, a grant is only good for one session
+type SessionGrant struct {
+	ID      string
+	HostID  string
+	Viewer  string
+	Screens []int
+	Role    string
+	Expires time.Time
+}
+
+// AllowsScreen reports whether the grant covers screen, a grant without
+// screens covers all of them
+func (g *SessionGrant) AllowsScreen(screen int) bool {
+	return allowsScreen(g.Screens, screen)
+}
+
+// Allows reports whether the role of the grant includes role
+func (g *SessionGrant) Allows(role string) bool {
+	return roleRank(g.Role) >= roleRank(role)
+}
+
+// LoadPublicKey reads a PEM encoded RSA, ECDSA or Ed25519 public key, or the
+// key of a certificate
+func LoadPublicKey(file string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data in %s", file)
+	}
+
+	var key crypto.PublicKey
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(signingMethods(key)) == 0 {
+		return nil, fmt.Errorf("Unsupported key type %T in %s", key, file)
+	}
+	return key, nil
+}
+
+// signingMethods returns the JWT algorithms a key verifies
+func signingMethods(key crypto.PublicKey) []string {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}
+	case *ecdsa.PublicKey:
+		return []string{"ES256", "ES384", "ES512"}
+	case ed25519.PublicKey:
+		return []string{"EdDSA"}
+	}
+	return nil
+}
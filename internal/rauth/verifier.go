@@ -0,0 +1,176 @@
+package rauth
+
+import (
+	"crypto"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// hostClaims are the claims of a host identity, the subject is the host
+type hostClaims struct {
+	jwt.RegisteredClaims
+	Kind string `json:"kind"`
+}
+
+// grantClaims are the claims of a session grant, the subject is the viewer
+// and the audience the host
+type grantClaims struct {
+	jwt.RegisteredClaims
+	Kind    string `json:"kind"`
+	Screens []int  `json:"screens,omitempty"`
+	Role    string `json:"role,omitempty"`
+}
+
+// kindClaims are the claims of the tokens of the signaling server
+type kindClaims interface {
+	jwt.Claims
+	registered() *jwt.RegisteredClaims
+	kind() string
+}
+
+// Verifier checks the tokens signed by the signaling server. Grants are
+// remembered until they expire so that each one opens a single session.
+type Verifier struct {
+	key    crypto.PublicKey
+	issuer string
+	parser *jwt.Parser
+
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+// NewVerifier verifies tokens signed with key, issuer is the expected iss
+// claim and isn't checked when empty
+func NewVerifier(key crypto.PublicKey, issuer string) *Verifier {
+	return &Verifier{
+		key:    key,
+		issuer: issuer,
+		parser: jwt.NewParser(jwt.WithValidMethods(signingMethods(key))),
+		used:   make(map[string]time.Time),
+	}
+}
+
+// HostIdentity verifies the identity handed out at registration
+func (v *Verifier) HostIdentity(token string) (*HostIdentity, error) {
+	claims := &hostClaims{}
+	if err := v.parse(token, claims, HostKind); err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("Host identity without a host")
+	}
+	return &HostIdentity{
+		HostID:  claims.Subject,
+		Issuer:  claims.Issuer,
+		Expires: expiry(&claims.RegisteredClaims),
+	}, nil
+}
+
+// Grant verifies the session grant of a viewer of host and consumes it
+func (v *Verifier) Grant(token string, host *HostIdentity) (*SessionGrant, error) {
+	claims, err := v.verifyGrant(token, host)
+	if err != nil {
+		return nil, err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := time.Now()
+	for id, expires := range v.used {
+		if now.After(expires) {
+			delete(v.used, id)
+		}
+	}
+	if _, found := v.used[claims.ID]; found {
+		return nil, fmt.Errorf("Session grant already used")
+	}
+	v.used[claims.ID] = claims.ExpiresAt.Time
+	return newSessionGrant(claims, host), nil
+}
+
+// UsedGrant verifies a session grant Grant consumed already, for the
+// messages that ride on the one that used it
+func (v *Verifier) UsedGrant(token string, host *HostIdentity) (*SessionGrant, error) {
+	claims, err := v.verifyGrant(token, host)
+	if err != nil {
+		return nil, err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, found := v.used[claims.ID]; !found {
+		return nil, fmt.Errorf("Session grant not used yet")
+	}
+	return newSessionGrant(claims, host), nil
+}
+
+// verifyGrant checks a session grant was issued for host
+func (v *Verifier) verifyGrant(token string, host *HostIdentity) (*grantClaims, error) {
+	claims := &grantClaims{}
+	if err := v.parse(token, claims, GrantKind); err != nil {
+		return nil, err
+	}
+	if !claims.VerifyAudience(host.HostID, true) {
+		return nil, fmt.Errorf("Session grant issued for another host")
+	}
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("Session grant without id or expiry")
+	}
+	return claims, nil
+}
+
+func newSessionGrant(claims *grantClaims, host *HostIdentity) *SessionGrant {
+	return &SessionGrant{
+		ID:      claims.ID,
+		HostID:  host.HostID,
+		Viewer:  claims.Subject,
+		Screens: claims.Screens,
+		Role:    claims.Role,
+		Expires: claims.ExpiresAt.Time,
+	}
+}
+
+// parse checks the signature, the time claims, the issuer and the kind of
+// token
+func (v *Verifier) parse(token string, claims kindClaims, kind string) error {
+	_, err := v.parser.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return v.key, nil
+	})
+	if err != nil {
+		return err
+	}
+	registered := claims.registered()
+	if v.issuer != "" && !registered.VerifyIssuer(v.issuer, true) {
+		return fmt.Errorf("Token issued by %q", registered.Issuer)
+	}
+	if claims.kind() != kind {
+		return fmt.Errorf("Expected a %s token, got %q", kind, claims.kind())
+	}
+	return nil
+}
+
+func (c *hostClaims) registered() *jwt.RegisteredClaims {
+	return &c.RegisteredClaims
+}
+
+func (c *hostClaims) kind() string {
+	return c.Kind
+}
+
+func (c *grantClaims) registered() *jwt.RegisteredClaims {
+	return &c.RegisteredClaims
+}
+
+func (c *grantClaims) kind() string {
+	return c.Kind
+}
+
+func expiry(claims *jwt.RegisteredClaims) time.Time {
+	if claims.ExpiresAt == nil {
+		return time.Time{}
+	}
+	return claims.ExpiresAt.Time
+}
@@ -0,0 +1,251 @@
+package rauth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const testIssuer = "signaling"
+
+func newKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, private
+}
+
+func sign(t *testing.T, key crypto.PrivateKey, claims jwt.Claims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// grant returns the claims of a valid grant of viewer bob on host-1, edit
+// changes them
+func grant(id string, edit func(*grantClaims)) *grantClaims {
+	claims := &grantClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        id,
+			Issuer:    testIssuer,
+			Subject:   "bob",
+			Audience:  jwt.ClaimStrings{"host-1"},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+		Kind:    GrantKind,
+		Screens: []int{1},
+		Role:    ControllerRole,
+	}
+	if edit != nil {
+		edit(claims)
+	}
+	return claims
+}
+
+func TestGrant(t *testing.T) {
+	public, private := newKey(t)
+	_, otherPrivate := newKey(t)
+	host := &HostIdentity{HostID: "host-1"}
+
+	tests := []struct {
+		name  string
+		token func(t *testing.T) string
+		valid bool
+	}{
+		{"valid", func(t *testing.T) string {
+			return sign(t, private, grant("valid", nil))
+		}, true},
+		{"expired", func(t *testing.T) string {
+			return sign(t, private, grant("expired", func(c *grantClaims) {
+				c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Second))
+			}))
+		}, false},
+		{"not valid yet", func(t *testing.T) string {
+			return sign(t, private, grant("early", func(c *grantClaims) {
+				c.NotBefore = jwt.NewNumericDate(time.Now().Add(time.Minute))
+			}))
+		}, false},
+		{"without expiry", func(t *testing.T) string {
+			return sign(t, private, grant("forever", func(c *grantClaims) {
+				c.ExpiresAt = nil
+			}))
+		}, false},
+		{"without id", func(t *testing.T) string {
+			return sign(t, private, grant("", nil))
+		}, false},
+		{"other host", func(t *testing.T) string {
+			return sign(t, private, grant("other-host", func(c *grantClaims) {
+				c.Audience = jwt.ClaimStrings{"host-2"}
+			}))
+		}, false},
+		{"other issuer", func(t *testing.T) string {
+			return sign(t, private, grant("other-issuer", func(c *grantClaims) {
+				c.Issuer = "someone"
+			}))
+		}, false},
+		{"host identity", func(t *testing.T) string {
+			return sign(t, private, grant("host-kind", func(c *grantClaims) {
+				c.Kind = HostKind
+			}))
+		}, false},
+		{"other key", func(t *testing.T) string {
+			return sign(t, otherPrivate, grant("other-key", nil))
+		}, false},
+		{"unsigned", func(t *testing.T) string {
+			token, err := jwt.NewWithClaims(jwt.SigningMethodNone, grant("none", nil)).SignedString(jwt.UnsafeAllowNoneSignatureType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return token
+		}, false},
+		{"garbage", func(t *testing.T) string {
+			return "not a token"
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifier := NewVerifier(public, testIssuer)
+			g, err := verifier.Grant(test.token(t), host)
+			if !test.valid {
+				if err == nil {
+					t.Fatal("accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("rejected: %v", err)
+			}
+			if g.Viewer != "bob" || g.HostID != "host-1" || g.Role != ControllerRole {
+				t.Errorf("unexpected grant %+v", g)
+			}
+			if !g.AllowsScreen(1) || g.AllowsScreen(0) {
+				t.Errorf("grant of screens %v", g.Screens)
+			}
+		})
+	}
+}
+
+func TestGrantIsSingleUse(t *testing.T) {
+	public, private := newKey(t)
+	host := &HostIdentity{HostID: "host-1"}
+	verifier := NewVerifier(public, testIssuer)
+	token := sign(t, private, grant("once", nil))
+
+	if _, err := verifier.Grant(token, host); err != nil {
+		t.Fatalf("rejected: %v", err)
+	}
+	if _, err := verifier.Grant(token, host); err == nil {
+		t.Fatal("accepted twice")
+	}
+	// Another grant is still good
+	if _, err := verifier.Grant(sign(t, private, grant("twice", nil)), host); err != nil {
+		t.Fatalf("rejected: %v", err)
+	}
+}
+
+func TestUsedGrant(t *testing.T) {
+	public, private := newKey(t)
+	host := &HostIdentity{HostID: "host-1"}
+	verifier := NewVerifier(public, testIssuer)
+	token := sign(t, private, grant("offer", nil))
+
+	if _, err := verifier.UsedGrant(token, host); err == nil {
+		t.Fatal("accepted before use")
+	}
+	if _, err := verifier.Grant(token, host); err != nil {
+		t.Fatalf("rejected: %v", err)
+	}
+	g, err := verifier.UsedGrant(token, host)
+	if err != nil {
+		t.Fatalf("rejected after use: %v", err)
+	}
+	if g.ID != "offer" {
+		t.Errorf("unexpected grant %+v", g)
+	}
+	// Checking a used grant doesn't use it up
+	if _, err := verifier.UsedGrant(token, host); err != nil {
+		t.Fatalf("rejected twice: %v", err)
+	}
+	if _, err := verifier.UsedGrant(token, &HostIdentity{HostID: "host-2"}); err == nil {
+		t.Fatal("accepted for another host")
+	}
+}
+
+func TestGrantAllows(t *testing.T) {
+	tests := []struct {
+		grant string
+		role  string
+		want  bool
+	}{
+		{"", ViewerRole, true},
+		{"", ControllerRole, false},
+		{ViewerRole, ControllerRole, false},
+		{ControllerRole, ControllerRole, true},
+		{ControllerRole, AdminRole, false},
+		{AdminRole, ControllerRole, true},
+		{"root", ViewerRole, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.grant+"/"+test.role, func(t *testing.T) {
+			g := &SessionGrant{Role: test.grant}
+			if got := g.Allows(test.role); got != test.want {
+				t.Errorf("Allows(%q) = %v, want %v", test.role, got, test.want)
+			}
+		})
+	}
+}
+
+func TestHostIdentity(t *testing.T) {
+	public, private := newKey(t)
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name   string
+		claims *hostClaims
+		valid  bool
+	}{
+		{"valid", &hostClaims{
+			RegisteredClaims: jwt.RegisteredClaims{Issuer: testIssuer, Subject: "host-1", ExpiresAt: jwt.NewNumericDate(expires)},
+			Kind:             HostKind,
+		}, true},
+		{"expired", &hostClaims{
+			RegisteredClaims: jwt.RegisteredClaims{Issuer: testIssuer, Subject: "host-1", ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))},
+			Kind:             HostKind,
+		}, false},
+		{"without host", &hostClaims{
+			RegisteredClaims: jwt.RegisteredClaims{Issuer: testIssuer, ExpiresAt: jwt.NewNumericDate(expires)},
+			Kind:             HostKind,
+		}, false},
+		{"grant", &hostClaims{
+			RegisteredClaims: jwt.RegisteredClaims{Issuer: testIssuer, Subject: "host-1", ExpiresAt: jwt.NewNumericDate(expires)},
+			Kind:             GrantKind,
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identity, err := NewVerifier(public, testIssuer).HostIdentity(sign(t, private, test.claims))
+			if !test.valid {
+				if err == nil {
+					t.Fatal("accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("rejected: %v", err)
+			}
+			if identity.HostID != "host-1" || !identity.Expires.Equal(expires) {
+				t.Errorf("unexpected identity %+v", identity)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package rbroadcast
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"oneplay-videostream-browser/internal/encoders"
+
+	"github.com/Eyevinn/mp4ff/avc"
+	rtmp "github.com/yutopp/go-rtmp"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+)
+
+const (
+	rtmpChunkSize = 4096
+	// rtmpVideoChunkStream is the chunk stream of the video messages, the
+	// command messages use chunk stream 3
+	rtmpVideoChunkStream = 6
+
+	flvKeyframe   = 1
+	flvInterframe = 2
+	flvCodecAVC   = 7
+
+	flvSequenceHeader = 0
+	flvNALU           = 1
+)
+
+// rtmpPublisher publishes the video as FLV AVC tags. The decoder
+// configuration record is sent before the first keyframe and again whenever
+// the parameter sets change.
+type rtmpPublisher struct {
+	client *rtmp.ClientConn
+	stream *rtmp.Stream
+	sps    [][]byte
+	pps    [][]byte
+	// start is the timestamp of the first published frame
+	start   time.Duration
+	started bool
+}
+
+func dialRTMP(u *url.URL) (*rtmpPublisher, error) {
+	app, key := splitStreamKey(u.Path)
+	if app == "" || key == "" {
+		return nil, fmt.Errorf("RTMP target must look like %s://host/app/streamkey", u.Scheme)
+	}
+	if u.RawQuery != "" {
+		key += "?" + u.RawQuery
+	}
+
+	secure := strings.ToLower(u.Scheme) == "rtmps"
+	host := u.Host
+	if u.Port() == "" {
+		port := "1935"
+		if secure {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var client *rtmp.ClientConn
+	var err error
+	if secure {
+		client, err = rtmp.DialWithTLSDialer(&tls.Dialer{
+			NetDialer: dialer,
+			Config:    &tls.Config{ServerName: u.Hostname()},
+		}, "rtmps", host, &rtmp.ConnConfig{})
+	} else {
+		client, err = rtmp.DialWithDialer(dialer, "rtmp", host, &rtmp.ConnConfig{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tcURL := fmt.Sprintf("%s://%s/%s", u.Scheme, u.Host, app)
+	stream, err := publishRTMP(client, app, tcURL, key)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &rtmpPublisher{
+		client: client,
+		stream: stream,
+	}, nil
+}
+
+// publishRTMP runs the connect, createStream and publish commands, go-rtmp
+// waits for the server replies without a deadline
+func publishRTMP(client *rtmp.ClientConn, app, tcURL, key string) (*rtmp.Stream, error) {
+	type result struct {
+		stream *rtmp.Stream
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		err := client.Connect(&rtmpmsg.NetConnectionConnect{
+			Command: rtmpmsg.NetConnectionConnectCommand{
+				App:      app,
+				Type:     "nonprivate",
+				FlashVer: "FMLE/3.0 (compatible; oneplay)",
+				TCURL:    tcURL,
+			},
+		})
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		stream, err := client.CreateStream(nil, rtmpChunkSize)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		err = stream.Publish(&rtmpmsg.NetStreamPublish{
+			PublishingName: key,
+			PublishingType: "live",
+		})
+		done <- result{stream: stream, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.stream, r.err
+	case <-time.After(dialTimeout):
+		// The caller closes the connection, failing the pending command
+		return nil, fmt.Errorf("RTMP server did not answer within %v", dialTimeout)
+	}
+}
+
+// splitStreamKey splits the path of an RTMP URL, the stream key is the last
+// element and the application everything before it
+func splitStreamKey(p string) (app, key string) {
+	p = strings.Trim(p, "/")
+	i := strings.LastIndex(p, "/")
+	if i < 0 {
+		return p, ""
+	}
+	return p[:i], p[i+1:]
+}
+
+func (p *rtmpPublisher) WriteVideo(frame []byte, pts time.Duration) error {
+	au := encoders.SplitAccessUnit(frame)
+	if len(au.Sample) == 0 {
+		return nil
+	}
+	if !p.started {
+		if !au.StartsStream() {
+			return nil
+		}
+		p.start = pts
+		p.started = true
+	}
+
+	timestamp := uint32((pts - p.start) / time.Millisecond)
+	if au.StartsStream() && !sameParameterSets(au, p.sps, p.pps) {
+		if err := p.writeSequenceHeader(au.SPS, au.PPS, timestamp); err != nil {
+			return err
+		}
+	}
+
+	frameType := byte(flvInterframe)
+	if au.Keyframe {
+		frameType = flvKeyframe
+	}
+	// The encoder has no B-frames, the composition time is always 0
+	body := append([]byte{frameType<<4 | flvCodecAVC, flvNALU, 0, 0, 0}, au.Sample...)
+	return p.stream.Write(rtmpVideoChunkStream, timestamp, &rtmpmsg.VideoMessage{
+		Payload: bytes.NewReader(body),
+	})
+}
+
+func (p *rtmpPublisher) writeSequenceHeader(sps, pps [][]byte, timestamp uint32) error {
+	record, err := avc.CreateAVCDecConfRec(sps, pps, true)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	body.Write([]byte{flvKeyframe<<4 | flvCodecAVC, flvSequenceHeader, 0, 0, 0})
+	if err = record.Encode(&body); err != nil {
+		return err
+	}
+	if err = p.stream.Write(rtmpVideoChunkStream, timestamp, &rtmpmsg.VideoMessage{
+		Payload: &body,
+	}); err != nil {
+		return err
+	}
+	p.sps = sps
+	p.pps = pps
+	return nil
+}
+
+func (p *rtmpPublisher) Close() error {
+	return p.client.Close()
+}
+
+func sameParameterSets(au encoders.AccessUnit, sps, pps [][]byte) bool {
+	return sameNALUs(au.SPS, sps) && sameNALUs(au.PPS, pps)
+}
+
+func sameNALUs(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,67 @@
+package rbroadcast
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// dialTimeout bounds the connection and publishing handshake to a target
+const dialTimeout = 10 * time.Second
+
+// Publisher pushes an encoded screen to a streaming platform. Frames are
+// dropped until a keyframe carrying the parameter sets, the caller asks the
+// encoder for one when it starts publishing.
+type Publisher interface {
+	io.Closer
+	// WriteVideo publishes an Annex-B H.264 frame, timestamp is its time
+	// since the first frame offered. Timestamps keep running over the frames
+	// the caller had to drop.
+	WriteVideo(frame []byte, timestamp time.Duration) error
+}
+
+// Dial connects to target and starts publishing, the scheme selects the
+// protocol. rtmp://host[:port]/app/streamkey and rtmps:// targets receive
+// FLV over RTMP, srt://host:port?streamid=...&passphrase=... ones receive
+// MPEG-TS over SRT. Audio is not published, FLV has no Opus mapping.
+func Dial(target string) (Publisher, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid egress target: %v", err)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "rtmp", "rtmps":
+		return dialRTMP(u)
+	case "srt":
+		return dialSRT(target)
+	}
+	return nil, fmt.Errorf("Unsupported egress target %q", Redact(target))
+}
+
+// Redact hides the credentials, stream key and SRT secrets of target so
+// that it can be logged and returned by the API
+func Redact(target string) string {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return "<invalid>"
+	}
+	if u.User != nil {
+		u.User = url.User("xxxxx")
+	}
+	if strings.ToLower(u.Scheme) != "srt" && u.Path != "" && u.Path != "/" {
+		u.Path = path.Join(path.Dir(u.Path), "xxxxx")
+		u.RawPath = ""
+	}
+	u.Fragment = ""
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			query.Set(key, "xxxxx")
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
@@ -0,0 +1,121 @@
+package rbroadcast
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"oneplay-videostream-browser/internal/encoders"
+
+	"github.com/asticode/go-astits"
+	srt "github.com/datarhei/gosrt"
+)
+
+const (
+	tsVideoPID = 0x100
+	// tsVideoStreamID is the PES stream id of the first video stream
+	tsVideoStreamID = 0xe0
+	// tsPTSDelay keeps the presentation times ahead of the PCR, the margin
+	// receivers need to buffer and decode a frame
+	tsPTSDelay = 200 * time.Millisecond
+	// srtPayloadSize is the usual SRT payload, 7 MPEG-TS packets
+	srtPayloadSize = 7 * astits.MpegTsPacketSize
+)
+
+// audNALU starts every access unit, MPEG-TS requires it for H.264
+var audNALU = []byte{0, 0, 0, 1, 9, 0xf0}
+
+// srtPublisher publishes the video as MPEG-TS, the caller mode of SRT. The
+// encoder repeats the parameter sets on keyframes so the Annex-B frames are
+// sent as they are.
+type srtPublisher struct {
+	conn  srt.Conn
+	buf   bytes.Buffer
+	muxer *astits.Muxer
+	// start is the timestamp of the first published frame
+	start   time.Duration
+	started bool
+}
+
+func dialSRT(target string) (*srtPublisher, error) {
+	config := srt.DefaultConfig()
+	addr, err := config.UnmarshalURL(target)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := srt.Dial("srt", addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &srtPublisher{conn: conn}
+	p.muxer = astits.NewMuxer(context.Background(), &p.buf)
+	if err = p.muxer.AddElementaryStream(astits.PMTElementaryStream{
+		ElementaryPID: tsVideoPID,
+		StreamType:    astits.StreamTypeH264Video,
+	}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p.muxer.SetPCRPID(tsVideoPID)
+	return p, nil
+}
+
+func (p *srtPublisher) WriteVideo(frame []byte, pts time.Duration) error {
+	au := encoders.SplitAccessUnit(frame)
+	if !p.started {
+		if !au.StartsStream() {
+			return nil
+		}
+		p.start = pts
+		p.started = true
+	}
+
+	pcr := toClock(pts - p.start)
+
+	data := make([]byte, 0, len(audNALU)+len(frame))
+	data = append(append(data, audNALU...), frame...)
+	_, err := p.muxer.WriteData(&astits.MuxerData{
+		PID: tsVideoPID,
+		AdaptationField: &astits.PacketAdaptationField{
+			RandomAccessIndicator: au.Keyframe,
+			HasPCR:                true,
+			PCR:                   &astits.ClockReference{Base: pcr},
+		},
+		PES: &astits.PESData{
+			Header: &astits.PESHeader{
+				StreamID: tsVideoStreamID,
+				OptionalHeader: &astits.PESOptionalHeader{
+					MarkerBits:      2,
+					PTSDTSIndicator: astits.PTSDTSIndicatorOnlyPTS,
+					PTS:             &astits.ClockReference{Base: pcr + toClock(tsPTSDelay)},
+				},
+			},
+			Data: data,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return p.flush()
+}
+
+// flush sends the packets of the frame, grouped by srtPayloadSize
+func (p *srtPublisher) flush() error {
+	for p.buf.Len() > 0 {
+		if _, err := p.conn.Write(p.buf.Next(srtPayloadSize)); err != nil {
+			return err
+		}
+	}
+	p.buf.Reset()
+	return nil
+}
+
+func (p *srtPublisher) Close() error {
+	return p.conn.Close()
+}
+
+// toClock converts to the 90kHz MPEG-TS clock
+func toClock(d time.Duration) int64 {
+	return int64(d/time.Microsecond) * 90 / 1000
+}
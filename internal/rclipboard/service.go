@@ -0,0 +1,34 @@
+package rclipboard
+
+import "io"
+
+const (
+	// MimeText plain UTF-8 text
+	MimeText = "text/plain"
+	// MimeHTML HTML fragment
+	MimeHTML = "text/html"
+	// MimePNG PNG encoded image
+	MimePNG = "image/png"
+)
+
+// Content is a clipboard payload
+type Content struct {
+	MimeType string
+	Data     []byte
+}
+
+// Clipboard gives access to the host clipboard
+type Clipboard interface {
+	io.Closer
+	// Set makes content the host clipboard, text is also set as the primary
+	// selection
+	Set(content Content) error
+	// Changes receives what is copied on the host, content larger than the
+	// size limit is skipped
+	Changes() <-chan Content
+}
+
+// Service creates clipboard instances
+type Service interface {
+	CreateClipboard(maxSize int) (Clipboard, error)
+}
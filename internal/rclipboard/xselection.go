@@ -0,0 +1,276 @@
+package rclipboard
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/BurntSushi/xgb"
+	"github.com/BurntSushi/xgb/xfixes"
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+// XClipboardProvider implements the rclipboard.Service interface for XServer
+type XClipboardProvider struct{}
+
+// NewClipboardProvider returns an X Server-based clipboard provider
+func NewClipboardProvider() (Service, error) {
+	return &XClipboardProvider{}, nil
+}
+
+type xAtoms struct {
+	clipboard xproto.Atom
+	targets   xproto.Atom
+	utf8      xproto.Atom
+	text      xproto.Atom
+	html      xproto.Atom
+	png       xproto.Atom
+	incr      xproto.Atom
+	property  xproto.Atom
+}
+
+// XClipboard owns the CLIPBOARD and PRIMARY selections through a hidden
+// window and watches CLIPBOARD ownership changes with XFixes
+type XClipboard struct {
+	conn    *xgb.Conn
+	window  xproto.Window
+	atoms   xAtoms
+	maxSize int
+	changes chan Content
+
+	mu    sync.Mutex
+	owned Content
+}
+
+// CreateClipboard connects to the X server and starts serving and watching
+// the selections
+func (*XClipboardProvider) CreateClipboard(maxSize int) (Clipboard, error) {
+	conn, err := xgb.NewConn()
+	if err != nil {
+		return nil, err
+	}
+	c := &XClipboard{
+		conn:    conn,
+		maxSize: maxSize,
+		changes: make(chan Content, 1),
+	}
+	if err = c.init(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.eventLoop()
+	return c, nil
+}
+
+func (c *XClipboard) init() error {
+	if err := xfixes.Init(c.conn); err != nil {
+		return err
+	}
+	if _, err := xfixes.QueryVersion(c.conn, 4, 0).Reply(); err != nil {
+		return err
+	}
+
+	names := map[string]*xproto.Atom{
+		"CLIPBOARD":         &c.atoms.clipboard,
+		"TARGETS":           &c.atoms.targets,
+		"UTF8_STRING":       &c.atoms.utf8,
+		"TEXT":              &c.atoms.text,
+		"text/html":         &c.atoms.html,
+		"image/png":         &c.atoms.png,
+		"INCR":              &c.atoms.incr,
+		"ONEPLAY_CLIPBOARD": &c.atoms.property,
+	}
+	for name, atom := range names {
+		reply, err := xproto.InternAtom(c.conn, false, uint16(len(name)), name).Reply()
+		if err != nil {
+			return err
+		}
+		*atom = reply.Atom
+	}
+
+	window, err := xproto.NewWindowId(c.conn)
+	if err != nil {
+		return err
+	}
+	root := xproto.Setup(c.conn).DefaultScreen(c.conn).Root
+	err = xproto.CreateWindowChecked(c.conn, 0, window, root, 0, 0, 1, 1, 0,
+		xproto.WindowClassInputOnly, 0, 0, nil).Check()
+	if err != nil {
+		return err
+	}
+	c.window = window
+
+	return xfixes.SelectSelectionInputChecked(c.conn, window, c.atoms.clipboard,
+		xfixes.SelectionEventMaskSetSelectionOwner).Check()
+}
+
+// Changes receives the content copied on the host
+func (c *XClipboard) Changes() <-chan Content {
+	return c.changes
+}
+
+// Set takes ownership of the selections and serves content to other clients
+func (c *XClipboard) Set(content Content) error {
+	if len(content.Data) > c.maxSize {
+		return fmt.Errorf("Clipboard content exceeds %d bytes", c.maxSize)
+	}
+	if len(c.targetsFor(content.MimeType)) == 0 {
+		return fmt.Errorf("Unsupported clipboard type %s", content.MimeType)
+	}
+	c.mu.Lock()
+	c.owned = content
+	c.mu.Unlock()
+
+	if err := xproto.SetSelectionOwnerChecked(c.conn, c.window, c.atoms.clipboard, xproto.TimeCurrentTime).Check(); err != nil {
+		return err
+	}
+	if content.MimeType == MimeText {
+		return xproto.SetSelectionOwnerChecked(c.conn, c.window, xproto.AtomPrimary, xproto.TimeCurrentTime).Check()
+	}
+	return nil
+}
+
+// Close destroys the selection window and closes the X connection
+func (c *XClipboard) Close() error {
+	xproto.DestroyWindow(c.conn, c.window)
+	c.conn.Close()
+	return nil
+}
+
+// targetsFor returns the selection targets a mime type is offered as
+func (c *XClipboard) targetsFor(mimeType string) []xproto.Atom {
+	switch mimeType {
+	case MimeText:
+		return []xproto.Atom{c.atoms.utf8, xproto.AtomString, c.atoms.text}
+	case MimeHTML:
+		return []xproto.Atom{c.atoms.html}
+	case MimePNG:
+		return []xproto.Atom{c.atoms.png}
+	}
+	return nil
+}
+
+func (c *XClipboard) eventLoop() {
+	defer close(c.changes)
+	for {
+		ev, err := c.conn.WaitForEvent()
+		if ev == nil && err == nil {
+			// Connection closed
+			return
+		}
+		if err != nil {
+			log.Printf("Clipboard: %v", err)
+			continue
+		}
+		switch e := ev.(type) {
+		case xfixes.SelectionNotifyEvent:
+			if e.Owner != c.window && e.Owner != xproto.WindowNone {
+				// Ask the new owner which formats it offers
+				xproto.ConvertSelection(c.conn, c.window, c.atoms.clipboard, c.atoms.targets,
+					c.atoms.property, e.SelectionTimestamp)
+			}
+		case xproto.SelectionNotifyEvent:
+			c.receive(e)
+		case xproto.SelectionRequestEvent:
+			c.serve(e)
+		}
+	}
+}
+
+// receive reads the property the selection owner converted the clipboard to
+func (c *XClipboard) receive(e xproto.SelectionNotifyEvent) {
+	if e.Property == xproto.AtomNone {
+		return
+	}
+	reply, err := xproto.GetProperty(c.conn, true, c.window, e.Property,
+		xproto.GetPropertyTypeAny, 0, uint32(c.maxSize/4+1)).Reply()
+	if err != nil {
+		log.Printf("Clipboard: %v", err)
+		return
+	}
+	// Incremental transfers are only used for data too large for us anyway
+	if reply.Type == c.atoms.incr || reply.BytesAfter > 0 || len(reply.Value) > c.maxSize {
+		return
+	}
+
+	if e.Target == c.atoms.targets {
+		offered := make(map[xproto.Atom]bool)
+		for i := 0; i+4 <= len(reply.Value); i += 4 {
+			offered[xproto.Atom(binary.LittleEndian.Uint32(reply.Value[i:]))] = true
+		}
+		for _, target := range []xproto.Atom{c.atoms.utf8, xproto.AtomString, c.atoms.html, c.atoms.png} {
+			if offered[target] {
+				xproto.ConvertSelection(c.conn, c.window, c.atoms.clipboard, target,
+					c.atoms.property, e.Time)
+				return
+			}
+		}
+		return
+	}
+
+	content := Content{Data: reply.Value}
+	switch e.Target {
+	case c.atoms.utf8, xproto.AtomString:
+		content.MimeType = MimeText
+	case c.atoms.html:
+		content.MimeType = MimeHTML
+	case c.atoms.png:
+		content.MimeType = MimePNG
+	default:
+		return
+	}
+	// Only the latest copy matters to a slow consumer
+	select {
+	case <-c.changes:
+	default:
+	}
+	c.changes <- content
+}
+
+// serve answers another client pasting what we own
+func (c *XClipboard) serve(e xproto.SelectionRequestEvent) {
+	property := e.Property
+	if property == xproto.AtomNone {
+		// Obsolete clients expect the target to be used as property
+		property = e.Target
+	}
+
+	c.mu.Lock()
+	owned := c.owned
+	c.mu.Unlock()
+
+	targets := c.targetsFor(owned.MimeType)
+	if e.Target == c.atoms.targets {
+		offered := append([]xproto.Atom{c.atoms.targets}, targets...)
+		data := make([]byte, 4*len(offered))
+		for i, atom := range offered {
+			binary.LittleEndian.PutUint32(data[i*4:], uint32(atom))
+		}
+		xproto.ChangeProperty(c.conn, xproto.PropModeReplace, e.Requestor, property,
+			xproto.AtomAtom, 32, uint32(len(offered)), data)
+	} else if hasAtom(targets, e.Target) {
+		xproto.ChangeProperty(c.conn, xproto.PropModeReplace, e.Requestor, property,
+			e.Target, 8, uint32(len(owned.Data)), owned.Data)
+	} else {
+		property = xproto.AtomNone
+	}
+
+	notify := xproto.SelectionNotifyEvent{
+		Time:      e.Time,
+		Requestor: e.Requestor,
+		Selection: e.Selection,
+		Target:    e.Target,
+		Property:  property,
+	}
+	xproto.SendEvent(c.conn, false, e.Requestor, xproto.EventMaskNoEvent, string(notify.Bytes()))
+}
+
+func hasAtom(haystack []xproto.Atom, needle xproto.Atom) bool {
+	for _, atom := range haystack {
+		if atom == needle {
+			return true
+		}
+	}
+	return false
+}
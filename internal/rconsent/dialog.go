@@ -0,0 +1,95 @@
+package rconsent
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// xmessageAllow is the exit status of the xmessage Allow button, xmessage
+// exits with 0 when it times out
+const xmessageAllow = 10
+
+// DialogApprover asks the host through a dialog on the X display, the
+// viewer is rejected if nobody answers in time
+type DialogApprover struct {
+	tool    string
+	timeout time.Duration
+}
+
+// NewDialogApprover returns an approver showing a zenity, kdialog or
+// xmessage dialog, whichever is installed first
+func NewDialogApprover(timeout time.Duration) (*DialogApprover, error) {
+	for _, tool := range []string{"zenity", "kdialog", "xmessage"} {
+		if _, err := exec.LookPath(tool); err == nil {
+			return &DialogApprover{tool: tool, timeout: timeout}, nil
+		}
+	}
+	return nil, fmt.Errorf("No dialog tool found, install zenity, kdialog or xmessage")
+}
+
+// Approve shows the dialog and waits for the host to answer
+func (d *DialogApprover) Approve(req Request) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	cmd := d.command(ctx, prompt(req))
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return false, nil
+	}
+	exit, ok := err.(*exec.ExitError)
+	if err != nil && !ok {
+		return false, err
+	}
+	if d.tool == "xmessage" {
+		return ok && exit.ExitCode() == xmessageAllow, nil
+	}
+	// zenity and kdialog exit with 0 on Allow, 1 on Deny and zenity 5 when
+	// it timed out
+	return err == nil, nil
+}
+
+func (d *DialogApprover) command(ctx context.Context, text string) *exec.Cmd {
+	const title = "Screen sharing request"
+	seconds := strconv.Itoa(int(d.timeout / time.Second))
+	switch d.tool {
+	case "zenity":
+		return exec.CommandContext(ctx, "zenity", "--question",
+			"--title="+title,
+			"--text="+text,
+			"--ok-label=Allow",
+			"--cancel-label=Deny",
+			"--timeout="+seconds,
+		)
+	case "kdialog":
+		return exec.CommandContext(ctx, "kdialog",
+			"--title", title,
+			"--yes-label", "Allow",
+			"--no-label", "Deny",
+			"--yesno", text,
+		)
+	}
+	return exec.CommandContext(ctx, "xmessage",
+		"-center",
+		"-title", title,
+		"-buttons", "Allow:"+strconv.Itoa(xmessageAllow)+",Deny:1",
+		"-default", "Deny",
+		"-timeout", seconds,
+		text,
+	)
+}
+
+func prompt(req Request) string {
+	viewer := req.Viewer
+	if viewer == "" {
+		viewer = "An anonymous viewer"
+	}
+	action := "watch"
+	if req.Role == "controller" {
+		action = "control"
+	}
+	return fmt.Sprintf("%s wants to %s screen %d.", viewer, action, req.Screen)
+}
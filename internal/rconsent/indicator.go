@@ -0,0 +1,196 @@
+package rconsent
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/xgb"
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+const (
+	// indicatorMargin is the distance to the top right corner of the root
+	// window
+	indicatorMargin = 16
+	// indicatorPadding surrounds the text inside the indicator
+	indicatorPadding = 6
+	// indicatorMaxText keeps a long list of viewers from covering the screen
+	indicatorMaxText = 80
+)
+
+// XIndicator shows a red banner in the top right corner of the X display
+// while someone is watching. The banner is an override-redirect window, the
+// window manager neither decorates nor moves it.
+type XIndicator struct {
+	conn   *xgb.Conn
+	screen *xproto.ScreenInfo
+	window xproto.Window
+	gc     xproto.Gcontext
+	font   xproto.Font
+
+	mu     sync.Mutex
+	text   string
+	width  uint16
+	height uint16
+	ascent int16
+}
+
+// NewIndicator connects to the X server and creates the hidden banner
+func NewIndicator() (*XIndicator, error) {
+	conn, err := xgb.NewConn()
+	if err != nil {
+		return nil, err
+	}
+	ind := &XIndicator{
+		conn:   conn,
+		screen: xproto.Setup(conn).DefaultScreen(conn),
+	}
+	if err = ind.init(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go ind.eventLoop()
+	return ind, nil
+}
+
+func (ind *XIndicator) init() error {
+	color, err := xproto.AllocColor(ind.conn, ind.screen.DefaultColormap, 0xd300, 0x2f00, 0x2f00).Reply()
+	if err != nil {
+		return err
+	}
+
+	if ind.font, err = xproto.NewFontId(ind.conn); err != nil {
+		return err
+	}
+	const fontName = "fixed"
+	if err = xproto.OpenFontChecked(ind.conn, ind.font, uint16(len(fontName)), fontName).Check(); err != nil {
+		return fmt.Errorf("Can't open the %s font: %v", fontName, err)
+	}
+	info, err := xproto.QueryFont(ind.conn, xproto.Fontable(ind.font)).Reply()
+	if err != nil {
+		return err
+	}
+	ind.ascent = info.FontAscent
+	ind.height = uint16(info.FontAscent+info.FontDescent) + 2*indicatorPadding
+
+	if ind.window, err = xproto.NewWindowId(ind.conn); err != nil {
+		return err
+	}
+	err = xproto.CreateWindowChecked(ind.conn, ind.screen.RootDepth, ind.window, ind.screen.Root,
+		0, 0, 1, ind.height, 0,
+		xproto.WindowClassInputOutput, ind.screen.RootVisual,
+		xproto.CwBackPixel|xproto.CwOverrideRedirect|xproto.CwEventMask,
+		[]uint32{color.Pixel, 1, xproto.EventMaskExposure},
+	).Check()
+	if err != nil {
+		return err
+	}
+
+	if ind.gc, err = xproto.NewGcontextId(ind.conn); err != nil {
+		return err
+	}
+	return xproto.CreateGCChecked(ind.conn, ind.gc, xproto.Drawable(ind.window),
+		xproto.GcForeground|xproto.GcBackground|xproto.GcFont,
+		[]uint32{ind.screen.WhitePixel, color.Pixel, uint32(ind.font)},
+	).Check()
+}
+
+// Watching shows the banner with the names of the viewers, or hides it
+// once the last viewer left
+func (ind *XIndicator) Watching(viewers []string) {
+	if len(viewers) == 0 {
+		ind.mu.Lock()
+		ind.text = ""
+		ind.mu.Unlock()
+		xproto.UnmapWindow(ind.conn, ind.window)
+		return
+	}
+
+	names := make([]string, len(viewers))
+	for i, viewer := range viewers {
+		if viewer == "" {
+			viewer = "anonymous"
+		}
+		names[i] = viewer
+	}
+	text := fmt.Sprintf("Screen shared with %s", strings.Join(names, ", "))
+	if len(text) > indicatorMaxText {
+		text = text[:indicatorMaxText-3] + "..."
+	}
+
+	width, err := ind.textWidth(text)
+	if err != nil {
+		log.Printf("Indicator: %v", err)
+		return
+	}
+	width += 2 * indicatorPadding
+
+	ind.mu.Lock()
+	ind.text = text
+	ind.width = width
+	ind.mu.Unlock()
+
+	x := int(ind.screen.WidthInPixels) - int(width) - indicatorMargin
+	if x < 0 {
+		x = 0
+	}
+	xproto.ConfigureWindow(ind.conn, ind.window,
+		xproto.ConfigWindowX|xproto.ConfigWindowY|xproto.ConfigWindowWidth|xproto.ConfigWindowStackMode,
+		[]uint32{uint32(x), indicatorMargin, uint32(width), xproto.StackModeAbove},
+	)
+	xproto.MapWindow(ind.conn, ind.window)
+	ind.draw()
+}
+
+func (ind *XIndicator) textWidth(text string) (uint16, error) {
+	chars := make([]xproto.Char2b, len(text))
+	for i := 0; i < len(text); i++ {
+		chars[i] = xproto.Char2b{Byte2: text[i]}
+	}
+	extents, err := xproto.QueryTextExtents(ind.conn, xproto.Fontable(ind.font), chars, uint16(len(chars))).Reply()
+	if err != nil {
+		return 0, err
+	}
+	return uint16(extents.OverallWidth), nil
+}
+
+func (ind *XIndicator) draw() {
+	ind.mu.Lock()
+	text := ind.text
+	ind.mu.Unlock()
+	if text == "" {
+		return
+	}
+	xproto.ClearArea(ind.conn, false, ind.window, 0, 0, 0, 0)
+	xproto.ImageText8(ind.conn, byte(len(text)), xproto.Drawable(ind.window), ind.gc,
+		indicatorPadding, indicatorPadding+ind.ascent, text)
+}
+
+// eventLoop redraws the banner when it gets exposed, it ends once the
+// connection is closed
+func (ind *XIndicator) eventLoop() {
+	for {
+		ev, err := ind.conn.WaitForEvent()
+		if ev == nil && err == nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Indicator: %v", err)
+			continue
+		}
+		if expose, ok := ev.(xproto.ExposeEvent); ok && expose.Count == 0 {
+			ind.draw()
+		}
+	}
+}
+
+// Close removes the banner and disconnects from the X server
+func (ind *XIndicator) Close() error {
+	xproto.DestroyWindow(ind.conn, ind.window)
+	xproto.FreeGC(ind.conn, ind.gc)
+	xproto.CloseFont(ind.conn, ind.font)
+	ind.conn.Close()
+	return nil
+}
@@ -0,0 +1,84 @@
+package rconsent
+
+import (
+	"io"
+	"path"
+	"strings"
+)
+
+// Request describes a viewer asking to watch a screen
+type Request struct {
+	// Viewer is the identity from the viewer token or session grant, empty
+	// when the viewer didn't authenticate
+	Viewer string
+	Screen int
+	// Role is the role the session asks for, viewer or controller
+	Role string
+}
+
+// Approver decides whether a viewer may start a session, it is asked before
+// any capture starts and may block while the host makes up their mind
+type Approver interface {
+	Approve(req Request) (bool, error)
+}
+
+// Indicator tells the people in front of the host that the screen is being
+// watched
+type Indicator interface {
+	io.Closer
+	// Watching updates the indicator with the viewers currently connected,
+	// no viewers hides it
+	Watching(viewers []string)
+}
+
+// AutoApprover accepts every viewer, sessions start as soon as the offer is
+// valid
+type AutoApprover struct{}
+
+// Approve always approves
+func (AutoApprover) Approve(req Request) (bool, error) {
+	return true, nil
+}
+
+// AllowlistApprover accepts the listed viewers and hands the others to a
+// fallback approver
+type AllowlistApprover struct {
+	viewers  []string
+	fallback Approver
+}
+
+// NewAllowlistApprover returns an approver accepting the viewers matching one
+// of the patterns (path.Match syntax, e.g. "ops-*"). The other viewers are
+// asked to fallback, or rejected when fallback is nil.
+func NewAllowlistApprover(viewers []string, fallback Approver) *AllowlistApprover {
+	return &AllowlistApprover{
+		viewers:  viewers,
+		fallback: fallback,
+	}
+}
+
+// ParseAllowlist splits a comma separated list of viewer patterns
+func ParseAllowlist(list string) []string {
+	viewers := []string{}
+	for _, viewer := range strings.Split(list, ",") {
+		if viewer = strings.TrimSpace(viewer); viewer != "" {
+			viewers = append(viewers, viewer)
+		}
+	}
+	return viewers
+}
+
+// Approve approves the listed viewers, anonymous viewers are never listed
+func (a *AllowlistApprover) Approve(req Request) (bool, error) {
+	if req.Viewer != "" {
+		for _, pattern := range a.viewers {
+			if matched, _ := path.Match(pattern, req.Viewer); matched {
+				return true, nil
+			}
+		}
+	}
+	if a.fallback == nil {
+		return false, nil
+	}
+	return a.fallback.Approve(req)
+}
@@ -0,0 +1,117 @@
+package rdisplay
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"strings"
+
+	"github.com/BurntSushi/xgb"
+	"github.com/BurntSushi/xgb/xfixes"
+)
+
+// CursorMode selects how the mouse pointer reaches the viewer
+type CursorMode int
+
+const (
+	// CursorHidden leaves the pointer out of the stream
+	CursorHidden CursorMode = iota
+	// CursorComposite draws the pointer into every captured frame
+	CursorComposite
+	// CursorSeparate publishes pointer shape and position through
+	// ScreenGrabber.Cursor so the viewer can render it locally
+	CursorSeparate
+)
+
+// ParseCursorMode maps the signaling/API names to a CursorMode,
+// unknown values fall back to CursorHidden
+func ParseCursorMode(mode string) CursorMode {
+	switch strings.ToLower(mode) {
+	case "composite":
+		return CursorComposite
+	case "separate":
+		return CursorSeparate
+	}
+	return CursorHidden
+}
+
+func (m CursorMode) String() string {
+	switch m {
+	case CursorComposite:
+		return "composite"
+	case CursorSeparate:
+		return "separate"
+	}
+	return "hidden"
+}
+
+// Cursor is a snapshot of the mouse pointer
+type Cursor struct {
+	// Position of the pointer relative to the captured screen origin
+	Position image.Point
+	// Hotspot is the offset of the pointer tip inside Image
+	Hotspot image.Point
+	// Serial changes every time the pointer shape changes
+	Serial uint32
+	Image  *image.RGBA
+}
+
+// xCursorSource reads the pointer image through the XFixes extension
+type xCursorSource struct {
+	conn *xgb.Conn
+}
+
+func newXCursorSource() (*xCursorSource, error) {
+	conn, err := xgb.NewConn()
+	if err != nil {
+		return nil, err
+	}
+	if err = xfixes.Init(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// XFixes requires the client to announce its version before any request
+	if _, err = xfixes.QueryVersion(conn, 4, 0).Reply(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &xCursorSource{conn: conn}, nil
+}
+
+// Capture returns the current pointer, positioned relative to bounds
+func (c *xCursorSource) Capture(bounds image.Rectangle) (*Cursor, error) {
+	reply, err := xfixes.GetCursorImage(c.conn).Reply()
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, fmt.Errorf("Empty cursor image reply")
+	}
+	width, height := int(reply.Width), int(reply.Height)
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < width*height && i < len(reply.CursorImage); i++ {
+		// XFixes pixels are premultiplied ARGB, same as image.RGBA expects
+		argb := reply.CursorImage[i]
+		img.Pix[i*4] = uint8(argb >> 16)
+		img.Pix[i*4+1] = uint8(argb >> 8)
+		img.Pix[i*4+2] = uint8(argb)
+		img.Pix[i*4+3] = uint8(argb >> 24)
+	}
+	return &Cursor{
+		Position: image.Point{int(reply.X), int(reply.Y)}.Sub(bounds.Min),
+		Hotspot:  image.Point{int(reply.Xhot), int(reply.Yhot)},
+		Serial:   reply.CursorSerial,
+		Image:    img,
+	}, nil
+}
+
+func (c *xCursorSource) Close() {
+	c.conn.Close()
+}
+
+// compositeCursor draws the pointer over the frame
+func compositeCursor(frame *image.RGBA, cursor *Cursor) {
+	topLeft := cursor.Position.Sub(cursor.Hotspot)
+	target := cursor.Image.Bounds().Add(topLeft)
+	draw.Draw(frame, target, cursor.Image, image.Point{}, draw.Over)
+}
@@ -1,30 +1,53 @@
 package rdisplay
 
 import (
+	"fmt"
 	"image"
+	"sync/atomic"
 	"time"
 
+	"oneplay-videostream-browser/internal/rlog"
+
 	"github.com/kbinani/screenshot"
 )
 
 // XVideoProvider implements the rdisplay.Service interface for XServer
-type XVideoProvider struct{}
+type XVideoProvider struct {
+	log *rlog.Logger
+}
 
 // XScreenGrabber captures video from a X server
 type XScreenGrabber struct {
-	fps    int
-	screen Screen
-	frames chan *image.RGBA
-	stop   chan struct{}
+	// accessed atomically, kept first for 64-bit alignment on 32-bit platforms
+	captured   uint64
+	dropped    uint64
+	fps        int
+	screen     Screen
+	frames     chan *Frame
+	cursorMode CursorMode
+	cursor     chan *Cursor
+	stop       chan struct{}
+	log        *rlog.Logger
 }
 
 // CreateScreenGrabber Creates an screen capturer for the X server
-func (*XVideoProvider) CreateScreenGrabber(screen Screen, fps int) (ScreenGrabber, error) {
+func (x *XVideoProvider) CreateScreenGrabber(screen Screen, fps int, cursor CursorMode, queue int) (ScreenGrabber, error) {
+	if fps <= 0 {
+		return nil, fmt.Errorf("Invalid capture frame rate %d", fps)
+	}
+	// Without a queue the newest frame still waits in a single slot, so the
+	// encoder picks it up instead of whatever it was offered last
+	if queue < 1 {
+		queue = 1
+	}
 	return &XScreenGrabber{
-		screen: screen,
-		fps:    fps,
-		frames: make(chan *image.RGBA),
-		stop:   make(chan struct{}),
+		screen:     screen,
+		fps:        fps,
+		frames:     make(chan *Frame, queue),
+		cursorMode: cursor,
+		cursor:     make(chan *Cursor, 1),
+		stop:       make(chan struct{}),
+		log:        x.log.With(rlog.F("screen", screen.Index)),
 	}, nil
 }
 
@@ -42,36 +65,110 @@ func (x *XVideoProvider) Screens() ([]Screen, error) {
 }
 
 // Frames returns a channel that will receive an image stream
-func (g *XScreenGrabber) Frames() <-chan *image.RGBA {
+func (g *XScreenGrabber) Frames() <-chan *Frame {
 	return g.frames
 }
 
-// Start initiates the screen capture loop
+// Cursor returns a channel that receives pointer updates when the grabber
+// was created with CursorSeparate
+func (g *XScreenGrabber) Cursor() <-chan *Cursor {
+	return g.cursor
+}
+
+// Start initiates the screen capture loop. Captures are paced by a ticker so
+// a slow capture doesn't make the frame rate drift, and frames are handed
+// over without blocking: if the consumer hasn't picked up the previous frame
+// yet it is dropped in favor of the newest one.
 func (g *XScreenGrabber) Start() {
-	delta := time.Duration(1000/g.fps) * time.Millisecond
+	delta := time.Second / time.Duration(g.fps)
+	g.log.Infof("Capturing %dx%d at %d fps", g.screen.Bounds.Dx(), g.screen.Bounds.Dy(), g.fps)
+	var cursorSource *xCursorSource
+	if g.cursorMode != CursorHidden {
+		var err error
+		cursorSource, err = newXCursorSource()
+		if err != nil {
+			g.log.Warnf("Cursor capture disabled: %v", err)
+		}
+	}
 	go func() {
+		ticker := time.NewTicker(delta)
+		defer func() {
+			ticker.Stop()
+			if cursorSource != nil {
+				cursorSource.Close()
+			}
+			close(g.frames)
+			close(g.cursor)
+		}()
+		var lastCursor *Cursor
 		for {
-			startedAt := time.Now()
 			select {
 			case <-g.stop:
-				close(g.frames)
 				return
-			default:
+			case <-ticker.C:
+				captured := time.Now()
 				img, err := screenshot.CaptureRect(g.screen.Bounds)
 				if err != nil {
+					g.log.Errorf("Screen capture failed: %v", err)
 					return
 				}
-				g.frames <- img
-				ellapsed := time.Now().Sub(startedAt)
-				sleepDuration := delta - ellapsed
-				if sleepDuration > 0 {
-					time.Sleep(sleepDuration)
+				atomic.AddUint64(&g.captured, 1)
+				if cursorSource != nil {
+					lastCursor = g.handleCursor(cursorSource, img, lastCursor)
 				}
+				g.publish(&Frame{Image: img, Captured: captured})
 			}
 		}
 	}()
 }
 
+// publish replaces the oldest frame still waiting in the channel with frame
+func (g *XScreenGrabber) publish(frame *Frame) {
+	for {
+		select {
+		case g.frames <- frame:
+			return
+		default:
+		}
+		select {
+		case <-g.frames:
+			atomic.AddUint64(&g.dropped, 1)
+		default:
+		}
+	}
+}
+
+// Stats returns the capture counters since the grabber was created
+func (g *XScreenGrabber) Stats() CaptureStats {
+	return CaptureStats{
+		Captured: atomic.LoadUint64(&g.captured),
+		Dropped:  atomic.LoadUint64(&g.dropped),
+	}
+}
+
+// handleCursor captures the pointer and either composites it into frame or
+// publishes it when it moved or changed shape, returns the latest pointer
+func (g *XScreenGrabber) handleCursor(source *xCursorSource, frame *image.RGBA, last *Cursor) *Cursor {
+	cursor, err := source.Capture(g.screen.Bounds)
+	if err != nil {
+		return last
+	}
+	if g.cursorMode == CursorComposite {
+		compositeCursor(frame, cursor)
+		return cursor
+	}
+	if last != nil && last.Position == cursor.Position && last.Serial == cursor.Serial {
+		return last
+	}
+	// Only the newest pointer matters, replace any update nobody read yet
+	select {
+	case <-g.cursor:
+	default:
+	}
+	g.cursor <- cursor
+	return cursor
+}
+
 // Stop sends a stop signal to the capture loop
 func (g *XScreenGrabber) Stop() {
 	close(g.stop)
@@ -87,7 +184,7 @@ func (g *XScreenGrabber) Fps() int {
 	return g.fps
 }
 
-// NewVideoProvider returns an X Server-based video provider
-func NewVideoProvider() (Service, error) {
-	return &XVideoProvider{}, nil
+// NewVideoProvider returns an X Server-based video provider, log can be nil
+func NewVideoProvider(log *rlog.Logger) (Service, error) {
+	return &XVideoProvider{log: log}, nil
 }
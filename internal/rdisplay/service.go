@@ -1,14 +1,32 @@
 package rdisplay
 
-import "image"
+import (
+	"image"
+	"time"
+)
+
+// Frame is a captured image, Captured is when the capture started
+type Frame struct {
+	Image    *image.RGBA
+	Captured time.Time
+}
 
 // ScreenGrabber TODO
 type ScreenGrabber interface {
 	Start()
-	Frames() <-chan *image.RGBA
+	Frames() <-chan *Frame
+	Cursor() <-chan *Cursor
 	Stop()
 	Fps() int
 	Screen() *Screen
+	Stats() CaptureStats
+}
+
+// CaptureStats counts the frames a ScreenGrabber produced, Dropped frames
+// were replaced by a newer one before the consumer read them
+type CaptureStats struct {
+	Captured uint64
+	Dropped  uint64
 }
 
 // Screen TODO
@@ -19,6 +37,9 @@ type Screen struct {
 
 // Service TODO
 type Service interface {
-	CreateScreenGrabber(screen Screen, fps int) (ScreenGrabber, error)
+	// CreateScreenGrabber creates a grabber that keeps at most queue frames
+	// waiting for the consumer, older frames are dropped for newer ones and
+	// with 0 only the newest frame waits
+	CreateScreenGrabber(screen Screen, fps int, cursor CursorMode, queue int) (ScreenGrabber, error)
 	Screens() ([]Screen, error)
 }
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package rgamepad
+
+import "fmt"
+
+// NewGamepadProvider reports that virtual gamepads need Linux uinput
+func NewGamepadProvider() (Service, error) {
+	return nil, fmt.Errorf("Virtual gamepads are only supported on Linux")
+}
@@ -0,0 +1,35 @@
+package rgamepad
+
+import (
+	"io"
+	"time"
+)
+
+// State is a snapshot of a viewer gamepad using the W3C Gamepad API
+// standard mapping: 17 buttons with values between 0 and 1, and 4 axes
+// between -1 and 1 (left X, left Y, right X, right Y)
+type State struct {
+	Buttons []float64
+	Axes    []float64
+}
+
+// Rumble is a force feedback request of a game, magnitudes are between 0
+// and 1. A zero Duration stops the rumble.
+type Rumble struct {
+	Strong   float64
+	Weak     float64
+	Duration time.Duration
+}
+
+// Gamepad is a virtual controller on the host
+type Gamepad interface {
+	io.Closer
+	Update(state State) error
+	// Rumble receives the force feedback games play on the controller
+	Rumble() <-chan Rumble
+}
+
+// Service creates virtual gamepads
+type Service interface {
+	CreateGamepad(slot int) (Gamepad, error)
+}
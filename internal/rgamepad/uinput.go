@@ -0,0 +1,481 @@
+//go:build linux
+// +build linux
+
+package rgamepad
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Linux input event types and codes, from linux/input-event-codes.h
+const (
+	evSyn     = 0x00
+	evKey     = 0x01
+	evAbs     = 0x03
+	evFF      = 0x15
+	evUinput  = 0x0101
+	synReport = 0
+
+	btnA      = 0x130
+	btnB      = 0x131
+	btnX      = 0x133
+	btnY      = 0x134
+	btnTL     = 0x136
+	btnTR     = 0x137
+	btnSelect = 0x13a
+	btnStart  = 0x13b
+	btnMode   = 0x13c
+	btnThumbL = 0x13d
+	btnThumbR = 0x13e
+
+	absX     = 0x00
+	absY     = 0x01
+	absZ     = 0x02
+	absRX    = 0x03
+	absRY    = 0x04
+	absRZ    = 0x05
+	absHat0X = 0x10
+	absHat0Y = 0x11
+
+	ffRumble = 0x50
+
+	uiFFUpload = 1
+	uiFFErase  = 2
+
+	busVirtual = 0x06
+	// Microsoft Xbox 360 controller ids, games and SDL pick the right
+	// mapping from them
+	xboxVendor  = 0x045e
+	xboxProduct = 0x028e
+
+	uinputMaxName = 80
+	// maxEffects is how many force feedback effects a game can upload
+	maxEffects = 16
+	// endlessRumble stands for effects without a length, it is the longest
+	// rumble browsers play
+	endlessRumble = 5 * time.Second
+)
+
+// standardButtons maps the W3C standard gamepad buttons to evdev codes,
+// triggers (6, 7) and the d-pad (12 to 15) are reported as axes
+var standardButtons = map[int]uint16{
+	0:  btnA,
+	1:  btnB,
+	2:  btnX,
+	3:  btnY,
+	4:  btnTL,
+	5:  btnTR,
+	8:  btnSelect,
+	9:  btnStart,
+	10: btnThumbL,
+	11: btnThumbR,
+	16: btnMode,
+}
+
+// stickAxes maps the W3C standard gamepad axes to evdev codes
+var stickAxes = [4]uint16{absX, absY, absRX, absRY}
+
+// uinput ioctl requests, from linux/uinput.h
+var (
+	uiDevCreate      = ioc(0, 1, 0)
+	uiDevDestroy     = ioc(0, 2, 0)
+	uiDevSetup       = ioc(iocWrite, 3, unsafe.Sizeof(uinputSetup{}))
+	uiAbsSetup       = ioc(iocWrite, 4, unsafe.Sizeof(uinputAbsSetup{}))
+	uiSetEvBit       = ioc(iocWrite, 100, unsafe.Sizeof(int32(0)))
+	uiSetKeyBit      = ioc(iocWrite, 101, unsafe.Sizeof(int32(0)))
+	uiSetAbsBit      = ioc(iocWrite, 103, unsafe.Sizeof(int32(0)))
+	uiSetFFBit       = ioc(iocWrite, 107, unsafe.Sizeof(int32(0)))
+	uiBeginFFUpload  = ioc(iocRead|iocWrite, 200, unsafe.Sizeof(uinputFFUpload{}))
+	uiEndFFUpload    = ioc(iocWrite, 201, unsafe.Sizeof(uinputFFUpload{}))
+	uiBeginFFErase   = ioc(iocRead|iocWrite, 202, unsafe.Sizeof(uinputFFErase{}))
+	uiEndFFErase     = ioc(iocWrite, 203, unsafe.Sizeof(uinputFFErase{}))
+	inputEventLength = int(unsafe.Sizeof(inputEvent{}))
+)
+
+const (
+	iocWrite = 1
+	iocRead  = 2
+)
+
+func ioc(dir, nr uintptr, size uintptr) uintptr {
+	return dir<<30 | size<<16 | 'U'<<8 | nr
+}
+
+type inputID struct {
+	Bustype uint16
+	Vendor  uint16
+	Product uint16
+	Version uint16
+}
+
+type uinputSetup struct {
+	ID           inputID
+	Name         [uinputMaxName]byte
+	FFEffectsMax uint32
+}
+
+type inputAbsinfo struct {
+	Value      int32
+	Minimum    int32
+	Maximum    int32
+	Fuzz       int32
+	Flat       int32
+	Resolution int32
+}
+
+type uinputAbsSetup struct {
+	Code uint16
+	_    uint16
+	Abs  inputAbsinfo
+}
+
+type inputEvent struct {
+	Time  syscall.Timeval
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+// ffEffect mirrors struct ff_effect, only the rumble member of the union is
+// read. The union holds a pointer, which sets its size and alignment.
+type ffEffect struct {
+	Type      uint16
+	ID        int16
+	Direction uint16
+	Trigger   [2]uint16
+	Replay    struct {
+		Length uint16
+		Delay  uint16
+	}
+	_     uint16
+	Union [3]uint64
+	_     uintptr
+}
+
+type uinputFFUpload struct {
+	RequestID uint32
+	Retval    int32
+	Effect    ffEffect
+	Old       ffEffect
+}
+
+type uinputFFErase struct {
+	RequestID uint32
+	Retval    int32
+	EffectID  uint32
+}
+
+// UinputGamepadProvider implements the rgamepad.Service interface with
+// virtual controllers created through /dev/uinput
+type UinputGamepadProvider struct {
+	device string
+}
+
+// UinputGamepad is an Xbox 360-style controller created through uinput
+type UinputGamepad struct {
+	mu      sync.Mutex
+	file    *os.File
+	buttons map[uint16]bool
+	axes    map[uint16]int32
+	effects map[int16]Rumble
+	rumble  chan Rumble
+	closed  bool
+}
+
+// NewGamepadProvider returns a uinput-based gamepad provider, the process
+// needs write access to /dev/uinput
+func NewGamepadProvider() (Service, error) {
+	device := "/dev/uinput"
+	file, err := os.OpenFile(device, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	return &UinputGamepadProvider{device: device}, nil
+}
+
+// CreateGamepad plugs a new virtual controller into the host
+func (p *UinputGamepadProvider) CreateGamepad(slot int) (Gamepad, error) {
+	file, err := os.OpenFile(p.device, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err = setupDevice(file, fmt.Sprintf("OnePlay Virtual Gamepad %d", slot+1)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	pad := &UinputGamepad{
+		file:    file,
+		buttons: make(map[uint16]bool),
+		axes:    make(map[uint16]int32),
+		effects: make(map[int16]Rumble),
+		rumble:  make(chan Rumble, 1),
+	}
+	go pad.readFeedback()
+	return pad, nil
+}
+
+func setupDevice(file *os.File, name string) error {
+	return control(file, func(fd uintptr) error {
+		return setupDeviceFd(fd, name)
+	})
+}
+
+func setupDeviceFd(fd uintptr, name string) error {
+	for _, ev := range []int{evKey, evAbs, evFF} {
+		if err := ioctl(fd, uiSetEvBit, uintptr(ev)); err != nil {
+			return err
+		}
+	}
+	for _, code := range standardButtons {
+		if err := ioctl(fd, uiSetKeyBit, uintptr(code)); err != nil {
+			return err
+		}
+	}
+	if err := ioctl(fd, uiSetFFBit, ffRumble); err != nil {
+		return err
+	}
+
+	axes := []uinputAbsSetup{
+		{Code: absX, Abs: inputAbsinfo{Minimum: -32768, Maximum: 32767, Fuzz: 16, Flat: 128}},
+		{Code: absY, Abs: inputAbsinfo{Minimum: -32768, Maximum: 32767, Fuzz: 16, Flat: 128}},
+		{Code: absRX, Abs: inputAbsinfo{Minimum: -32768, Maximum: 32767, Fuzz: 16, Flat: 128}},
+		{Code: absRY, Abs: inputAbsinfo{Minimum: -32768, Maximum: 32767, Fuzz: 16, Flat: 128}},
+		{Code: absZ, Abs: inputAbsinfo{Minimum: 0, Maximum: 255}},
+		{Code: absRZ, Abs: inputAbsinfo{Minimum: 0, Maximum: 255}},
+		{Code: absHat0X, Abs: inputAbsinfo{Minimum: -1, Maximum: 1}},
+		{Code: absHat0Y, Abs: inputAbsinfo{Minimum: -1, Maximum: 1}},
+	}
+	for i := range axes {
+		if err := ioctl(fd, uiSetAbsBit, uintptr(axes[i].Code)); err != nil {
+			return err
+		}
+		if err := ioctl(fd, uiAbsSetup, uintptr(unsafe.Pointer(&axes[i]))); err != nil {
+			return err
+		}
+	}
+
+	setup := uinputSetup{
+		ID: inputID{
+			Bustype: busVirtual,
+			Vendor:  xboxVendor,
+			Product: xboxProduct,
+			Version: 0x0110,
+		},
+		FFEffectsMax: maxEffects,
+	}
+	copy(setup.Name[:uinputMaxName-1], name)
+	if err := ioctl(fd, uiDevSetup, uintptr(unsafe.Pointer(&setup))); err != nil {
+		return err
+	}
+	return ioctl(fd, uiDevCreate, 0)
+}
+
+// control runs fn on the raw descriptor of file without switching it to
+// blocking mode like File.Fd does, so a pending Read still returns on Close
+func control(file *os.File, fn func(fd uintptr) error) error {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var fnErr error
+	if err = conn.Control(func(fd uintptr) {
+		fnErr = fn(fd)
+	}); err != nil {
+		return err
+	}
+	return fnErr
+}
+
+func ioctl(fd, req, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Update reports the buttons and axes that changed since the last state
+func (g *UinputGamepad) Update(state State) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return fmt.Errorf("Gamepad closed")
+	}
+
+	var events []inputEvent
+	for index, code := range standardButtons {
+		pressed := button(state, index) > 0.5
+		if g.buttons[code] != pressed {
+			g.buttons[code] = pressed
+			value := int32(0)
+			if pressed {
+				value = 1
+			}
+			events = append(events, inputEvent{Type: evKey, Code: code, Value: value})
+		}
+	}
+	values := map[uint16]int32{
+		absZ:     int32(math.Round(button(state, 6) * 255)),
+		absRZ:    int32(math.Round(button(state, 7) * 255)),
+		absHat0X: hat(button(state, 14), button(state, 15)),
+		absHat0Y: hat(button(state, 12), button(state, 13)),
+	}
+	for index, code := range stickAxes {
+		axis := 0.0
+		if index < len(state.Axes) {
+			axis = math.Max(-1, math.Min(1, state.Axes[index]))
+		}
+		values[code] = int32(math.Round(axis * 32767))
+	}
+	for code, value := range values {
+		if g.axes[code] != value {
+			g.axes[code] = value
+			events = append(events, inputEvent{Type: evAbs, Code: code, Value: value})
+		}
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	events = append(events, inputEvent{Type: evSyn, Code: synReport})
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, events); err != nil {
+		return err
+	}
+	_, err := g.file.Write(buf.Bytes())
+	return err
+}
+
+func button(state State, index int) float64 {
+	if index >= len(state.Buttons) {
+		return 0
+	}
+	return math.Max(0, math.Min(1, state.Buttons[index]))
+}
+
+func hat(negative, positive float64) int32 {
+	switch {
+	case negative > 0.5 && positive <= 0.5:
+		return -1
+	case positive > 0.5 && negative <= 0.5:
+		return 1
+	}
+	return 0
+}
+
+// Rumble returns the force feedback played by games, a pending request is
+// replaced by a newer one when the receiver is slow
+func (g *UinputGamepad) Rumble() <-chan Rumble {
+	return g.rumble
+}
+
+// readFeedback serves effect uploads and erasures and turns the effect
+// playbacks into Rumble requests
+func (g *UinputGamepad) readFeedback() {
+	defer close(g.rumble)
+	buf := make([]byte, inputEventLength)
+	for {
+		if _, err := io.ReadFull(g.file, buf); err != nil {
+			return
+		}
+		var event inputEvent
+		if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &event); err != nil {
+			return
+		}
+		switch {
+		case event.Type == evUinput && event.Code == uiFFUpload:
+			g.uploadEffect(uint32(event.Value))
+		case event.Type == evUinput && event.Code == uiFFErase:
+			g.eraseEffect(uint32(event.Value))
+		case event.Type == evFF:
+			g.playEffect(int16(event.Code), event.Value > 0)
+		}
+	}
+}
+
+func (g *UinputGamepad) uploadEffect(request uint32) {
+	upload := uinputFFUpload{RequestID: request}
+	if err := g.ioctl(uiBeginFFUpload, uintptr(unsafe.Pointer(&upload))); err != nil {
+		return
+	}
+	if upload.Effect.Type == ffRumble {
+		// struct ff_rumble_effect starts the union: strong and weak
+		// magnitudes as two unsigned 16-bit values
+		strong := uint16(upload.Effect.Union[0])
+		weak := uint16(upload.Effect.Union[0] >> 16)
+		duration := time.Duration(upload.Effect.Replay.Length) * time.Millisecond
+		if duration == 0 {
+			// Endless effects play until stopped
+			duration = endlessRumble
+		}
+		g.mu.Lock()
+		g.effects[upload.Effect.ID] = Rumble{
+			Strong:   float64(strong) / math.MaxUint16,
+			Weak:     float64(weak) / math.MaxUint16,
+			Duration: duration,
+		}
+		g.mu.Unlock()
+		upload.Retval = 0
+	} else {
+		upload.Retval = -int32(syscall.EINVAL)
+	}
+	g.ioctl(uiEndFFUpload, uintptr(unsafe.Pointer(&upload)))
+}
+
+func (g *UinputGamepad) eraseEffect(request uint32) {
+	erase := uinputFFErase{RequestID: request}
+	if err := g.ioctl(uiBeginFFErase, uintptr(unsafe.Pointer(&erase))); err != nil {
+		return
+	}
+	g.mu.Lock()
+	delete(g.effects, int16(erase.EffectID))
+	g.mu.Unlock()
+	erase.Retval = 0
+	g.ioctl(uiEndFFErase, uintptr(unsafe.Pointer(&erase)))
+}
+
+func (g *UinputGamepad) playEffect(id int16, play bool) {
+	g.mu.Lock()
+	effect, found := g.effects[id]
+	g.mu.Unlock()
+	if !found {
+		return
+	}
+	if !play {
+		effect = Rumble{}
+	}
+	// Only the latest rumble matters
+	select {
+	case <-g.rumble:
+	default:
+	}
+	g.rumble <- effect
+}
+
+func (g *UinputGamepad) ioctl(req, arg uintptr) error {
+	return control(g.file, func(fd uintptr) error {
+		return ioctl(fd, req, arg)
+	})
+}
+
+// Close unplugs the virtual controller
+func (g *UinputGamepad) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return nil
+	}
+	g.closed = true
+	g.ioctl(uiDevDestroy, 0)
+	return g.file.Close()
+}
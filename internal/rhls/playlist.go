@@ -0,0 +1,185 @@
+package rhls
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServeHTTP serves the playlist, index.m3u8, the init segment, init.mp4,
+// the segments, seg<msn>.m4s, and their parts, part<msn>.<part>.m4s. The
+// path is relative to the stream. Blocking playlist reloads and preload
+// hints wait for the media they ask for.
+func (s *Stream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	s.mu.Lock()
+	s.accessed = time.Now()
+	s.mu.Unlock()
+
+	switch {
+	case name == "index.m3u8":
+		s.servePlaylist(w, r)
+	case name == "init.mp4":
+		s.serveMedia(w, "video/mp4", func() ([]byte, bool) {
+			return s.init, s.init == nil
+		})
+	case strings.HasPrefix(name, "seg") && strings.HasSuffix(name, ".m4s"):
+		msn, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "seg"), ".m4s"))
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.serveMedia(w, "video/iso.segment", func() ([]byte, bool) {
+			return s.segmentData(msn)
+		})
+	case strings.HasPrefix(name, "part") && strings.HasSuffix(name, ".m4s"):
+		var msn, index int
+		if _, err := fmt.Sscanf(name, "part%d.%d.m4s", &msn, &index); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.serveMedia(w, "video/iso.segment", func() ([]byte, bool) {
+			return s.partData(msn, index)
+		})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// servePlaylist answers the _HLS_msn and _HLS_part directives once the
+// playlist holds the part they ask for
+func (s *Stream) servePlaylist(w http.ResponseWriter, r *http.Request) {
+	msn, part := -1, -1
+	query := r.URL.Query()
+	if v := query.Get("_HLS_msn"); v != "" {
+		var err error
+		if msn, err = strconv.Atoi(v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if v = query.Get("_HLS_part"); v != "" {
+			if part, err = strconv.Atoi(v); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// A player can't be more than two segments ahead of the live edge
+	if msn > s.nextMSN+1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err := s.wait(func() bool {
+		if len(s.segments) == 0 || len(s.current().parts) == 0 {
+			return false
+		}
+		return msn < 0 || s.hasPart(msn, part)
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(s.playlist())
+}
+
+// serveMedia serves the media returned by get, waiting for it while get
+// reports it is pending
+func (s *Stream) serveMedia(w http.ResponseWriter, contentType string, get func() (data []byte, pending bool)) {
+	s.mu.Lock()
+	var data []byte
+	err := s.wait(func() bool {
+		var pending bool
+		data, pending = get()
+		return data != nil || !pending
+	})
+	s.mu.Unlock()
+	if err != nil || data == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(data)
+}
+
+// hasPart reports whether the playlist lists part of segment msn, or the
+// whole segment when part is negative
+func (s *Stream) hasPart(msn, part int) bool {
+	current := s.current()
+	if msn != current.msn {
+		return msn < current.msn
+	}
+	return part >= 0 && part < len(current.parts)
+}
+
+// segmentData returns a complete segment, pending while it is in progress
+func (s *Stream) segmentData(msn int) ([]byte, bool) {
+	seg := s.find(msn)
+	if seg == nil {
+		return nil, msn == s.nextMSN
+	}
+	if !seg.complete {
+		return nil, true
+	}
+	var data []byte
+	for _, p := range seg.parts {
+		data = append(data, p.data...)
+	}
+	return data, false
+}
+
+// partData returns a part, pending while it is the next part of the
+// segment in progress as announced by the preload hint
+func (s *Stream) partData(msn, index int) ([]byte, bool) {
+	seg := s.find(msn)
+	if seg == nil {
+		return nil, msn == s.nextMSN && index == 0
+	}
+	if index < len(seg.parts) {
+		return seg.parts[index].data, false
+	}
+	return nil, !seg.complete && index == len(seg.parts)
+}
+
+// playlist renders the media playlist, the parts of the last segments are
+// listed for low latency players and a preload hint names the next one
+func (s *Stream) playlist() []byte {
+	var b bytes.Buffer
+	partTarget := s.config.PartDuration.Seconds()
+	// Segments end at the first keyframe after their duration, the target
+	// duration leaves room for a late one
+	target := int(s.config.SegmentDuration/time.Second) + 1
+	fmt.Fprintf(&b, "#EXTM3U\n")
+	fmt.Fprintf(&b, "#EXT-X-VERSION:9\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", target)
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget)
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", s.segments[0].msn)
+	fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init.mp4\"\n")
+
+	for i, seg := range s.segments {
+		if len(s.segments)-i <= partialSegments {
+			for j, p := range seg.parts {
+				fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%.5f,URI=\"part%d.%d.m4s\"", p.duration.Seconds(), seg.msn, j)
+				if p.independent {
+					fmt.Fprintf(&b, ",INDEPENDENT=YES")
+				}
+				fmt.Fprintf(&b, "\n")
+			}
+		}
+		if seg.complete {
+			fmt.Fprintf(&b, "#EXTINF:%.5f,\nseg%d.m4s\n", seg.duration.Seconds(), seg.msn)
+		}
+	}
+	current := s.current()
+	fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part%d.%d.m4s\"\n", current.msn, len(current.parts))
+	return b.Bytes()
+}
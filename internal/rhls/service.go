@@ -0,0 +1,24 @@
+package rhls
+
+import "time"
+
+// Config is the packaging of the HLS streams, HLS is disabled when
+// SegmentDuration is zero. Segments are cut at the first keyframe after
+// SegmentDuration and split in LL-HLS parts of at most PartDuration.
+type Config struct {
+	SegmentDuration time.Duration
+	PartDuration    time.Duration
+	// Segments is the number of complete segments kept in the playlist
+	Segments int
+}
+
+const (
+	videoTimescale = 90000
+	videoTrack     = 1
+	// partialSegments is the number of segments the playlist lists the parts
+	// of, the live edge players join at
+	partialSegments = 3
+	// blockTimeout bounds how long a blocking playlist reload or a preload
+	// hint request waits for the media it asks for
+	blockTimeout = 5 * time.Second
+)
@@ -0,0 +1,265 @@
+package rhls
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"oneplay-videostream-browser/internal/encoders"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+// keyframeRetry is how long a segment overruns its duration before the
+// stream asks the encoder for another keyframe
+const keyframeRetry = time.Second
+
+// Stream packages an H.264 stream in fragmented MP4 segments and parts held
+// in memory, and serves them with their playlist over HTTP. The video is
+// written by one goroutine while any number of players read it.
+type Stream struct {
+	config          Config
+	requestKeyframe func()
+
+	mu sync.Mutex
+	// changed is closed and replaced every time a part is added, to wake up
+	// the blocked requests
+	changed  chan struct{}
+	init     []byte
+	segments []*segment
+	// nextMSN is the media sequence number of the next segment
+	nextMSN int
+	// samples of the part being built and its start
+	samples   []mp4.FullSample
+	partStart time.Duration
+	pts       time.Duration
+	moofSeq   uint32
+	requested time.Time
+	accessed  time.Time
+	closed    bool
+}
+
+type segment struct {
+	msn      int
+	duration time.Duration
+	parts    []*part
+	complete bool
+}
+
+type part struct {
+	data        []byte
+	duration    time.Duration
+	independent bool
+}
+
+// NewStream creates an empty stream, requestKeyframe asks the encoder
+// feeding it for a keyframe
+func NewStream(config Config, requestKeyframe func()) *Stream {
+	return &Stream{
+		config:          config,
+		requestKeyframe: requestKeyframe,
+		changed:         make(chan struct{}),
+		moofSeq:         1,
+		accessed:        time.Now(),
+	}
+}
+
+// WriteVideo packages an Annex-B H.264 frame lasting duration, frames are
+// dropped until a keyframe carrying the parameter sets
+func (s *Stream) WriteVideo(frame []byte, duration time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+
+	au := encoders.SplitAccessUnit(frame)
+	if len(au.Sample) == 0 {
+		return nil
+	}
+	if s.init == nil {
+		if !au.StartsStream() {
+			s.askKeyframe()
+			return nil
+		}
+		if err := s.createInit(au.SPS, au.PPS); err != nil {
+			return err
+		}
+	}
+
+	// A keyframe within half a frame of the segment duration ends it, the
+	// sample durations don't add up exactly
+	current := s.current()
+	if au.Keyframe && (current == nil || current.duration+s.pending()+duration/2 >= s.config.SegmentDuration) {
+		if err := s.flushPart(); err != nil {
+			return err
+		}
+		if current != nil {
+			current.complete = true
+		}
+		s.startSegment()
+	} else if len(s.samples) > 0 && s.pending()+duration > s.config.PartDuration {
+		if err := s.flushPart(); err != nil {
+			return err
+		}
+	}
+	// The encoder normally sends a keyframe every segment duration, it may
+	// not when it shares its output with viewers that lost one
+	if !au.Keyframe && s.current().duration+s.pending() >= s.config.SegmentDuration+keyframeRetry/2 {
+		s.askKeyframe()
+	}
+
+	if len(s.samples) == 0 {
+		s.partStart = s.pts
+	}
+	flags := mp4.NonSyncSampleFlags
+	if au.Keyframe {
+		flags = mp4.SyncSampleFlags
+	}
+	start := toTimescale(s.pts)
+	end := toTimescale(s.pts + duration)
+	s.samples = append(s.samples, mp4.FullSample{
+		Sample: mp4.Sample{
+			Flags: flags,
+			Dur:   uint32(end - start),
+			Size:  uint32(len(au.Sample)),
+		},
+		DecodeTime: start,
+		Data:       au.Sample,
+	})
+	s.pts += duration
+	return nil
+}
+
+// Idle returns how long ago a player last fetched something
+func (s *Stream) Idle() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.accessed)
+}
+
+// Close wakes up the blocked requests, the stream doesn't accept video
+// afterwards
+func (s *Stream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.changed)
+	}
+}
+
+func (s *Stream) createInit(sps, pps [][]byte) error {
+	init := mp4.CreateEmptyInit()
+	init.AddEmptyTrack(videoTimescale, "video", "und")
+	if err := init.Moov.Traks[0].SetAVCDescriptor("avc1", sps, pps, true); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := init.Encode(&buf); err != nil {
+		return err
+	}
+	s.init = buf.Bytes()
+	return nil
+}
+
+func (s *Stream) current() *segment {
+	if len(s.segments) == 0 {
+		return nil
+	}
+	return s.segments[len(s.segments)-1]
+}
+
+func (s *Stream) pending() time.Duration {
+	return s.pts - s.partStart
+}
+
+// startSegment opens a segment and drops the ones out of the window
+func (s *Stream) startSegment() {
+	s.segments = append(s.segments, &segment{msn: s.nextMSN})
+	s.nextMSN++
+	// the segment in progress isn't counted
+	if extra := len(s.segments) - 1 - s.config.Segments; extra > 0 {
+		s.segments = append(s.segments[:0], s.segments[extra:]...)
+	}
+}
+
+// flushPart turns the pending samples into a part of the current segment
+func (s *Stream) flushPart() error {
+	if len(s.samples) == 0 {
+		return nil
+	}
+	fragment, err := mp4.CreateFragment(s.moofSeq, videoTrack)
+	if err != nil {
+		return err
+	}
+	for _, sample := range s.samples {
+		fragment.AddFullSample(sample)
+	}
+	var buf bytes.Buffer
+	if err = fragment.Encode(&buf); err != nil {
+		return err
+	}
+	s.moofSeq++
+
+	current := s.current()
+	current.parts = append(current.parts, &part{
+		data:        buf.Bytes(),
+		duration:    s.pending(),
+		independent: s.samples[0].Flags == mp4.SyncSampleFlags,
+	})
+	current.duration += s.pending()
+	s.samples = s.samples[:0]
+	s.partStart = s.pts
+
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return nil
+}
+
+func (s *Stream) askKeyframe() {
+	if time.Since(s.requested) < keyframeRetry {
+		return
+	}
+	s.requested = time.Now()
+	s.requestKeyframe()
+}
+
+// find returns the segment msn, nil if it is out of the window or to come
+func (s *Stream) find(msn int) *segment {
+	for _, seg := range s.segments {
+		if seg.msn == msn {
+			return seg
+		}
+	}
+	return nil
+}
+
+// wait blocks until ready returns true, the stream closes or the timeout
+// expires. It is called with s.mu held and returns with it held.
+func (s *Stream) wait(ready func() bool) error {
+	timeout := time.NewTimer(blockTimeout)
+	defer timeout.Stop()
+	for !ready() {
+		if s.closed {
+			return fmt.Errorf("HLS stream closed")
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+			s.mu.Lock()
+		case <-timeout.C:
+			s.mu.Lock()
+			return fmt.Errorf("HLS media not ready")
+		}
+	}
+	return nil
+}
+
+// toTimescale converts to the track timescale, in microseconds first so that
+// long running streams don't overflow
+func toTimescale(d time.Duration) uint64 {
+	return uint64(d/time.Microsecond) * videoTimescale / 1000000
+}
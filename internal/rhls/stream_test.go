@@ -0,0 +1,193 @@
+package rhls
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testSPS = "6764001eacd940a02ff9610000030001000003003c8f162d96"
+	testPPS = "68ebecb22c"
+	// testFrame is the duration of the test frames, a keyframe comes every
+	// testGOP frames
+	testFrame = 100 * time.Millisecond
+	testGOP   = 10
+)
+
+var testConfig = Config{
+	SegmentDuration: time.Second,
+	PartDuration:    200 * time.Millisecond,
+	Segments:        2,
+}
+
+// annexB joins the NAL units of a frame in an Annex-B stream
+func annexB(t *testing.T, nalus ...string) []byte {
+	var frame []byte
+	for _, nalu := range nalus {
+		data, err := hex.DecodeString(nalu)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame = append(frame, 0, 0, 0, 1)
+		frame = append(frame, data...)
+	}
+	return frame
+}
+
+// writeFrames writes n frames to s, a keyframe with its parameter sets
+// every testGOP frames
+func writeFrames(t *testing.T, s *Stream, n int) {
+	for i := 0; i < n; i++ {
+		frame := annexB(t, "419a6649e10f2653022fff87")
+		if i%testGOP == 0 {
+			frame = annexB(t, testSPS, testPPS, "65888400ff")
+		}
+		if err := s.WriteVideo(frame, testFrame); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPlaylist(t *testing.T) {
+	tests := []struct {
+		name    string
+		frames  int
+		want    []string
+		missing []string
+	}{
+		{"first segment", 5, []string{
+			"#EXT-X-MEDIA-SEQUENCE:0\n",
+			"#EXT-X-PART:DURATION=0.20000,URI=\"part0.0.m4s\",INDEPENDENT=YES\n",
+			"#EXT-X-PART:DURATION=0.20000,URI=\"part0.1.m4s\"\n",
+			"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part0.2.m4s\"\n",
+		}, []string{"#EXTINF"}},
+		{"complete segments", 25, []string{
+			"#EXT-X-MEDIA-SEQUENCE:0\n",
+			"#EXTINF:1.00000,\nseg0.m4s\n",
+			"#EXTINF:1.00000,\nseg1.m4s\n",
+			"URI=\"part2.0.m4s\",INDEPENDENT=YES\n",
+			"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part2.2.m4s\"\n",
+		}, []string{"seg2.m4s"}},
+		{"sliding window", 45, []string{
+			"#EXT-X-MEDIA-SEQUENCE:2\n",
+			"seg2.m4s\n",
+			"seg3.m4s\n",
+			"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part4.2.m4s\"\n",
+		}, []string{"seg1.m4s", "part1.0.m4s"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewStream(testConfig, func() {})
+			writeFrames(t, s, test.frames)
+			playlist := string(s.playlist())
+			for _, line := range test.want {
+				if !strings.Contains(playlist, line) {
+					t.Errorf("playlist without %q:\n%s", line, playlist)
+				}
+			}
+			for _, line := range test.missing {
+				if strings.Contains(playlist, line) {
+					t.Errorf("playlist with %q:\n%s", line, playlist)
+				}
+			}
+		})
+	}
+}
+
+func TestWaitsForKeyframe(t *testing.T) {
+	requested := 0
+	s := NewStream(testConfig, func() { requested++ })
+	for i := 0; i < 3; i++ {
+		if err := s.WriteVideo(annexB(t, "419a6649e10f2653022fff87"), testFrame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.init != nil || len(s.segments) != 0 {
+		t.Fatal("packaged frames before a keyframe")
+	}
+	// Requests are spaced by keyframeRetry
+	if requested != 1 {
+		t.Errorf("%d keyframe requests, want 1", requested)
+	}
+
+	writeFrames(t, s, 1)
+	if s.init == nil || len(s.segments) != 1 {
+		t.Fatal("keyframe not packaged")
+	}
+}
+
+func TestServe(t *testing.T) {
+	s := NewStream(testConfig, func() {})
+	writeFrames(t, s, 25)
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+	}{
+		{"/index.m3u8", http.StatusOK, "application/vnd.apple.mpegurl"},
+		{"/index.m3u8?_HLS_msn=1", http.StatusOK, "application/vnd.apple.mpegurl"},
+		{"/index.m3u8?_HLS_msn=9", http.StatusBadRequest, ""},
+		{"/index.m3u8?_HLS_msn=x", http.StatusBadRequest, ""},
+		{"/init.mp4", http.StatusOK, "video/mp4"},
+		{"/seg0.m4s", http.StatusOK, "video/iso.segment"},
+		{"/seg9.m4s", http.StatusNotFound, ""},
+		{"/segx.m4s", http.StatusNotFound, ""},
+		{"/part2.1.m4s", http.StatusOK, "video/iso.segment"},
+		{"/part0.9.m4s", http.StatusNotFound, ""},
+		{"/other.txt", http.StatusNotFound, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			res, err := http.Get(server.URL + test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != test.status {
+				t.Fatalf("status = %d, want %d", res.StatusCode, test.status)
+			}
+			if got := res.Header.Get("Content-Type"); test.contentType != "" && got != test.contentType {
+				t.Errorf("content type %q, want %q", got, test.contentType)
+			}
+		})
+	}
+}
+
+func TestSegmentIsItsParts(t *testing.T) {
+	s := NewStream(testConfig, func() {})
+	writeFrames(t, s, 15)
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	get := func(path string) []byte {
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	var parts []byte
+	for i := 0; i < 5; i++ {
+		parts = append(parts, get(fmt.Sprintf("/part0.%d.m4s", i))...)
+	}
+	if segment := get("/seg0.m4s"); len(segment) == 0 || !bytes.Equal(segment, parts) {
+		t.Errorf("segment of %d bytes isn't its %d bytes of parts", len(segment), len(parts))
+	}
+}
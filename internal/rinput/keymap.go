@@ -0,0 +1,93 @@
+package rinput
+
+import (
+	"strconv"
+
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+// X pointer buttons, 4 to 7 are the wheel directions
+const (
+	xButtonLeft       = 1
+	xButtonMiddle     = 2
+	xButtonRight      = 3
+	xButtonWheelUp    = 4
+	xButtonWheelDown  = 5
+	xButtonWheelLeft  = 6
+	xButtonWheelRight = 7
+	xButtonBack       = 8
+	xButtonForward    = 9
+)
+
+var xButtons = map[MouseButton]byte{
+	MouseLeft:    xButtonLeft,
+	MouseMiddle:  xButtonMiddle,
+	MouseRight:   xButtonRight,
+	MouseBack:    xButtonBack,
+	MouseForward: xButtonForward,
+}
+
+// domCodeKeysyms maps DOM KeyboardEvent.code values, which identify the
+// physical key regardless of the viewer's layout, to the X keysym of that
+// key on a US layout
+var domCodeKeysyms = map[string]xproto.Keysym{
+	"Escape":         0xff1b,
+	"Backspace":      0xff08,
+	"Tab":            0xff09,
+	"Enter":          0xff0d,
+	"Space":          0x0020,
+	"CapsLock":       0xffe5,
+	"ShiftLeft":      0xffe1,
+	"ShiftRight":     0xffe2,
+	"ControlLeft":    0xffe3,
+	"ControlRight":   0xffe4,
+	"AltLeft":        0xffe9,
+	"AltRight":       0xffea,
+	"MetaLeft":       0xffeb,
+	"MetaRight":      0xffec,
+	"ContextMenu":    0xff67,
+	"PrintScreen":    0xff61,
+	"ScrollLock":     0xff14,
+	"Pause":          0xff13,
+	"Insert":         0xff63,
+	"Delete":         0xffff,
+	"Home":           0xff50,
+	"End":            0xff57,
+	"PageUp":         0xff55,
+	"PageDown":       0xff56,
+	"ArrowLeft":      0xff51,
+	"ArrowUp":        0xff52,
+	"ArrowRight":     0xff53,
+	"ArrowDown":      0xff54,
+	"Backquote":      0x0060,
+	"Minus":          0x002d,
+	"Equal":          0x003d,
+	"BracketLeft":    0x005b,
+	"BracketRight":   0x005d,
+	"Backslash":      0x005c,
+	"Semicolon":      0x003b,
+	"Quote":          0x0027,
+	"Comma":          0x002c,
+	"Period":         0x002e,
+	"Slash":          0x002f,
+	"NumLock":        0xff7f,
+	"NumpadDivide":   0xffaf,
+	"NumpadMultiply": 0xffaa,
+	"NumpadSubtract": 0xffad,
+	"NumpadAdd":      0xffab,
+	"NumpadEnter":    0xff8d,
+	"NumpadDecimal":  0xffae,
+}
+
+func init() {
+	for i := 0; i < 26; i++ {
+		domCodeKeysyms["Key"+string(rune('A'+i))] = xproto.Keysym('a' + i)
+	}
+	for i := 0; i < 10; i++ {
+		domCodeKeysyms["Digit"+string(rune('0'+i))] = xproto.Keysym('0' + i)
+		domCodeKeysyms["Numpad"+string(rune('0'+i))] = xproto.Keysym(0xffb0 + i)
+	}
+	for i := 1; i <= 12; i++ {
+		domCodeKeysyms["F"+strconv.Itoa(i)] = xproto.Keysym(0xffbe + i - 1)
+	}
+}
@@ -0,0 +1,39 @@
+package rinput
+
+import "io"
+
+// MouseButton identifies a pointer button using the DOM MouseEvent.button
+// numbering
+type MouseButton int
+
+const (
+	// MouseLeft main button
+	MouseLeft MouseButton = iota
+	// MouseMiddle wheel button
+	MouseMiddle
+	// MouseRight secondary button
+	MouseRight
+	// MouseBack browser back button
+	MouseBack
+	// MouseForward browser forward button
+	MouseForward
+)
+
+// Injector replays viewer input on the host display. Coordinates are
+// absolute positions on the host's root window.
+type Injector interface {
+	io.Closer
+	MouseMove(x, y int) error
+	MouseMoveRelative(dx, dy int) error
+	MouseButton(button MouseButton, pressed bool) error
+	// Wheel scrolls by the given number of notches, positive values scroll
+	// right and down
+	Wheel(dx, dy int) error
+	// Key presses or releases a key identified by its DOM KeyboardEvent.code
+	Key(code string, pressed bool) error
+}
+
+// Service creates input injectors
+type Service interface {
+	CreateInjector() (Injector, error)
+}
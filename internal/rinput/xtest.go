@@ -0,0 +1,157 @@
+package rinput
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/BurntSushi/xgb"
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/BurntSushi/xgb/xtest"
+)
+
+// maxWheelDetents bounds the wheel clicks sent per axis for a single event
+const maxWheelDetents = 20
+
+// XInputProvider implements the rinput.Service interface for XServer
+type XInputProvider struct{}
+
+// XTestInjector injects input into a X server through the XTEST extension
+type XTestInjector struct {
+	mu       sync.Mutex
+	conn     *xgb.Conn
+	root     xproto.Window
+	keycodes map[xproto.Keysym]xproto.Keycode
+}
+
+// NewInputProvider returns an X Server-based input provider
+func NewInputProvider() (Service, error) {
+	return &XInputProvider{}, nil
+}
+
+// CreateInjector opens a connection to the X server used to inject input
+func (*XInputProvider) CreateInjector() (Injector, error) {
+	conn, err := xgb.NewConn()
+	if err != nil {
+		return nil, err
+	}
+	if err = xtest.Init(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	setup := xproto.Setup(conn)
+	keycodes, err := loadKeycodes(conn, setup)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &XTestInjector{
+		conn:     conn,
+		root:     setup.DefaultScreen(conn).Root,
+		keycodes: keycodes,
+	}, nil
+}
+
+// loadKeycodes maps every keysym of the current keyboard layout to the
+// first keycode producing it
+func loadKeycodes(conn *xgb.Conn, setup *xproto.SetupInfo) (map[xproto.Keysym]xproto.Keycode, error) {
+	count := byte(setup.MaxKeycode - setup.MinKeycode + 1)
+	reply, err := xproto.GetKeyboardMapping(conn, setup.MinKeycode, count).Reply()
+	if err != nil {
+		return nil, err
+	}
+	perKeycode := int(reply.KeysymsPerKeycode)
+	keycodes := make(map[xproto.Keysym]xproto.Keycode, len(reply.Keysyms))
+	for i, keysym := range reply.Keysyms {
+		if keysym == 0 {
+			continue
+		}
+		if _, found := keycodes[keysym]; !found {
+			keycodes[keysym] = setup.MinKeycode + xproto.Keycode(i/perKeycode)
+		}
+	}
+	return keycodes, nil
+}
+
+func (x *XTestInjector) fake(eventType byte, detail byte, rootX, rootY int) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return xtest.FakeInputChecked(x.conn, eventType, detail, 0, x.root, int16(rootX), int16(rootY), 0).Check()
+}
+
+// MouseMove moves the pointer to an absolute position
+func (x *XTestInjector) MouseMove(rootX, rootY int) error {
+	return x.fake(xproto.MotionNotify, 0, rootX, rootY)
+}
+
+// MouseMoveRelative moves the pointer relative to its current position
+func (x *XTestInjector) MouseMoveRelative(dx, dy int) error {
+	return x.fake(xproto.MotionNotify, 1, dx, dy)
+}
+
+// MouseButton presses or releases a pointer button
+func (x *XTestInjector) MouseButton(button MouseButton, pressed bool) error {
+	detail, found := xButtons[button]
+	if !found {
+		return fmt.Errorf("Unknown mouse button %d", button)
+	}
+	return x.click(detail, pressed)
+}
+
+// Wheel scrolls by sending clicks on the X wheel buttons, at most
+// maxWheelDetents per axis
+func (x *XTestInjector) Wheel(dx, dy int) error {
+	scroll := func(amount int, negative, positive byte) error {
+		detail := positive
+		if amount < 0 {
+			detail = negative
+			amount = -amount
+		}
+		if amount > maxWheelDetents {
+			amount = maxWheelDetents
+		}
+		for i := 0; i < amount; i++ {
+			if err := x.click(detail, true); err != nil {
+				return err
+			}
+			if err := x.click(detail, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := scroll(dy, xButtonWheelUp, xButtonWheelDown); err != nil {
+		return err
+	}
+	return scroll(dx, xButtonWheelLeft, xButtonWheelRight)
+}
+
+func (x *XTestInjector) click(detail byte, pressed bool) error {
+	eventType := byte(xproto.ButtonRelease)
+	if pressed {
+		eventType = xproto.ButtonPress
+	}
+	return x.fake(eventType, detail, 0, 0)
+}
+
+// Key presses or releases the key matching a DOM KeyboardEvent.code
+func (x *XTestInjector) Key(code string, pressed bool) error {
+	keysym, found := domCodeKeysyms[code]
+	if !found {
+		return fmt.Errorf("Unknown key code %s", code)
+	}
+	keycode, found := x.keycodes[keysym]
+	if !found {
+		return fmt.Errorf("Key %s not available in the host keyboard layout", code)
+	}
+	eventType := byte(xproto.KeyRelease)
+	if pressed {
+		eventType = xproto.KeyPress
+	}
+	return x.fake(eventType, byte(keycode), 0, 0)
+}
+
+// Close closes the connection to the X server
+func (x *XTestInjector) Close() error {
+	x.conn.Close()
+	return nil
+}
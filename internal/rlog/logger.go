@@ -0,0 +1,237 @@
+package rlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log line
+type Level int
+
+const (
+	// LevelDebug is for tracing what the agent does, SDP and ICE included
+	LevelDebug Level = iota
+	// LevelInfo is for the lifecycle of sessions and outputs
+	LevelInfo
+	// LevelWarn is for failures the agent works around
+	LevelWarn
+	// LevelError is for failures that end a session or a feature
+	LevelError
+)
+
+// ParseLevel maps the flag names to a Level, unknown values fall back to
+// LevelInfo
+func ParseLevel(level string) Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return LevelDebug
+	case "warn", "warning":
+		return LevelWarn
+	case "error":
+		return LevelError
+	}
+	return LevelInfo
+}
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "info"
+}
+
+// Field is a key/value pair attached to every line of a logger
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F makes a Field
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Config sets up the output of a logger
+type Config struct {
+	// Level is the least severe level written
+	Level Level
+	// JSON writes a JSON object per line instead of text
+	JSON bool
+	// Redact hides IP addresses and credentials, see Redact
+	Redact bool
+}
+
+// sink is the output shared by a logger and the loggers derived from it
+type sink struct {
+	config Config
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Logger writes levelled lines with fields. A nil *Logger discards
+// everything, so components can be used without one.
+type Logger struct {
+	sink   *sink
+	fields []Field
+}
+
+// New returns a logger writing to w
+func New(w io.Writer, config Config) *Logger {
+	return &Logger{sink: &sink{config: config, w: w}}
+}
+
+// With returns a logger adding fields to every line, after the fields of l
+func (l *Logger) With(fields ...Field) *Logger {
+	if l == nil {
+		return nil
+	}
+	all := make([]Field, 0, len(l.fields)+len(fields))
+	all = append(all, l.fields...)
+	all = append(all, fields...)
+	return &Logger{sink: l.sink, fields: all}
+}
+
+// Enabled reports whether lines of level are written, to skip building
+// expensive messages
+func (l *Logger) Enabled(level Level) bool {
+	return l != nil && level >= l.sink.config.Level
+}
+
+// Debugf logs at LevelDebug
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, format, args...)
+}
+
+// Infof logs at LevelInfo
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, format, args...)
+}
+
+// Warnf logs at LevelWarn
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LevelWarn, format, args...)
+}
+
+// Errorf logs at LevelError
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, format, args...)
+}
+
+// Fatalf logs at LevelError and exits
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.logf(LevelError, format, args...)
+	os.Exit(1)
+}
+
+func (l *Logger) logf(level Level, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.write(time.Now(), level, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) write(now time.Time, level Level, msg string) {
+	config := l.sink.config
+	if config.Redact {
+		msg = Redact(msg)
+	}
+	fields := make([]Field, len(l.fields))
+	for i, field := range l.fields {
+		value := fmt.Sprint(field.Value)
+		if config.Redact {
+			value = redactField(field.Key, value)
+		}
+		fields[i] = Field{Key: field.Key, Value: value}
+	}
+
+	var line bytes.Buffer
+	if config.JSON {
+		writeJSON(&line, now, level, msg, fields)
+	} else {
+		writeText(&line, now, level, msg, fields)
+	}
+
+	l.sink.mu.Lock()
+	l.sink.w.Write(line.Bytes())
+	l.sink.mu.Unlock()
+}
+
+// writeText writes "<time> <LEVEL> <message> key=value...", values with
+// spaces or quotes are quoted
+func writeText(line *bytes.Buffer, now time.Time, level Level, msg string, fields []Field) {
+	line.WriteString(now.UTC().Format(time.RFC3339Nano))
+	line.WriteByte(' ')
+	line.WriteString(strings.ToUpper(level.String()))
+	line.WriteByte(' ')
+	line.WriteString(strings.TrimRight(msg, "\n"))
+	for _, field := range fields {
+		value := field.Value.(string)
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+		line.WriteByte(' ')
+		line.WriteString(field.Key)
+		line.WriteByte('=')
+		line.WriteString(value)
+	}
+	line.WriteByte('\n')
+}
+
+// writeJSON writes an object with the time, level, msg and fields keys,
+// the first field wins if keys repeat
+func writeJSON(line *bytes.Buffer, now time.Time, level Level, msg string, fields []Field) {
+	seen := map[string]bool{"time": true, "level": true, "msg": true}
+	line.WriteString(`{"time":`)
+	writeJSONString(line, now.UTC().Format(time.RFC3339Nano))
+	line.WriteString(`,"level":`)
+	writeJSONString(line, level.String())
+	line.WriteString(`,"msg":`)
+	writeJSONString(line, strings.TrimRight(msg, "\n"))
+	for _, field := range fields {
+		if seen[field.Key] {
+			continue
+		}
+		seen[field.Key] = true
+		line.WriteByte(',')
+		writeJSONString(line, field.Key)
+		line.WriteByte(':')
+		writeJSONString(line, field.Value.(string))
+	}
+	line.WriteString("}\n")
+}
+
+func writeJSONString(line *bytes.Buffer, s string) {
+	encoded, _ := json.Marshal(s)
+	line.Write(encoded)
+}
+
+// Writer returns a writer logging every line written to it at level, to
+// hand the logger to the standard log package or http.Server
+func (l *Logger) Writer(level Level) io.Writer {
+	return &lineWriter{log: l, level: level}
+}
+
+type lineWriter struct {
+	log   *Logger
+	level Level
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.log.logf(w.level, "%s", line)
+	}
+	return len(p), nil
+}
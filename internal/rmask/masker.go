@@ -0,0 +1,225 @@
+package rmask
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// windowRefresh is how often the windows are listed again while window
+	// rules are set. A window that just appeared or moved may show for up
+	// to that long.
+	windowRefresh = 100 * time.Millisecond
+	// blurBlock is the side of the blocks StyleBlur averages, large enough
+	// to make text unreadable
+	blurBlock = 20
+)
+
+// area is a resolved rule, what to hide and how
+type area struct {
+	rect  image.Rectangle
+	style Style
+}
+
+// Masker hides areas of the captured frames before they are encoded. The
+// rules can be replaced at any time, every feed sharing the masker picks
+// them up with its next frame.
+type Masker struct {
+	windows WindowLister
+
+	mu    sync.Mutex
+	rules []Rule
+	areas []area
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewMasker returns a masker applying rules, windows can be nil when there
+// is no window list, window rules are rejected then
+func NewMasker(windows WindowLister, rules []Rule) (*Masker, error) {
+	m := &Masker{
+		windows: windows,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := m.SetRules(rules); err != nil {
+		return nil, err
+	}
+	go m.run()
+	return m, nil
+}
+
+// Rules returns the current rules
+func (m *Masker) Rules() []Rule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Rule{}, m.rules...)
+}
+
+// SetRules replaces the rules, the windows are listed right away so the
+// next frame is already masked
+func (m *Masker) SetRules(rules []Rule) error {
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+		if rule.matchesWindows() && m.windows == nil {
+			return fmt.Errorf("Window rules need the X window list")
+		}
+	}
+	rules = append([]Rule{}, rules...)
+	areas, err := m.resolve(rules)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.rules = rules
+	m.areas = areas
+	m.mu.Unlock()
+	return nil
+}
+
+// resolve turns the rules into the areas to hide
+func (m *Masker) resolve(rules []Rule) ([]area, error) {
+	var windows []Window
+	for _, rule := range rules {
+		if rule.matchesWindows() {
+			var err error
+			if windows, err = m.windows.Windows(); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	areas := []area{}
+	for _, rule := range rules {
+		if !rule.matchesWindows() {
+			areas = append(areas, area{rect: rule.Rect, style: rule.Style})
+			continue
+		}
+		for _, w := range windows {
+			if rule.matches(w) {
+				areas = append(areas, area{rect: w.Bounds, style: rule.Style})
+			}
+		}
+	}
+	return areas, nil
+}
+
+// run follows the windows while there are window rules. If the windows
+// can't be listed the last known positions stay masked.
+func (m *Masker) run() {
+	defer close(m.done)
+	ticker := time.NewTicker(windowRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+
+		m.mu.Lock()
+		rules := m.rules
+		m.mu.Unlock()
+
+		areas, err := m.resolve(rules)
+		if err != nil {
+			log.Printf("Masking: %v", err)
+			continue
+		}
+		m.mu.Lock()
+		// Rules replaced meanwhile were resolved by SetRules already
+		if sameRules(rules, m.rules) {
+			m.areas = areas
+		}
+		m.mu.Unlock()
+	}
+}
+
+func sameRules(a, b []Rule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply hides the masked areas of img, the capture of the desktop area
+// starting at origin
+func (m *Masker) Apply(img *image.RGBA, origin image.Point) {
+	m.mu.Lock()
+	areas := m.areas
+	m.mu.Unlock()
+
+	offset := img.Bounds().Min.Sub(origin)
+	for _, a := range areas {
+		rect := a.rect.Add(offset).Intersect(img.Bounds())
+		if rect.Empty() {
+			continue
+		}
+		if a.style == StyleBlur {
+			pixelate(img, rect)
+		} else {
+			fill(img, rect)
+		}
+	}
+}
+
+// Close stops following the windows
+func (m *Masker) Close() {
+	close(m.stop)
+	<-m.done
+}
+
+func fill(img *image.RGBA, rect image.Rectangle) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(rect.Min.X, y):img.PixOffset(rect.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			row[i] = 0
+			row[i+1] = 0
+			row[i+2] = 0
+			row[i+3] = 0xff
+		}
+	}
+}
+
+// pixelate replaces every block of rect with its average color, blocks are
+// aligned on rect so a window keeps the same mosaic while it moves
+func pixelate(img *image.RGBA, rect image.Rectangle) {
+	for by := rect.Min.Y; by < rect.Max.Y; by += blurBlock {
+		for bx := rect.Min.X; bx < rect.Max.X; bx += blurBlock {
+			block := image.Rect(bx, by, bx+blurBlock, by+blurBlock).Intersect(rect)
+			var r, g, b, n uint32
+			for y := block.Min.Y; y < block.Max.Y; y++ {
+				row := img.Pix[img.PixOffset(block.Min.X, y):img.PixOffset(block.Max.X, y)]
+				for i := 0; i < len(row); i += 4 {
+					r += uint32(row[i])
+					g += uint32(row[i+1])
+					b += uint32(row[i+2])
+					n++
+				}
+			}
+			r, g, b = r/n, g/n, b/n
+			for y := block.Min.Y; y < block.Max.Y; y++ {
+				row := img.Pix[img.PixOffset(block.Min.X, y):img.PixOffset(block.Max.X, y)]
+				for i := 0; i < len(row); i += 4 {
+					row[i] = uint8(r)
+					row[i+1] = uint8(g)
+					row[i+2] = uint8(b)
+					row[i+3] = 0xff
+				}
+			}
+		}
+	}
+}
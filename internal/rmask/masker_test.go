@@ -0,0 +1,86 @@
+package rmask
+
+import (
+	"image"
+	"testing"
+)
+
+// masked returns the area of img painted black by Apply
+func masked(img *image.RGBA) image.Rectangle {
+	area := image.Rectangle{}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if img.RGBAAt(x, y).A == 0xff {
+				area = area.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return area
+}
+
+func TestApplyClipsRects(t *testing.T) {
+	tests := []struct {
+		name   string
+		rect   image.Rectangle
+		bounds image.Rectangle
+		origin image.Point
+		want   image.Rectangle
+	}{
+		{"inside", image.Rect(10, 10, 20, 20), image.Rect(0, 0, 100, 100), image.Point{}, image.Rect(10, 10, 20, 20)},
+		{"across the top left corner", image.Rect(-10, -10, 5, 5), image.Rect(0, 0, 100, 100), image.Point{}, image.Rect(0, 0, 5, 5)},
+		{"across the bottom right corner", image.Rect(90, 95, 150, 150), image.Rect(0, 0, 100, 100), image.Point{}, image.Rect(90, 95, 100, 100)},
+		{"covering the screen", image.Rect(-50, -50, 200, 200), image.Rect(0, 0, 100, 100), image.Point{}, image.Rect(0, 0, 100, 100)},
+		{"outside", image.Rect(100, 0, 120, 20), image.Rect(0, 0, 100, 100), image.Point{}, image.Rectangle{}},
+		{"on a second screen", image.Rect(1930, 10, 1940, 20), image.Rect(0, 0, 100, 100), image.Pt(1920, 0), image.Rect(10, 10, 20, 20)},
+		{"on the first screen of two", image.Rect(10, 10, 20, 20), image.Rect(0, 0, 100, 100), image.Pt(1920, 0), image.Rectangle{}},
+		{"into an offset capture", image.Rect(1910, 10, 1930, 20), image.Rect(50, 50, 150, 150), image.Pt(1920, 0), image.Rect(50, 60, 60, 70)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := NewMasker(nil, []Rule{{Rect: test.rect}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+
+			img := image.NewRGBA(test.bounds)
+			m.Apply(img, test.origin)
+			if got := masked(img); got != test.want {
+				t.Errorf("masked %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSetRulesValidates(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  Rule
+		valid bool
+	}{
+		{"rectangle", Rule{Rect: image.Rect(0, 0, 10, 10)}, true},
+		{"empty rectangle", Rule{Rect: image.Rect(10, 10, 10, 20)}, false},
+		{"window without a window list", Rule{Class: "KeePassXC"}, false},
+		{"bad pattern", Rule{Title: "[", Rect: image.Rect(0, 0, 10, 10)}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := NewMasker(nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+
+			err = m.SetRules([]Rule{test.rule})
+			if test.valid && err != nil {
+				t.Errorf("rejected: %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Error("accepted")
+			}
+		})
+	}
+}
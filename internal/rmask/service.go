@@ -0,0 +1,131 @@
+package rmask
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// Style is how a masked area is hidden
+type Style int
+
+const (
+	// StyleBlack paints the area black
+	StyleBlack Style = iota
+	// StyleBlur pixelates the area in coarse blocks, enough to tell a
+	// window is there but not what it shows. Unlike a gaussian blur text
+	// can't be recovered from it.
+	StyleBlur
+)
+
+// ParseStyle maps the API names to a Style, unknown values fall back to
+// StyleBlack
+func ParseStyle(style string) Style {
+	if strings.ToLower(style) == "blur" {
+		return StyleBlur
+	}
+	return StyleBlack
+}
+
+func (s Style) String() string {
+	if s == StyleBlur {
+		return "blur"
+	}
+	return "black"
+}
+
+// Rule selects an area to hide. A rule with a class or title pattern
+// (path.Match syntax) hides the windows matching all the patterns it has,
+// decorations included, otherwise it hides Rect, in desktop coordinates.
+type Rule struct {
+	// Class matches the instance or the class name of WM_CLASS
+	Class string
+	Title string
+	Rect  image.Rectangle
+	Style Style
+}
+
+// matchesWindows reports whether the rule hides windows rather than a
+// fixed rectangle
+func (r Rule) matchesWindows() bool {
+	return r.Class != "" || r.Title != ""
+}
+
+func (r Rule) validate() error {
+	for _, pattern := range []string{r.Class, r.Title} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Bad window pattern %q: %v", pattern, err)
+		}
+	}
+	if !r.matchesWindows() && r.Rect.Empty() {
+		return fmt.Errorf("Mask rule needs a window pattern or a rectangle")
+	}
+	return nil
+}
+
+// Window is a top-level window of the desktop, Bounds in desktop
+// coordinates include the decorations
+type Window struct {
+	Instance string
+	Class    string
+	Title    string
+	Bounds   image.Rectangle
+}
+
+func (r Rule) matches(w Window) bool {
+	if r.Class != "" {
+		instance, _ := path.Match(r.Class, w.Instance)
+		class, _ := path.Match(r.Class, w.Class)
+		if !instance && !class {
+			return false
+		}
+	}
+	if r.Title != "" {
+		if matched, _ := path.Match(r.Title, w.Title); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// WindowLister lists the visible top-level windows
+type WindowLister interface {
+	Windows() ([]Window, error)
+}
+
+// ruleFile is the JSON form of a rule in a rules file
+type ruleFile struct {
+	Class  string `json:"class"`
+	Title  string `json:"title"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Style  string `json:"style"`
+}
+
+// LoadRules reads a JSON array of rules, e.g.
+// [{"class": "KeePassXC", "style": "blur"}, {"x": 0, "y": 0, "width": 400, "height": 300}]
+func LoadRules(file string) ([]Rule, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var entries []ruleFile
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("Bad rules file %s: %v", file, err)
+	}
+	rules := make([]Rule, len(entries))
+	for i, e := range entries {
+		rules[i] = Rule{
+			Class: e.Class,
+			Title: e.Title,
+			Rect:  image.Rect(e.X, e.Y, e.X+e.Width, e.Y+e.Height),
+			Style: ParseStyle(e.Style),
+		}
+	}
+	return rules, nil
+}
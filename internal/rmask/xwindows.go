@@ -0,0 +1,159 @@
+package rmask
+
+import (
+	"bytes"
+	"image"
+
+	"github.com/BurntSushi/xgb"
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+// XWindowLister lists the windows of the X display through the EWMH client
+// list, or the children of the root window without an EWMH window manager
+type XWindowLister struct {
+	conn *xgb.Conn
+	root xproto.Window
+
+	clientList   xproto.Atom
+	wmName       xproto.Atom
+	utf8         xproto.Atom
+	frameExtents xproto.Atom
+}
+
+// NewWindowLister connects to the X server
+func NewWindowLister() (*XWindowLister, error) {
+	conn, err := xgb.NewConn()
+	if err != nil {
+		return nil, err
+	}
+	l := &XWindowLister{
+		conn: conn,
+		root: xproto.Setup(conn).DefaultScreen(conn).Root,
+	}
+	names := map[string]*xproto.Atom{
+		"_NET_CLIENT_LIST":   &l.clientList,
+		"_NET_WM_NAME":       &l.wmName,
+		"UTF8_STRING":        &l.utf8,
+		"_NET_FRAME_EXTENTS": &l.frameExtents,
+	}
+	for name, atom := range names {
+		reply, err := xproto.InternAtom(conn, false, uint16(len(name)), name).Reply()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		*atom = reply.Atom
+	}
+	return l, nil
+}
+
+// windowCookies are the requests about one window, sent all at once before
+// waiting for any reply
+type windowCookies struct {
+	attributes xproto.GetWindowAttributesCookie
+	geometry   xproto.GetGeometryCookie
+	position   xproto.TranslateCoordinatesCookie
+	class      xproto.GetPropertyCookie
+	netName    xproto.GetPropertyCookie
+	name       xproto.GetPropertyCookie
+	extents    xproto.GetPropertyCookie
+}
+
+// Windows lists the mapped top-level windows. Windows closed while being
+// listed are skipped.
+func (l *XWindowLister) Windows() ([]Window, error) {
+	ids, err := l.topLevel()
+	if err != nil {
+		return nil, err
+	}
+
+	cookies := make([]windowCookies, len(ids))
+	for i, id := range ids {
+		cookies[i] = windowCookies{
+			attributes: xproto.GetWindowAttributes(l.conn, id),
+			geometry:   xproto.GetGeometry(l.conn, xproto.Drawable(id)),
+			position:   xproto.TranslateCoordinates(l.conn, id, l.root, 0, 0),
+			class:      xproto.GetProperty(l.conn, false, id, xproto.AtomWmClass, xproto.AtomString, 0, 256),
+			netName:    xproto.GetProperty(l.conn, false, id, l.wmName, l.utf8, 0, 256),
+			name:       xproto.GetProperty(l.conn, false, id, xproto.AtomWmName, xproto.GetPropertyTypeAny, 0, 256),
+			extents:    xproto.GetProperty(l.conn, false, id, l.frameExtents, xproto.AtomCardinal, 0, 4),
+		}
+	}
+
+	windows := []Window{}
+	for _, c := range cookies {
+		attributes, attrErr := c.attributes.Reply()
+		geometry, geomErr := c.geometry.Reply()
+		position, posErr := c.position.Reply()
+		class, _ := c.class.Reply()
+		netName, _ := c.netName.Reply()
+		name, _ := c.name.Reply()
+		extents, _ := c.extents.Reply()
+		if attrErr != nil || geomErr != nil || posErr != nil {
+			continue
+		}
+		if attributes.MapState != xproto.MapStateViewable {
+			continue
+		}
+
+		// The position is the one of the inside of the border
+		x, y, border := int(position.DstX), int(position.DstY), int(geometry.BorderWidth)
+		w := Window{
+			Bounds: image.Rect(
+				x-border, y-border,
+				x+int(geometry.Width)+border, y+int(geometry.Height)+border,
+			),
+		}
+		if class != nil {
+			// WM_CLASS is the instance and the class, both null terminated
+			parts := bytes.Split(class.Value, []byte{0})
+			w.Instance = string(parts[0])
+			if len(parts) > 1 {
+				w.Class = string(parts[1])
+			}
+		}
+		if netName != nil && len(netName.Value) > 0 {
+			w.Title = string(netName.Value)
+		} else if name != nil {
+			w.Title = string(name.Value)
+		}
+		// _NET_FRAME_EXTENTS is left, right, top and bottom, the title bar
+		// shows the title too
+		if extents != nil && len(extents.Value) >= 16 {
+			left := int(xgb.Get32(extents.Value[0:]))
+			right := int(xgb.Get32(extents.Value[4:]))
+			top := int(xgb.Get32(extents.Value[8:]))
+			bottom := int(xgb.Get32(extents.Value[12:]))
+			w.Bounds.Min = w.Bounds.Min.Sub(image.Pt(left, top))
+			w.Bounds.Max = w.Bounds.Max.Add(image.Pt(right, bottom))
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func (l *XWindowLister) topLevel() ([]xproto.Window, error) {
+	reply, err := xproto.GetProperty(l.conn, false, l.root, l.clientList, xproto.AtomWindow, 0, 1<<16).Reply()
+	if err != nil {
+		return nil, err
+	}
+	if reply.Format == 32 && reply.ValueLen > 0 {
+		ids := make([]xproto.Window, reply.ValueLen)
+		for i := range ids {
+			ids[i] = xproto.Window(xgb.Get32(reply.Value[i*4:]))
+		}
+		return ids, nil
+	}
+
+	tree, err := xproto.QueryTree(l.conn, l.root).Reply()
+	if err != nil {
+		return nil, err
+	}
+	return tree.Children, nil
+}
+
+// Close disconnects from the X server
+func (l *XWindowLister) Close() error {
+	l.conn.Close()
+	return nil
+}
@@ -0,0 +1,200 @@
+package rrecord
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/bits"
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+const (
+	mp4VideoTimescale = 90000
+	mp4VideoTrack     = 1
+	mp4AudioTrack     = 2
+	// mp4FragmentDuration bounds the media held in memory, every fragment
+	// is playable as soon as it is written
+	mp4FragmentDuration = time.Second
+)
+
+// mp4Muxer writes fragmented MP4: the init segment followed by one moof and
+// mdat pair per fragment. Fragments start at keyframes when there are some,
+// the low latency profile only has intra refresh so they are cut by time.
+type mp4Muxer struct {
+	w     io.WriteCloser
+	audio *AudioTrack
+	seq   uint32
+	video []mp4.FullSample
+	sound []mp4.FullSample
+	// start is the pts of the first sample of the pending fragment
+	start time.Duration
+}
+
+func newMP4Muxer(w io.WriteCloser, sps, pps [][]byte, audio *AudioTrack) (muxer, error) {
+	init := mp4.CreateEmptyInit()
+	init.AddEmptyTrack(mp4VideoTimescale, "video", "und")
+	if err := init.Moov.Traks[0].SetAVCDescriptor("avc1", sps, pps, true); err != nil {
+		return nil, err
+	}
+	if audio != nil {
+		init.AddEmptyTrack(uint32(audio.SampleRate), "audio", "und")
+		entry := mp4.CreateAudioSampleEntryBox("Opus", uint16(audio.Channels), 16, uint16(audio.SampleRate), newOpusSpecificBox(audio))
+		init.Moov.Traks[1].Mdia.Minf.Stbl.Stsd.AddChild(entry)
+	}
+	if err := init.Encode(w); err != nil {
+		return nil, err
+	}
+	return &mp4Muxer{
+		w:     w,
+		audio: audio,
+		seq:   1,
+	}, nil
+}
+
+func (m *mp4Muxer) writeVideo(sample []byte, keyframe bool, pts, duration time.Duration) error {
+	if m.pending() && (keyframe || pts-m.start >= mp4FragmentDuration) {
+		if err := m.flush(); err != nil {
+			return err
+		}
+	}
+	m.begin(pts)
+	flags := mp4.NonSyncSampleFlags
+	if keyframe {
+		flags = mp4.SyncSampleFlags
+	}
+	m.video = append(m.video, fullSample(sample, flags, pts, duration, mp4VideoTimescale))
+	return nil
+}
+
+func (m *mp4Muxer) writeAudio(sample []byte, pts, duration time.Duration) error {
+	if m.audio == nil {
+		return nil
+	}
+	// Video cuts the fragments, audio only does if the video stalls
+	if m.pending() && pts-m.start >= 2*mp4FragmentDuration {
+		if err := m.flush(); err != nil {
+			return err
+		}
+	}
+	m.begin(pts)
+	m.sound = append(m.sound, fullSample(sample, mp4.SyncSampleFlags, pts, duration, m.audio.SampleRate))
+	return nil
+}
+
+func (m *mp4Muxer) pending() bool {
+	return len(m.video) > 0 || len(m.sound) > 0
+}
+
+func (m *mp4Muxer) begin(pts time.Duration) {
+	if !m.pending() {
+		m.start = pts
+	}
+}
+
+func (m *mp4Muxer) flush() error {
+	var tracks []uint32
+	if len(m.video) > 0 {
+		tracks = append(tracks, mp4VideoTrack)
+	}
+	if len(m.sound) > 0 {
+		tracks = append(tracks, mp4AudioTrack)
+	}
+	if len(tracks) == 0 {
+		return nil
+	}
+	fragment, err := mp4.CreateMultiTrackFragment(m.seq, tracks)
+	if err != nil {
+		return err
+	}
+	// Samples are added track after track, the order of the mdat
+	for _, sample := range m.video {
+		if err = fragment.AddFullSampleToTrack(sample, mp4VideoTrack); err != nil {
+			return err
+		}
+	}
+	for _, sample := range m.sound {
+		if err = fragment.AddFullSampleToTrack(sample, mp4AudioTrack); err != nil {
+			return err
+		}
+	}
+	m.seq++
+	m.video = m.video[:0]
+	m.sound = m.sound[:0]
+	return fragment.Encode(m.w)
+}
+
+func (m *mp4Muxer) close() error {
+	err := m.flush()
+	if closeErr := m.w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// fullSample converts the timing to the track timescale, the duration is
+// derived from the rounded start and end so that samples stay contiguous
+func fullSample(data []byte, flags uint32, pts, duration time.Duration, timescale int) mp4.FullSample {
+	start := toTimescale(pts, timescale)
+	end := toTimescale(pts+duration, timescale)
+	return mp4.FullSample{
+		Sample: mp4.Sample{
+			Flags: flags,
+			Dur:   uint32(end - start),
+			Size:  uint32(len(data)),
+		},
+		DecodeTime: start,
+		Data:       data,
+	}
+}
+
+func toTimescale(d time.Duration, timescale int) uint64 {
+	return uint64(d) * uint64(timescale) / uint64(time.Second)
+}
+
+// opusSpecificBox is the dOps box of the Opus in ISOBMFF mapping, which
+// mp4ff doesn't know about
+type opusSpecificBox struct {
+	payload []byte
+}
+
+func newOpusSpecificBox(audio *AudioTrack) *opusSpecificBox {
+	sw := bits.NewFixedSliceWriter(11)
+	sw.WriteUint8(0) // version
+	sw.WriteUint8(byte(audio.Channels))
+	sw.WriteUint16(0) // pre-skip
+	sw.WriteUint32(uint32(audio.SampleRate))
+	sw.WriteInt16(0) // output gain
+	sw.WriteUint8(0) // channel mapping family
+	return &opusSpecificBox{payload: sw.Bytes()}
+}
+
+func (b *opusSpecificBox) Type() string {
+	return "dOps"
+}
+
+func (b *opusSpecificBox) Size() uint64 {
+	return uint64(8 + len(b.payload))
+}
+
+func (b *opusSpecificBox) Encode(w io.Writer) error {
+	sw := bits.NewFixedSliceWriter(int(b.Size()))
+	if err := b.EncodeSW(sw); err != nil {
+		return err
+	}
+	_, err := w.Write(sw.Bytes())
+	return err
+}
+
+func (b *opusSpecificBox) EncodeSW(sw bits.SliceWriter) error {
+	if err := mp4.EncodeHeaderSW(b, sw); err != nil {
+		return err
+	}
+	sw.WriteBytes(b.payload)
+	return sw.AccError()
+}
+
+func (b *opusSpecificBox) Info(w io.Writer, specificBoxLevels, indent, indentStep string) error {
+	_, err := fmt.Fprintf(w, "%s[%s] size=%d\n", indent, b.Type(), b.Size())
+	return err
+}
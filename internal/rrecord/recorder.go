@@ -0,0 +1,213 @@
+package rrecord
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"oneplay-videostream-browser/internal/encoders"
+)
+
+// keyframeRetry is how long a recorder waits for a keyframe before asking
+// for another one, a request may be lost while the encoder is busy
+const keyframeRetry = time.Second
+
+// Recorder writes the encoded samples of a session to the recordings
+// directory without re-encoding them. Every file starts with a keyframe,
+// the recorder drops video until one comes and asks the encoder for it.
+type Recorder struct {
+	config          Config
+	format          Format
+	prefix          string
+	audio           *AudioTrack
+	newMuxer        muxerFactory
+	requestKeyframe func()
+
+	mu    sync.Mutex
+	file  *countingFile
+	muxer muxer
+	files []string
+	// opened is the wall clock of the first video sample of the file, the
+	// audio track starts at its offset from it
+	opened       time.Time
+	videoPTS     time.Duration
+	audioPTS     time.Duration
+	audioStarted bool
+	rotate       bool
+	requested    time.Time
+	closed       bool
+}
+
+// NewRecorder creates a recorder writing files named after prefix, audio is
+// nil for video only recordings. requestKeyframe asks the encoder feeding
+// the recorder for a keyframe.
+func NewRecorder(config Config, format Format, prefix string, audio *AudioTrack, requestKeyframe func()) (*Recorder, error) {
+	if config.Dir == "" {
+		return nil, fmt.Errorf("Recording disabled")
+	}
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Recorder{
+		config:          config,
+		format:          format,
+		prefix:          prefix,
+		audio:           audio,
+		newMuxer:        newMuxer(format),
+		requestKeyframe: requestKeyframe,
+	}, nil
+}
+
+// WriteVideo records an Annex-B H.264 frame lasting duration
+func (r *Recorder) WriteVideo(frame []byte, duration time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+
+	au := encoders.SplitAccessUnit(frame)
+	if len(au.Sample) == 0 {
+		return nil
+	}
+	startsFile := au.StartsStream()
+	if r.muxer == nil && !startsFile {
+		r.askKeyframe()
+		return nil
+	}
+	// A full file keeps going until the keyframe of the next one
+	if r.muxer == nil || (r.rotate && startsFile) {
+		if err := r.open(au.SPS, au.PPS); err != nil {
+			return err
+		}
+	}
+	if err := r.muxer.writeVideo(au.Sample, au.Keyframe, r.videoPTS, duration); err != nil {
+		return err
+	}
+	r.videoPTS += duration
+
+	if r.full() {
+		r.rotate = true
+		r.askKeyframe()
+	}
+	return nil
+}
+
+// WriteAudio records an Opus packet lasting duration, packets are dropped
+// until the video of the file started
+func (r *Recorder) WriteAudio(packet []byte, duration time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || r.muxer == nil || r.audio == nil {
+		return nil
+	}
+
+	if !r.audioStarted {
+		r.audioPTS = time.Since(r.opened)
+		r.audioStarted = true
+	}
+	if err := r.muxer.writeAudio(packet, r.audioPTS, duration); err != nil {
+		return err
+	}
+	r.audioPTS += duration
+	return nil
+}
+
+// Files returns the names of the files written so far
+func (r *Recorder) Files() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.files...)
+}
+
+// Close finishes the current file, samples written afterwards are dropped
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	return r.closeFile()
+}
+
+func (r *Recorder) askKeyframe() {
+	if time.Since(r.requested) < keyframeRetry {
+		return
+	}
+	r.requested = time.Now()
+	r.requestKeyframe()
+}
+
+// open moves on to a new file starting with the keyframe about to be
+// written
+func (r *Recorder) open(sps, pps [][]byte) error {
+	if err := r.closeFile(); err != nil {
+		log.Printf("Recorder: %v", err)
+	}
+
+	now := time.Now()
+	name := fmt.Sprintf("%s-%s-%03d%s", r.prefix, now.Format("20060102-150405"), len(r.files), r.format.Extension())
+	f, err := os.OpenFile(filepath.Join(r.config.Dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	file := &countingFile{File: f}
+	m, err := r.newMuxer(file, sps, pps, r.audio)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	r.file = file
+	r.muxer = m
+	r.files = append(r.files, name)
+	r.opened = now
+	r.videoPTS = 0
+	r.audioPTS = 0
+	r.audioStarted = false
+	r.rotate = false
+	r.requested = time.Time{}
+	return nil
+}
+
+func (r *Recorder) closeFile() error {
+	if r.muxer == nil {
+		return nil
+	}
+	err := r.muxer.close()
+	r.muxer = nil
+	r.file = nil
+	return err
+}
+
+// full reports whether the current file reached one of its limits
+func (r *Recorder) full() bool {
+	if r.config.MaxSize > 0 && r.file.written() >= r.config.MaxSize {
+		return true
+	}
+	return r.config.MaxDuration > 0 && r.videoPTS >= r.config.MaxDuration
+}
+
+// countingFile counts the bytes written to the file, the WebM writer
+// writes from its own goroutine
+type countingFile struct {
+	// accessed atomically, kept first for 64-bit alignment on 32-bit platforms
+	size int64
+	*os.File
+}
+
+func (f *countingFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	atomic.AddInt64(&f.size, int64(n))
+	return n, err
+}
+
+func (f *countingFile) written() int64 {
+	return atomic.LoadInt64(&f.size)
+}
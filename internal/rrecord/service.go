@@ -0,0 +1,125 @@
+package rrecord
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Format is the container recordings are written in
+type Format int
+
+const (
+	// MP4Format writes fragmented MP4, playable while it is being written
+	MP4Format Format = iota
+	// WebMFormat writes WebM, the video track stays H.264
+	WebMFormat
+)
+
+// ParseFormat maps the signaling/API names to a Format, unknown values fall
+// back to MP4Format
+func ParseFormat(format string) Format {
+	if strings.ToLower(format) == "webm" {
+		return WebMFormat
+	}
+	return MP4Format
+}
+
+func (f Format) String() string {
+	if f == WebMFormat {
+		return "webm"
+	}
+	return "mp4"
+}
+
+// Extension returns the file extension of the format, dot included
+func (f Format) Extension() string {
+	return "." + f.String()
+}
+
+// Config is the recording policy of the agent, recordings are disabled when
+// Dir is empty. A recording moves on to a new file once the current one
+// reaches MaxSize bytes or lasts MaxDuration, zero disables either limit.
+type Config struct {
+	Dir         string
+	MaxSize     int64
+	MaxDuration time.Duration
+}
+
+// AudioTrack describes the Opus track of a recording
+type AudioTrack struct {
+	SampleRate int
+	Channels   int
+}
+
+// muxer writes the samples of one file, video samples are AVC length
+// prefixed without parameter sets and timestamps are relative to the start
+// of the file
+type muxer interface {
+	writeVideo(sample []byte, keyframe bool, pts, duration time.Duration) error
+	writeAudio(sample []byte, pts, duration time.Duration) error
+	// close flushes the pending samples and closes the file
+	close() error
+}
+
+type muxerFactory func(w io.WriteCloser, sps, pps [][]byte, audio *AudioTrack) (muxer, error)
+
+func newMuxer(format Format) muxerFactory {
+	if format == WebMFormat {
+		return newWebMMuxer
+	}
+	return newMP4Muxer
+}
+
+// Recording is a file in the recordings directory
+type Recording struct {
+	Name     string
+	Size     int64
+	Modified time.Time
+}
+
+// List returns the recordings of dir, newest first
+func List(dir string) ([]Recording, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	recordings := []Recording{}
+	for _, info := range infos {
+		if info.IsDir() || !isRecording(info.Name()) {
+			continue
+		}
+		recordings = append(recordings, Recording{
+			Name:     info.Name(),
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+		})
+	}
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Modified.After(recordings[j].Modified)
+	})
+	return recordings, nil
+}
+
+// Path returns the path of the recording name in dir, names that aren't a
+// recording or point outside of dir are rejected
+func Path(dir, name string) (string, error) {
+	if name != filepath.Base(name) || !isRecording(name) {
+		return "", fmt.Errorf("Invalid recording name %q", name)
+	}
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func isRecording(name string) bool {
+	ext := filepath.Ext(name)
+	return !strings.HasPrefix(name, ".") && (ext == MP4Format.Extension() || ext == WebMFormat.Extension())
+}
@@ -0,0 +1,118 @@
+package rrecord
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/avc"
+	"github.com/at-wat/ebml-go/webm"
+)
+
+// opusSeekPreRoll is the audio to decode before a seek point for the Opus
+// decoder to converge, as recommended by the WebM Opus mapping
+const opusSeekPreRoll = 80 * time.Millisecond
+
+// webmMuxer writes the H.264 video as V_MPEG4/ISO/AVC, which browsers and
+// players accept in WebM even though the spec only lists VP8/VP9/AV1
+type webmMuxer struct {
+	video webm.BlockWriteCloser
+	sound webm.BlockWriteCloser
+}
+
+func newWebMMuxer(w io.WriteCloser, sps, pps [][]byte, audio *AudioTrack) (muxer, error) {
+	config, err := avc.CreateAVCDecConfRec(sps, pps, true)
+	if err != nil {
+		return nil, err
+	}
+	var codecPrivate bytes.Buffer
+	if err = config.Encode(&codecPrivate); err != nil {
+		return nil, err
+	}
+	parsed, err := avc.ParseSPSNALUnit(sps[0], false)
+	if err != nil {
+		return nil, err
+	}
+	tracks := []webm.TrackEntry{
+		{
+			Name:         "Video",
+			TrackNumber:  1,
+			TrackUID:     1,
+			CodecID:      "V_MPEG4/ISO/AVC",
+			CodecPrivate: codecPrivate.Bytes(),
+			TrackType:    1,
+			Video: &webm.Video{
+				PixelWidth:  uint64(parsed.Width),
+				PixelHeight: uint64(parsed.Height),
+			},
+		},
+	}
+	if audio != nil {
+		tracks = append(tracks, webm.TrackEntry{
+			Name:         "Audio",
+			TrackNumber:  2,
+			TrackUID:     2,
+			CodecID:      "A_OPUS",
+			CodecPrivate: opusHead(audio),
+			TrackType:    2,
+			SeekPreRoll:  uint64(opusSeekPreRoll),
+			Audio: &webm.Audio{
+				SamplingFrequency: float64(audio.SampleRate),
+				Channels:          uint64(audio.Channels),
+			},
+		})
+	}
+	writers, err := webm.NewSimpleBlockWriter(w, tracks)
+	if err != nil {
+		return nil, err
+	}
+	m := &webmMuxer{video: writers[0]}
+	if audio != nil {
+		m.sound = writers[1]
+	}
+	return m, nil
+}
+
+func (m *webmMuxer) writeVideo(sample []byte, keyframe bool, pts, duration time.Duration) error {
+	_, err := m.video.Write(keyframe, toTimecode(pts), sample)
+	return err
+}
+
+func (m *webmMuxer) writeAudio(sample []byte, pts, duration time.Duration) error {
+	if m.sound == nil {
+		return nil
+	}
+	_, err := m.sound.Write(true, toTimecode(pts), sample)
+	return err
+}
+
+// close closes every track, the writer closes the file after the last one
+func (m *webmMuxer) close() error {
+	err := m.video.Close()
+	if m.sound != nil {
+		if soundErr := m.sound.Close(); err == nil {
+			err = soundErr
+		}
+	}
+	return err
+}
+
+// toTimecode converts to the 1ms timecode scale of the segment
+func toTimecode(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// opusHead is the Ogg/WebM identification header of an Opus stream
+func opusHead(audio *AudioTrack) []byte {
+	head := []byte("OpusHead")
+	head = append(head, 1, byte(audio.Channels))
+	var fields [8]byte
+	// pre-skip, input sample rate and output gain
+	binary.LittleEndian.PutUint16(fields[0:2], 0)
+	binary.LittleEndian.PutUint32(fields[2:6], uint32(audio.SampleRate))
+	binary.LittleEndian.PutUint16(fields[6:8], 0)
+	head = append(head, fields[:]...)
+	// channel mapping family 0, mono or stereo
+	return append(head, 0)
+}
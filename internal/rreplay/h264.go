@@ -0,0 +1,214 @@
+package rreplay
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/avc"
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+var startCode = []byte{0, 0, 0, 1}
+
+// loadAnnexB splits an elementary stream in access units lasting duration
+// each, it returns them with the first SPS of the stream
+func loadAnnexB(data []byte, duration time.Duration) ([]Sample, []byte, error) {
+	var samples []Sample
+	var current [][]byte
+	var hasPicture bool
+	var sps, pps [][]byte
+
+	flush := func() {
+		if hasPicture {
+			samples = append(samples, newSample(current, sps, pps, duration))
+		}
+		current = nil
+		hasPicture = false
+	}
+	for _, nalu := range avc.ExtractNalusFromByteStream(data) {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch naluType := avc.GetNaluType(nalu[0]); naluType {
+		case avc.NALU_AUD, avc.NALU_SPS, avc.NALU_PPS, avc.NALU_SEI:
+			// Only ever found before the first slice of a picture
+			if hasPicture {
+				flush()
+			}
+			if naluType == avc.NALU_SPS {
+				sps = [][]byte{nalu}
+			} else if naluType == avc.NALU_PPS {
+				pps = [][]byte{nalu}
+			}
+		case avc.NALU_NON_IDR, avc.NALU_IDR:
+			// first_mb_in_slice is 0 for the first slice of a picture, its
+			// exp-Golomb code is then a single set bit
+			if hasPicture && len(nalu) > 1 && nalu[1]&0x80 != 0 {
+				flush()
+			}
+			hasPicture = true
+		}
+		current = append(current, nalu)
+	}
+	flush()
+
+	if len(sps) == 0 {
+		return samples, nil, nil
+	}
+	return samples, sps[0], nil
+}
+
+// loadMP4 reads the samples of the first H.264 track of a progressive or
+// fragmented MP4 file
+func loadMP4(data []byte) ([]Sample, []byte, error) {
+	file, err := mp4.DecodeFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	moov := file.Moov
+	if file.IsFragmented() && file.Init != nil {
+		moov = file.Init.Moov
+	}
+	if moov == nil {
+		return nil, nil, fmt.Errorf("No moov box")
+	}
+
+	var trak *mp4.TrakBox
+	for _, t := range moov.Traks {
+		stsd := t.Mdia.Minf.Stbl.Stsd
+		if t.Mdia.Hdlr.HandlerType == "vide" && stsd.AvcX != nil && stsd.AvcX.AvcC != nil {
+			trak = t
+			break
+		}
+	}
+	if trak == nil {
+		return nil, nil, fmt.Errorf("No H.264 track")
+	}
+	avcC := trak.Mdia.Minf.Stbl.Stsd.AvcX.AvcC
+	if len(avcC.SPSnalus) == 0 {
+		return nil, nil, fmt.Errorf("No SPS in the H.264 track")
+	}
+	timescale := time.Duration(trak.Mdia.Mdhd.Timescale)
+
+	var full []mp4.FullSample
+	if file.IsFragmented() {
+		full, err = fragmentedSamples(file, moov, trak.Tkhd.TrackID)
+	} else {
+		full, err = progressiveSamples(data, trak)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	samples := make([]Sample, 0, len(full))
+	for _, s := range full {
+		nalus, err := avc.GetNalusFromSample(s.Data)
+		if err != nil {
+			return nil, nil, err
+		}
+		duration := time.Duration(s.Dur) * time.Second / timescale
+		samples = append(samples, newSample(nalus, avcC.SPSnalus, avcC.PPSnalus, duration))
+	}
+	return samples, avcC.SPSnalus[0], nil
+}
+
+func fragmentedSamples(file *mp4.File, moov *mp4.MoovBox, trackID uint32) ([]mp4.FullSample, error) {
+	var trex *mp4.TrexBox
+	if moov.Mvex != nil {
+		trex, _ = moov.Mvex.GetTrex(trackID)
+	}
+	if trex == nil {
+		return nil, fmt.Errorf("No trex box for track %d", trackID)
+	}
+	var samples []mp4.FullSample
+	for _, segment := range file.Segments {
+		for _, fragment := range segment.Fragments {
+			fragmentSamples, err := fragment.GetFullSamples(trex)
+			if err != nil {
+				return nil, err
+			}
+			samples = append(samples, fragmentSamples...)
+		}
+	}
+	return samples, nil
+}
+
+// progressiveSamples locates every sample of the track through its chunk
+// offsets, data is the whole file
+func progressiveSamples(data []byte, trak *mp4.TrakBox) ([]mp4.FullSample, error) {
+	stbl := trak.Mdia.Minf.Stbl
+	if stbl.Stts == nil || stbl.Stsz == nil || stbl.Stsc == nil {
+		return nil, fmt.Errorf("Incomplete sample table")
+	}
+	chunkOffset := func(chunkNr int) (uint64, error) {
+		if stbl.Co64 != nil {
+			return stbl.Co64.GetOffset(chunkNr)
+		}
+		if stbl.Stco != nil {
+			return stbl.Stco.GetOffset(chunkNr)
+		}
+		return 0, fmt.Errorf("No chunk offsets")
+	}
+
+	count := stbl.Stsz.GetNrSamples()
+	samples := make([]mp4.FullSample, 0, count)
+	for nr := uint32(1); nr <= count; nr++ {
+		chunkNr, firstInChunk, err := stbl.Stsc.ChunkNrFromSampleNr(int(nr))
+		if err != nil {
+			return nil, err
+		}
+		offset, err := chunkOffset(chunkNr)
+		if err != nil {
+			return nil, err
+		}
+		for i := firstInChunk; i < int(nr); i++ {
+			offset += uint64(stbl.Stsz.GetSampleSize(i))
+		}
+		size := uint64(stbl.Stsz.GetSampleSize(int(nr)))
+		if offset+size > uint64(len(data)) {
+			return nil, fmt.Errorf("Sample %d beyond the end of the file", nr)
+		}
+		decodeTime, duration := stbl.Stts.GetDecodeTime(nr)
+		samples = append(samples, mp4.FullSample{
+			Sample:     mp4.Sample{Dur: duration, Size: uint32(size)},
+			DecodeTime: decodeTime,
+			Data:       data[offset : offset+size],
+		})
+	}
+	return samples, nil
+}
+
+// newSample joins the NAL units of an access unit in Annex-B, keyframes get
+// the parameter sets they lack
+func newSample(nalus [][]byte, sps, pps [][]byte, duration time.Duration) Sample {
+	sample := Sample{Duration: duration}
+	var hasSPS, hasPPS bool
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch avc.GetNaluType(nalu[0]) {
+		case avc.NALU_IDR:
+			sample.Keyframe = true
+		case avc.NALU_SPS:
+			hasSPS = true
+		case avc.NALU_PPS:
+			hasPPS = true
+		}
+	}
+	var data []byte
+	if sample.Keyframe && !hasSPS && !hasPPS {
+		for _, nalu := range sps {
+			data = append(append(data, startCode...), nalu...)
+		}
+		for _, nalu := range pps {
+			data = append(append(data, startCode...), nalu...)
+		}
+	}
+	for _, nalu := range nalus {
+		data = append(append(data, startCode...), nalu...)
+	}
+	sample.Data = data
+	return sample
+}
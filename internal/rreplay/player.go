@@ -0,0 +1,86 @@
+package rreplay
+
+import (
+	"image"
+	"sync"
+	"time"
+)
+
+// maxLag is how late a player may fall behind the recording pace before it
+// gives up catching up, a consumer that stalled gets the following samples
+// at the original pace instead of in a burst
+const maxLag = time.Second
+
+// filePlayer paces the samples of a loaded recording
+type filePlayer struct {
+	samples []Sample
+	size    image.Point
+	loop    bool
+
+	out       chan Sample
+	stop      chan struct{}
+	startOnce sync.Once
+	stopOnce  sync.Once
+}
+
+func newFilePlayer(samples []Sample, size image.Point, loop bool) *filePlayer {
+	return &filePlayer{
+		samples: samples,
+		size:    size,
+		loop:    loop,
+		out:     make(chan Sample, 1),
+		stop:    make(chan struct{}),
+	}
+}
+
+func (p *filePlayer) Start() {
+	p.startOnce.Do(func() {
+		go p.run()
+	})
+}
+
+func (p *filePlayer) Samples() <-chan Sample {
+	return p.out
+}
+
+func (p *filePlayer) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+}
+
+func (p *filePlayer) Size() image.Point {
+	return p.size
+}
+
+// run sends every sample when it is due, the schedule is absolute so the
+// pace doesn't drift with the time spent sending
+func (p *filePlayer) run() {
+	defer close(p.out)
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	next := time.Now()
+	for {
+		for _, sample := range p.samples {
+			if wait := time.Until(next); wait > 0 {
+				timer.Reset(wait)
+				select {
+				case <-p.stop:
+					return
+				case <-timer.C:
+				}
+			} else if -wait > maxLag {
+				next = time.Now()
+			}
+			select {
+			case <-p.stop:
+				return
+			case p.out <- sample:
+			}
+			next = next.Add(sample.Duration)
+		}
+		if !p.loop {
+			return
+		}
+	}
+}
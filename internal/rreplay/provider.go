@@ -0,0 +1,89 @@
+package rreplay
+
+import (
+	"fmt"
+	"image"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"oneplay-videostream-browser/internal/rdisplay"
+
+	"github.com/Eyevinn/mp4ff/avc"
+)
+
+// ReplayProvider replays a single recording as screen 0. The recording is
+// loaded in memory once and every player reads it from the start.
+type ReplayProvider struct {
+	path    string
+	samples []Sample
+	size    image.Point
+	loop    bool
+}
+
+// NewReplayProvider loads the H.264 recording at path, an MP4 file or an
+// Annex-B elementary stream. MP4 samples keep their recorded durations,
+// Annex-B streams carry no timing and are played at fps. With loop the
+// recording starts over once it is over.
+func NewReplayProvider(path string, fps int, loop bool) (Service, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []Sample
+	var sps []byte
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp4", ".m4v", ".mov":
+		samples, sps, err = loadMP4(data)
+	default:
+		if fps <= 0 {
+			return nil, fmt.Errorf("Invalid replay frame rate %d", fps)
+		}
+		samples, sps, err = loadAnnexB(data, time.Second/time.Duration(fps))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Can't load %s: %v", path, err)
+	}
+	if len(samples) == 0 || sps == nil {
+		return nil, fmt.Errorf("No H.264 video in %s", path)
+	}
+	if !samples[0].Keyframe {
+		return nil, fmt.Errorf("%s doesn't start with a keyframe", path)
+	}
+
+	parsed, err := avc.ParseSPSNALUnit(sps, false)
+	if err != nil {
+		return nil, err
+	}
+	return &ReplayProvider{
+		path:    path,
+		samples: samples,
+		size:    image.Point{int(parsed.Width), int(parsed.Height)},
+		loop:    loop,
+	}, nil
+}
+
+// Screens returns the recording as the only screen
+func (r *ReplayProvider) Screens() ([]rdisplay.Screen, error) {
+	return []rdisplay.Screen{
+		{
+			Index:  0,
+			Bounds: image.Rectangle{Max: r.size},
+		},
+	}, nil
+}
+
+// CreateScreenGrabber fails, a recording is played with CreatePlayer
+func (r *ReplayProvider) CreateScreenGrabber(screen rdisplay.Screen, fps int, cursor rdisplay.CursorMode, queue int) (rdisplay.ScreenGrabber, error) {
+	return nil, fmt.Errorf("%s is a recording, it can only be replayed", r.path)
+}
+
+// CreatePlayer returns a player starting at the beginning of the recording
+func (r *ReplayProvider) CreatePlayer(screen rdisplay.Screen) (Player, error) {
+	if screen.Index != 0 {
+		return nil, fmt.Errorf("Unknown replay screen %d", screen.Index)
+	}
+	return newFilePlayer(r.samples, r.size, r.loop), nil
+}
@@ -0,0 +1,33 @@
+package rreplay
+
+import (
+	"image"
+	"time"
+
+	"oneplay-videostream-browser/internal/rdisplay"
+)
+
+// Sample is an H.264 access unit in Annex-B, keyframes carry their
+// parameter sets so a viewer can start decoding at any of them
+type Sample struct {
+	Data     []byte
+	Duration time.Duration
+	Keyframe bool
+}
+
+// Player plays a recording at its original pace
+type Player interface {
+	Start()
+	Samples() <-chan Sample
+	Stop()
+	// Size is the size of the recorded video
+	Size() image.Point
+}
+
+// Service is an rdisplay.Service whose screens are recordings. They are
+// already encoded, so instead of being grabbed and encoded they are played
+// with CreatePlayer and their samples go to the peers untouched.
+type Service interface {
+	rdisplay.Service
+	CreatePlayer(screen rdisplay.Screen) (Player, error)
+}
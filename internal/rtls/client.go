@@ -0,0 +1,107 @@
+package rtls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// spkiPinPrefix marks the pins of a public key rather than a certificate
+const spkiPinPrefix = "sha256/"
+
+// pin is the SHA-256 of a certificate or of its public key
+type pin struct {
+	spki bool
+	hash []byte
+}
+
+// ClientConfig verifies servers against the CAs of caFile, the system ones
+// when it is empty. Pins restrict the accepted servers further: one of the
+// certificates of the verified chain must match one of them. A pin is
+// either the SHA-256 fingerprint of a certificate in hex, colons allowed,
+// or sha256/ followed by the base64 SHA-256 of a public key.
+func ClientConfig(caFile string, pins []string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if caFile != "" {
+		bundle, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("No certificate in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	var parsed []pin
+	for _, p := range pins {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		pin, err := parsePin(p)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, pin)
+	}
+	if len(parsed) > 0 {
+		config.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			for _, chain := range chains {
+				for _, cert := range chain {
+					if matches(parsed, cert) {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("Server certificate doesn't match the pinned ones")
+		}
+	}
+	return config, nil
+}
+
+func parsePin(s string) (pin, error) {
+	if strings.HasPrefix(s, spkiPinPrefix) {
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, spkiPinPrefix))
+		if err != nil || len(hash) != sha256.Size {
+			return pin{}, fmt.Errorf("Invalid public key pin %q", s)
+		}
+		return pin{spki: true, hash: hash}, nil
+	}
+	hash, err := hex.DecodeString(strings.Replace(s, ":", "", -1))
+	if err != nil || len(hash) != sha256.Size {
+		return pin{}, fmt.Errorf("Invalid certificate pin %q", s)
+	}
+	return pin{hash: hash}, nil
+}
+
+func matches(pins []pin, cert *x509.Certificate) bool {
+	certHash := sha256.Sum256(cert.Raw)
+	spkiHash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, p := range pins {
+		if p.spki && bytes.Equal(p.hash, spkiHash[:]) {
+			return true
+		}
+		if !p.spki && bytes.Equal(p.hash, certHash[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a DER certificate, as
+// browsers show it and as ClientConfig takes it
+func Fingerprint(der []byte) string {
+	hash := sha256.Sum256(der)
+	parts := make([]string, len(hash))
+	for i, b := range hash {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,136 @@
+package rtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newCertificate(t *testing.T) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "signaling.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func spkiPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return spkiPinPrefix + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func TestPinMatching(t *testing.T) {
+	cert := newCertificate(t)
+	other := newCertificate(t)
+
+	tests := []struct {
+		name  string
+		pins  []string
+		match bool
+	}{
+		{"certificate fingerprint", []string{Fingerprint(cert.Raw)}, true},
+		{"lowercase fingerprint without colons", []string{strings.ToLower(strings.Replace(Fingerprint(cert.Raw), ":", "", -1))}, true},
+		{"public key", []string{spkiPin(cert)}, true},
+		{"one of several", []string{Fingerprint(other.Raw), spkiPin(cert)}, true},
+		{"other certificate", []string{Fingerprint(other.Raw)}, false},
+		{"other public key", []string{spkiPin(other)}, false},
+		// The hash of the certificate isn't the hash of its key
+		{"fingerprint as a key pin", []string{spkiPinPrefix + base64.StdEncoding.EncodeToString(sha256Sum(cert.Raw))}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var pins []pin
+			for _, s := range test.pins {
+				p, err := parsePin(s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				pins = append(pins, p)
+			}
+			if got := matches(pins, cert); got != test.match {
+				t.Errorf("matches = %v, want %v", got, test.match)
+			}
+		})
+	}
+}
+
+func TestInvalidPins(t *testing.T) {
+	tests := []struct {
+		name string
+		pin  string
+	}{
+		{"not hex", "zz:11"},
+		{"short fingerprint", "AB:CD:EF"},
+		{"not base64", spkiPinPrefix + "!!!"},
+		{"short key hash", spkiPinPrefix + base64.StdEncoding.EncodeToString([]byte("short"))},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ClientConfig("", []string{test.pin}); err == nil {
+				t.Errorf("pin %q accepted", test.pin)
+			}
+		})
+	}
+}
+
+func TestVerifyPeerCertificate(t *testing.T) {
+	cert := newCertificate(t)
+	other := newCertificate(t)
+
+	tests := []struct {
+		name   string
+		pins   []string
+		chains [][]*x509.Certificate
+		ok     bool
+	}{
+		{"leaf pinned", []string{Fingerprint(cert.Raw)}, [][]*x509.Certificate{{cert}}, true},
+		{"root pinned", []string{spkiPin(other)}, [][]*x509.Certificate{{cert, other}}, true},
+		{"nothing pinned in the chain", []string{spkiPin(other)}, [][]*x509.Certificate{{cert}}, false},
+		{"no chain", []string{spkiPin(cert)}, nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := ClientConfig("", test.pins)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = config.VerifyPeerCertificate(nil, test.chains)
+			if test.ok && err != nil {
+				t.Errorf("rejected: %v", err)
+			}
+			if !test.ok && err == nil {
+				t.Error("accepted")
+			}
+		})
+	}
+}
+
+func sha256Sum(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
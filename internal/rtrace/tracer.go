@@ -0,0 +1,92 @@
+package rtrace
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentation names the tracer of the agent components
+const instrumentation = "oneplay-videostream-browser"
+
+// Config sets up the export of the spans
+type Config struct {
+	// Endpoint of the OTLP/HTTP collector, host:port or a URL with the
+	// path of the traces. Spans go nowhere when it is empty.
+	Endpoint string
+	// Insecure sends the spans over plain HTTP, http:// endpoints always do
+	Insecure bool
+	// Service names the agent in the traces
+	Service string
+	// Ratio of the traces sampled, from 0 to 1
+	Ratio float64
+}
+
+// Setup installs the global tracer provider exporting to config.Endpoint.
+// The returned function flushes the pending spans and stops the exporter.
+// Without an endpoint the no-op provider of OpenTelemetry stays in place.
+func Setup(config Config) (func(context.Context) error, error) {
+	if config.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	options := []otlptracehttp.Option{}
+	if target, err := url.Parse(config.Endpoint); err == nil && target.Host != "" {
+		if target.Scheme != "http" && target.Scheme != "https" {
+			return nil, fmt.Errorf("Unsupported trace endpoint scheme %q", target.Scheme)
+		}
+		options = append(options, otlptracehttp.WithEndpoint(target.Host))
+		if target.Path != "" {
+			options = append(options, otlptracehttp.WithURLPath(target.Path))
+		}
+		if target.Scheme == "http" {
+			config.Insecure = true
+		}
+	} else {
+		options = append(options, otlptracehttp.WithEndpoint(config.Endpoint))
+	}
+	if config.Insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	// The exporter connects lazily, an unreachable collector only shows
+	// when spans are exported
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	service, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceNameKey.String(config.Service),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(service),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.Ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer of the agent, a no-op one until Setup is
+// given an endpoint
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentation)
+}
+
+// Fail records err on span and marks the span as failed
+func Fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,199 @@
+package rtc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"oneplay-videostream-browser/internal/encoders"
+	"oneplay-videostream-browser/internal/raudio"
+	"oneplay-videostream-browser/internal/rlog"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// audioFrameDuration is the duration of every raudio frame
+const audioFrameDuration = time.Second * raudio.FrameSamples / raudio.SampleRate
+
+// acquireAudio returns the shared audio feed, starting the capture if no
+// other viewer is listening. Every acquireAudio must be paired with a
+// releaseAudio.
+func (h *captureHub) acquireAudio() (*audioFeed, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.audio != nil {
+		h.audio.refs++
+		return h.audio, nil
+	}
+	if h.audioService == nil {
+		return nil, fmt.Errorf("Audio capture disabled")
+	}
+
+	source, err := h.audioService.CreateAudioSource()
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := h.encService.NewAudioEncoder(encoders.OpusCodec, raudio.SampleRate, raudio.Channels)
+	if err != nil {
+		source.Stop()
+		return nil, err
+	}
+	h.audio = newAudioFeed(source, encoder, h.log)
+	h.audio.hub = h
+	h.audio.refs = 1
+	return h.audio, nil
+}
+
+func (h *captureHub) releaseAudio(feed *audioFeed) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	feed.refs--
+	if feed.refs > 0 {
+		return
+	}
+	if h.audio == feed {
+		h.audio = nil
+	}
+	feed.close()
+}
+
+// evictAudio forgets feed once its capture ended, the next viewer gets a
+// new one while the viewers of feed still release it
+func (h *captureHub) evictAudio(feed *audioFeed) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.audio == feed {
+		h.audio = nil
+	}
+}
+
+// audioFeed captures and encodes the host audio once and fans the Opus
+// packets out to every subscribed viewer
+type audioFeed struct {
+	source  raudio.AudioSource
+	encoder encoders.AudioEncoder
+	// refs is guarded by captureHub.mu
+	refs int
+	// hub is evicted from when the capture fails
+	hub *captureHub
+
+	mu    sync.Mutex
+	sinks map[sampleSink]struct{}
+
+	startOnce sync.Once
+	stop      chan struct{}
+	log       *rlog.Logger
+}
+
+func newAudioFeed(source raudio.AudioSource, encoder encoders.AudioEncoder, log *rlog.Logger) *audioFeed {
+	return &audioFeed{
+		source:  source,
+		encoder: encoder,
+		log:     log,
+		sinks:   make(map[sampleSink]struct{}),
+		stop:    make(chan struct{}),
+	}
+}
+
+func (f *audioFeed) subscribe(sink sampleSink) {
+	f.mu.Lock()
+	f.sinks[sink] = struct{}{}
+	f.mu.Unlock()
+
+	f.startOnce.Do(func() {
+		if err := f.source.Start(); err != nil {
+			f.log.Warnf("Audio: %v", err)
+			f.encoder.Close()
+			f.hub.evictAudio(f)
+			return
+		}
+		go f.run()
+	})
+}
+
+func (f *audioFeed) unsubscribe(sink sampleSink) {
+	f.mu.Lock()
+	delete(f.sinks, sink)
+	f.mu.Unlock()
+}
+
+// run encodes the captured frames. Audio timestamps advance by the exact
+// frame duration while video ones follow the capture clock, both tracks
+// share a stream id and the RTCP sender reports map them to the same wall
+// clock so the browser can keep them in sync.
+func (f *audioFeed) run() {
+	defer f.encoder.Close()
+	frames := f.source.Frames()
+	for {
+		select {
+		case <-f.stop:
+			f.source.Stop()
+			return
+		case frame, ok := <-frames:
+			if !ok {
+				// The capture gave up on its own
+				f.log.Warnf("Audio capture ended")
+				f.source.Stop()
+				f.hub.evictAudio(f)
+				return
+			}
+			payload, err := f.encoder.Encode(frame)
+			if err != nil {
+				f.log.Warnf("Audio: %v", err)
+				continue
+			}
+			f.broadcast(media.Sample{
+				Data:     payload,
+				Duration: audioFrameDuration,
+			})
+		}
+	}
+}
+
+func (f *audioFeed) broadcast(sample media.Sample) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for sink := range f.sinks {
+		if err := sink.WriteSample(sample); err != nil {
+			f.log.Warnf("Audio: %v", err)
+		}
+	}
+}
+
+func (f *audioFeed) close() {
+	close(f.stop)
+	f.startOnce.Do(func() {
+		f.encoder.Close()
+	})
+}
+
+// audioStreamer subscribes a peer's audio track to the shared audio feed
+type audioStreamer struct {
+	track     *webrtc.TrackLocalStaticSample
+	hub       *captureHub
+	feed      *audioFeed
+	closeOnce sync.Once
+}
+
+func newAudioStreamer(track *webrtc.TrackLocalStaticSample, hub *captureHub, feed *audioFeed) *audioStreamer {
+	return &audioStreamer{
+		track: track,
+		hub:   hub,
+		feed:  feed,
+	}
+}
+
+func (s *audioStreamer) start() {
+	s.feed.subscribe(s.track)
+}
+
+func (s *audioStreamer) close() {
+	s.closeOnce.Do(func() {
+		s.feed.unsubscribe(s.track)
+		s.hub.releaseAudio(s.feed)
+	})
+}
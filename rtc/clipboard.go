@@ -0,0 +1,166 @@
+package rtc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"oneplay-videostream-browser/internal/rclipboard"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	clipboardChannelLabel = "clipboard"
+	// clipboardMaxSize bounds the content synced in either direction, it
+	// stays below the X server maximum request size
+	clipboardMaxSize = 128 << 10
+	// clipboardChunkSize keeps every message well under the SCTP message
+	// size limit once base64 encoded
+	clipboardChunkSize = 32 << 10
+)
+
+// clipboardMessage carries a chunk of clipboard content, Last marks the
+// final chunk of a copy
+//
+//	{"type":"clipboard","mime":"text/plain","data":"aGVsbG8=","last":true}
+type clipboardMessage struct {
+	Type    string `json:"type"`
+	Mime    string `json:"mime,omitempty"`
+	Data    string `json:"data,omitempty"`
+	Last    bool   `json:"last,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// clipboardSync keeps the viewer and host clipboards in sync over the
+// "clipboard" data channel. Only controllers may read or change the host
+// clipboard.
+type clipboardSync struct {
+	channel  *webrtc.DataChannel
+	peer     *RemoteScreenPeerConn
+	service  rclipboard.Service
+	pending  bytes.Buffer
+	pendMime string
+
+	mu        sync.Mutex
+	clipboard rclipboard.Clipboard
+}
+
+func newClipboardSync(channel *webrtc.DataChannel, peer *RemoteScreenPeerConn, service rclipboard.Service) *clipboardSync {
+	return &clipboardSync{
+		channel: channel,
+		peer:    peer,
+		service: service,
+	}
+}
+
+func (c *clipboardSync) attach() {
+	c.channel.OnOpen(func() {
+		clipboard, err := c.service.CreateClipboard(clipboardMaxSize)
+		if err != nil {
+			c.peer.log.Warnf("Clipboard: %v", err)
+			return
+		}
+		c.mu.Lock()
+		c.clipboard = clipboard
+		c.mu.Unlock()
+		go c.forward(clipboard)
+	})
+	c.channel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if err := c.receive(msg.Data); err != nil {
+			c.peer.log.Warnf("Clipboard: %v", err)
+			c.send(clipboardMessage{Type: "error", Message: err.Error()})
+		}
+	})
+	c.channel.OnClose(func() {
+		c.close()
+	})
+}
+
+// forward sends whatever is copied on the host to the viewer, as long as
+// it controls the host. What is copied while it only watches stays there.
+func (c *clipboardSync) forward(clipboard rclipboard.Clipboard) {
+	for content := range clipboard.Changes() {
+		if c.peer.Role() != RoleController {
+			continue
+		}
+		for offset := 0; offset < len(content.Data) || offset == 0; offset += clipboardChunkSize {
+			end := offset + clipboardChunkSize
+			if end > len(content.Data) {
+				end = len(content.Data)
+			}
+			err := c.send(clipboardMessage{
+				Type: "clipboard",
+				Mime: content.MimeType,
+				Data: base64.StdEncoding.EncodeToString(content.Data[offset:end]),
+				Last: end == len(content.Data),
+			})
+			if err != nil {
+				c.peer.log.Warnf("Clipboard: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// receive assembles the chunks sent by the viewer, OnMessage callbacks of a
+// channel are never run concurrently
+func (c *clipboardSync) receive(data []byte) error {
+	var msg clipboardMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	if msg.Type != "clipboard" {
+		return fmt.Errorf("Unknown clipboard message %s", msg.Type)
+	}
+	if c.peer.Role() != RoleController {
+		return fmt.Errorf("Only the controller can set the host clipboard")
+	}
+	chunk, err := base64.StdEncoding.DecodeString(msg.Data)
+	if err != nil {
+		return err
+	}
+	if c.pending.Len() == 0 {
+		c.pendMime = msg.Mime
+	}
+	if c.pending.Len()+len(chunk) > clipboardMaxSize {
+		c.pending.Reset()
+		return fmt.Errorf("Clipboard content exceeds %d bytes", clipboardMaxSize)
+	}
+	c.pending.Write(chunk)
+	if !msg.Last {
+		return nil
+	}
+
+	content := rclipboard.Content{
+		MimeType: c.pendMime,
+		Data:     append([]byte(nil), c.pending.Bytes()...),
+	}
+	c.pending.Reset()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.clipboard == nil {
+		return nil
+	}
+	return c.clipboard.Set(content)
+}
+
+func (c *clipboardSync) send(msg clipboardMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.channel.SendText(string(payload))
+}
+
+func (c *clipboardSync) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.clipboard != nil {
+		c.clipboard.Close()
+		c.clipboard = nil
+	}
+}
@@ -1,31 +1,84 @@
 package rtc
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"image"
-	"log"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"oneplay-videostream-browser/internal/encoders"
+	"oneplay-videostream-browser/internal/raudio"
+	"oneplay-videostream-browser/internal/rclipboard"
 	"oneplay-videostream-browser/internal/rdisplay"
-
-	"github.com/gorilla/websocket"
+	"oneplay-videostream-browser/internal/rgamepad"
+	"oneplay-videostream-browser/internal/rinput"
+	"oneplay-videostream-browser/internal/rlog"
+	"oneplay-videostream-browser/internal/rrecord"
+	"oneplay-videostream-browser/internal/rtrace"
+
+	"github.com/google/uuid"
+	"github.com/pion/interceptor"
 	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // RemoteScreenPeerConn is a webrtc.PeerConnection wrapper that implements the
 // PeerConnection interface
 type RemoteScreenPeerConn struct {
+	// role and iceState are accessed atomically
+	role       int32
+	iceState   int32
+	id         string
+	started    time.Time
 	connection *webrtc.PeerConnection
 	stunServer string
 	track      *webrtc.TrackLocalStaticSample
+	audioTrack *webrtc.TrackLocalStaticSample
 	streamer   videoStreamer
-	grabber    rdisplay.ScreenGrabber
+	audio      *audioStreamer
+	screen     rdisplay.Screen
+	fps        int
+	opts       SessionOptions
+	hub        *captureHub
+	feed       *captureFeed
 	encService encoders.Service
+	inputSvc   rinput.Service
+	input      *inputHandler
+	clipSvc    rclipboard.Service
+	clipboard  *clipboardSync
+	padSvc     rgamepad.Service
+	padSlots   *gamepadSlots
+	pads       GamepadConfig
+	gamepads   *gamepadForwarder
+	latency    *latencyProbe
+	transport  *transportStats
+	sampler    *statsSampler
+	files      FileTransferConfig
+	transfer   *fileTransfer
+	arbiter    *controlArbiter
+	watchers   *watchers
+	// log has the session, screen and peer fields
+	log *rlog.Logger
+	// connect spans the ICE and DTLS handshakes, it ends once the peer
+	// connection is connected, failed or closed
+	connect trace.Span
+
+	// mu guards what ProcessOffer and the data channels set while the
+	// session is already registered, and read by the API and metrics
+	mu sync.Mutex
+	// closed is set by close, data channels opened after it are refused
+	closed bool
+
+	recordMu sync.Mutex
+	recorder *sessionRecorder
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
 func codecsFromMediaDescription(m *sdp.MediaDescription) (out []webrtc.RTPCodecParameters, err error) {
@@ -65,8 +118,14 @@ func codecsFromMediaDescription(m *sdp.MediaDescription) (out []webrtc.RTPCodecP
 		}
 
 		out = append(out, webrtc.RTPCodecParameters{
-			RTPCodecCapability: webrtc.RTPCodecCapability{m.MediaName.Media + "/" + codec.Name, codec.ClockRate, channels, codec.Fmtp, feedback},
-			PayloadType:        webrtc.PayloadType(payloadType),
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     m.MediaName.Media + "/" + codec.Name,
+				ClockRate:    codec.ClockRate,
+				Channels:     channels,
+				SDPFmtpLine:  codec.Fmtp,
+				RTCPFeedback: feedback,
+			},
+			PayloadType: webrtc.PayloadType(payloadType),
 		})
 	}
 
@@ -112,17 +171,32 @@ func codecsFromMediaDescription(m *sdp.MediaDescription) (out []webrtc.RTPCodecP
 // 	}
 // }
 
-func newRemoteScreenPeerConn(stunServer string, grabber rdisplay.ScreenGrabber, encService encoders.Service) *RemoteScreenPeerConn {
+func newRemoteScreenPeerConn(stunServer string, screen rdisplay.Screen, fps int, opts SessionOptions, hub *captureHub, encService encoders.Service, inputSvc rinput.Service, arbiter *controlArbiter, log *rlog.Logger) *RemoteScreenPeerConn {
+	id := uuid.New().String()
+	peer := opts.Viewer
+	if peer == "" {
+		peer = "anonymous"
+	}
 	return &RemoteScreenPeerConn{
+		id:         id,
+		role:       int32(RoleViewer),
+		iceState:   int32(webrtc.ICEConnectionStateNew),
+		started:    time.Now(),
 		stunServer: stunServer,
-		grabber:    grabber,
+		screen:     screen,
+		fps:        fps,
+		opts:       opts,
+		hub:        hub,
 		encService: encService,
+		inputSvc:   inputSvc,
+		arbiter:    arbiter,
+		log:        log.With(rlog.F("session", id), rlog.F("screen", screen.Index), rlog.F("peer", peer)),
 	}
 }
 
-func getTrackDirection(sdp *sdp.SessionDescription) webrtc.RTPTransceiverDirection {
+func getTrackDirection(sdp *sdp.SessionDescription, kind string) webrtc.RTPTransceiverDirection {
 	for _, mediaDesc := range sdp.MediaDescriptions {
-		if mediaDesc.MediaName.Media == "video" {
+		if mediaDesc.MediaName.Media == kind {
 			if _, recvOnly := mediaDesc.Attribute("recvonly"); recvOnly {
 				return webrtc.RTPTransceiverDirectionRecvonly
 			} else if _, sendRecv := mediaDesc.Attribute("sendrecv"); sendRecv {
@@ -134,31 +208,51 @@ func getTrackDirection(sdp *sdp.SessionDescription) webrtc.RTPTransceiverDirecti
 }
 
 type iceResponse struct {
-	WSType string
-	ICE    webrtc.ICECandidateInit
+	WSType  string
+	Session string
+	ICE     webrtc.ICECandidateInit
 }
 
 // var flag bool
 
 type newSessionResponse struct {
-	WSType string
-	Answer string
+	WSType  string
+	Answer  string
+	Session string
+	Role    string
 }
 
 // var isWaiting bool
 
-// ProcessOffer handles the SDP offer coming from the client,
-// return the SDP answer that must be passed back to stablish the WebRTC
-// connection.
-func (p *RemoteScreenPeerConn) ProcessOffer(strOffer string, conn *websocket.Conn, messageType int) {
+// ProcessOffer handles the SDP offer coming from the client and returns the
+// SDP answer. With a signal the answer and then the local ICE candidates are
+// sent through it, without one ICE gathering is awaited and the answer
+// carries every candidate. The caller closes the session on error.
+func (p *RemoteScreenPeerConn) ProcessOffer(ctx context.Context, strOffer string, signal Signal) (answerSDP string, err error) {
+	ctx, span := rtrace.Tracer().Start(ctx, "ProcessOffer", trace.WithAttributes(
+		attribute.String("session", p.id),
+		attribute.Int("screen", p.screen.Index),
+	))
+	defer func() {
+		if err != nil {
+			rtrace.Fail(span, err)
+		}
+		span.End()
+	}()
+
 	// flag = false
-	fmt.Println("session to offer : ", strOffer)
+	p.log.Debugf("Offer: %s", strOffer)
+	_, parseSpan := rtrace.Tracer().Start(ctx, "sdp.parse")
 	sdp := sdp.SessionDescription{}
 	strOfferByte := make([]byte, len(strOffer))
 	copy(strOfferByte, strOffer)
-	err := sdp.Unmarshal(strOfferByte)
+	err = sdp.Unmarshal(strOfferByte)
 	if err != nil {
-		panic(err)
+		rtrace.Fail(parseSpan, err)
+	}
+	parseSpan.End()
+	if err != nil {
+		return "", err
 	}
 
 	// webrtcCodec, encCodec, err := findBestCodec(&sdp, p.encService, "42e01f")
@@ -167,6 +261,7 @@ func (p *RemoteScreenPeerConn) ProcessOffer(strOffer string, conn *websocket.Con
 	// }
 	encCodec := encoders.H264Codec
 	mediaEngine := webrtc.MediaEngine{}
+	_, codecSpan := rtrace.Tracer().Start(ctx, "codec.select")
 
 	var cParameter webrtc.RTPCodecParameters
 	for _, md := range sdp.MediaDescriptions {
@@ -178,21 +273,32 @@ func (p *RemoteScreenPeerConn) ProcessOffer(strOffer string, conn *websocket.Con
 			if codecParameters[i].MimeType == webrtc.MimeTypeH264 {
 				fmtp := strings.Contains(codecParameters[i].SDPFmtpLine, fmt.Sprintf("profile-level-id=%s", "42e01f"))
 				packet := strings.Contains(codecParameters[i].SDPFmtpLine, "packetization-mode=1")
-				fmt.Println(codecParameters[i])
+				p.log.Debugf("Offered H.264 codec %d: %s", codecParameters[i].PayloadType, codecParameters[i].SDPFmtpLine)
 				if fmtp && packet {
 					cParameter = codecParameters[i]
 					err := mediaEngine.RegisterCodec(codecParameters[i], webrtc.RTPCodecTypeVideo)
 					if err != nil {
-						panic(err)
+						codecSpan.End()
+						return "", err
 					}
 				}
 			}
 		}
 	}
 
+	if cParameter.MimeType == "" {
+		codecSpan.AddEvent("No H.264 codec with profile 42e01f and packetization mode 1 offered")
+	} else {
+		codecSpan.SetAttributes(
+			attribute.String("codec", cParameter.MimeType),
+			attribute.Int("payload_type", int(cParameter.PayloadType)),
+		)
+	}
+	codecSpan.End()
+
 	err = mediaEngine.RegisterDefaultCodecs()
 	if err != nil {
-		log.Fatal(err)
+		p.log.Fatalf("Can't register the codecs: %v", err)
 	}
 
 	// mediaEngine.RegisterCodec(webrtcCodec)
@@ -201,7 +307,24 @@ func (p *RemoteScreenPeerConn) ProcessOffer(strOffer string, conn *websocket.Con
 	// 	log.Fatal(err)
 	// }
 
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(&mediaEngine))
+	// The default interceptors answer NACKs and send the RTCP sender reports
+	// browsers need to synchronize the audio and video tracks
+	interceptors := &interceptor.Registry{}
+	if err = webrtc.RegisterDefaultInterceptors(&mediaEngine, interceptors); err != nil {
+		p.log.Fatalf("Can't register the interceptors: %v", err)
+	}
+	if err = registerPlayoutDelay(&mediaEngine, interceptors, settingsForProfile(p.opts.Latency)); err != nil {
+		p.log.Fatalf("Can't register the playout delay: %v", err)
+	}
+	p.mu.Lock()
+	p.latency = newLatencyProbe(p.log)
+	p.transport = newTransportStats()
+	p.sampler = newStatsSampler(p)
+	p.mu.Unlock()
+	interceptors.Add(p.latency)
+	interceptors.Add(p.transport)
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(&mediaEngine), webrtc.WithInterceptorRegistry(interceptors))
 
 	pcconf := webrtc.Configuration{
 		ICEServers: []webrtc.ICEServer{
@@ -216,15 +339,74 @@ func (p *RemoteScreenPeerConn) ProcessOffer(strOffer string, conn *websocket.Con
 
 	peerConn, err := api.NewPeerConnection(pcconf)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
+	_, p.connect = rtrace.Tracer().Start(ctx, "webrtc.connect", trace.WithAttributes(
+		attribute.String("session", p.id),
+	))
+	peerConn.OnICEGatheringStateChange(func(state webrtc.ICEGathererState) {
+		p.connect.AddEvent("ice.gathering." + state.String())
+	})
+	peerConn.SCTP().Transport().OnStateChange(func(state webrtc.DTLSTransportState) {
+		p.connect.AddEvent("dtls." + state.String())
+	})
+	peerConn.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateFailed:
+			rtrace.Fail(p.connect, fmt.Errorf("Peer connection failed"))
+			p.connect.End()
+		case webrtc.PeerConnectionStateConnected, webrtc.PeerConnectionStateClosed:
+			p.connect.SetAttributes(attribute.String("state", state.String()))
+			p.connect.End()
+		}
+	})
+
 	peerConn.OnDataChannel(func(d *webrtc.DataChannel) {
-		fmt.Printf("New DataChannel %s %d\n", d.Label(), d.ID())
+		p.log.Debugf("Data channel %s opened by the viewer", d.Label())
+
+		if d.Label() == cursorChannelLabel {
+			newCursorForwarder(d, p).attach()
+			return
+		}
+
+		if d.Label() == inputChannelLabel && p.inputSvc != nil {
+			p.attachChannel(d, func() {
+				p.input = newInputHandler(d, p, p.inputSvc)
+				p.input.attach()
+			})
+			return
+		}
+
+		if d.Label() == clipboardChannelLabel && p.clipSvc != nil {
+			p.attachChannel(d, func() {
+				p.clipboard = newClipboardSync(d, p, p.clipSvc)
+				p.clipboard.attach()
+			})
+			return
+		}
+
+		if d.Label() == latencyChannelLabel && p.latency != nil {
+			p.latency.attach(d)
+			return
+		}
+
+		if d.Label() == statsChannelLabel && p.sampler != nil {
+			p.sampler.attach(d)
+			return
+		}
+
+		if d.Label() == gamepadChannelLabel && p.padSvc != nil {
+			p.attachChannel(d, func() {
+				p.gamepads = newGamepadForwarder(d, p, p.padSvc, p.padSlots, p.pads)
+				p.gamepads.attach()
+			})
+			return
+		}
 
 		// Register channel opening handling
 		d.OnOpen(func() {
-			fmt.Printf("Data channel '%s'-'%d' open. Random messages will now be sent to any connected DataChannels every 5 seconds\n", d.Label(), d.ID())
+			p.log.Debugf("Data channel %s open, it has no handler", d.Label())
 
 			// for range time.NewTicker(5 * time.Second).C {
 
@@ -240,13 +422,30 @@ func (p *RemoteScreenPeerConn) ProcessOffer(strOffer string, conn *websocket.Con
 
 		// Register text message handling
 		d.OnMessage(func(msg webrtc.DataChannelMessage) {
-			fmt.Printf("Message from DataChannel '%s': '%s'\n", d.Label(), string(msg.Data))
+			p.log.Debugf("Ignored %d bytes on data channel %s", len(msg.Data), d.Label())
 		})
 	})
 
+	p.mu.Lock()
 	p.connection = peerConn
+	p.mu.Unlock()
+
+	// The file channel is opened by the agent so viewers find it ready
+	// alongside the video track
+	if p.files.Dir != "" {
+		fileChannel, err := peerConn.CreateDataChannel(fileChannelLabel, nil)
+		if err != nil {
+			p.log.Warnf("File transfer disabled: %v", err)
+		} else {
+			p.attachChannel(fileChannel, func() {
+				p.transfer = newFileTransfer(fileChannel, p, p.files)
+				p.transfer.attach()
+			})
+		}
+	}
 
-	var payloads [][]byte
+	var candidatesMu sync.Mutex
+	var candidates []webrtc.ICECandidateInit
 
 	peerConn.OnICECandidate(func(c *webrtc.ICECandidate) {
 
@@ -254,32 +453,24 @@ func (p *RemoteScreenPeerConn) ProcessOffer(strOffer string, conn *websocket.Con
 			return
 		}
 
-		msg := iceResponse{
-			WSType: "ICE",
-			ICE:    c.ToJSON(),
-		}
-
-		payload, err := json.Marshal(msg)
-		if err != nil {
-			log.Fatal(err)
-			return
-		}
-
-		payloads = append(payloads, payload)
-		if err = peerConn.AddICECandidate(c.ToJSON()); err != nil {
-			panic(err)
+		candidatesMu.Lock()
+		candidates = append(candidates, c.ToJSON())
+		candidatesMu.Unlock()
+		if err := peerConn.AddICECandidate(c.ToJSON()); err != nil {
+			p.log.Warnf("Can't add the local ICE candidate: %v", err)
 		}
 	})
 
 	peerConn.OnICEConnectionStateChange(func(connState webrtc.ICEConnectionState) {
+		atomic.StoreInt32(&p.iceState, int32(connState))
+		p.connect.AddEvent("ice." + connState.String())
 		if connState == webrtc.ICEConnectionStateConnected {
 			p.start()
 		}
 		if connState == webrtc.ICEConnectionStateDisconnected {
 			p.Close()
 		}
-		fmt.Println(connState)
-		log.Printf("Connection state: %s \n", connState.String())
+		p.log.Infof("Connection state: %s", connState.String())
 		//p.start()
 	})
 	// outputTracks := map[string]*webrtc.TrackLocalStaticRTP{}
@@ -293,27 +484,30 @@ func (p *RemoteScreenPeerConn) ProcessOffer(strOffer string, conn *websocket.Con
 	outputTrack, err := webrtc.NewTrackLocalStaticSample(cParameter.RTPCodecCapability, "video_q", "pion_q")
 	// outputTrack, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video_q", "pion_q")
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
-	direction := getTrackDirection(&sdp)
+	sender, err := addOutputTrack(peerConn, outputTrack, getTrackDirection(&sdp, "video"))
+	if err != nil {
+		return "", fmt.Errorf("Can't add the video track: %v", err)
+	}
 
-	if direction == webrtc.RTPTransceiverDirectionSendrecv {
-		fmt.Println("In Send and Recv")
-		if _, err = peerConn.AddTrack(outputTrack); err != nil {
-			panic(err)
+	audioDirection := getTrackDirection(&sdp, "audio")
+	if p.hub.audioService != nil && audioDirection != webrtc.RTPTransceiverDirectionInactive {
+		// Same stream id as the video so the browser synchronizes them
+		audioTrack, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+			MimeType:  webrtc.MimeTypeOpus,
+			ClockRate: raudio.SampleRate,
+			Channels:  raudio.Channels,
+		}, "audio_q", "pion_q")
+		if err == nil {
+			_, err = addOutputTrack(peerConn, audioTrack, audioDirection)
 		}
-	} else if direction == webrtc.RTPTransceiverDirectionRecvonly {
-		fmt.Println("In Recv")
-		_, err = peerConn.AddTransceiverFromTrack(outputTrack, webrtc.RtpTransceiverInit{
-			Direction: webrtc.RTPTransceiverDirectionSendonly,
-		})
-		if err != nil {
-			fmt.Println("Add Track Error")
+		if err == nil {
+			p.audioTrack = audioTrack
+		} else {
+			p.log.Warnf("Audio disabled: %v", err)
 		}
-	} else {
-		fmt.Printf("Unsupported transceiver direction")
-		return
 	}
 
 	offerSdp := webrtc.SessionDescription{
@@ -322,102 +516,407 @@ func (p *RemoteScreenPeerConn) ProcessOffer(strOffer string, conn *websocket.Con
 	}
 	err = peerConn.SetRemoteDescription(offerSdp)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
 	p.track = outputTrack
+	p.latency.track = outputTrack
 
 	answer, err := peerConn.CreateAnswer(nil)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
-	screen := p.grabber.Screen()
-	sourceSize := image.Point{
-		screen.Bounds.Dx(),
-		screen.Bounds.Dy(),
-	}
-
-	fmt.Println("------------------------ : ", encCodec)
-	encoder, err := p.encService.NewEncoder(encCodec, sourceSize, p.grabber.Fps())
+	feed, err := p.hub.acquire(ctx, p.screen, captureKey{
+		screen:  p.screen.Index,
+		fps:     p.fps,
+		cursor:  p.opts.Cursor,
+		codec:   encCodec,
+		profile: p.opts.Latency,
+		marker:  p.opts.LatencyMarker,
+	})
 	if err != nil {
-		return
+		return "", fmt.Errorf("Can't capture the screen: %v", err)
 	}
+	p.log.Infof("Streaming %dx%d at %d fps", feed.size.X, feed.size.Y, p.fps)
 
-	size, err := encoder.VideoSize()
-	if err != nil {
-		return
+	streamer := newRTCStreamer(p.latency, sender, p.hub, feed)
+	var audioStream *audioStreamer
+	if p.audioTrack != nil {
+		audio, err := p.hub.acquireAudio()
+		if err != nil {
+			p.log.Warnf("Audio disabled: %v", err)
+		} else {
+			audioStream = newAudioStreamer(p.audioTrack, p.hub, audio)
+		}
 	}
-
-	fmt.Println(p.grabber, encoder, size)
-
-	p.streamer = newRTCStreamer(p.track, &p.grabber, &encoder, size)
-
+	p.mu.Lock()
+	p.feed = feed
+	p.streamer = streamer
+	p.audio = audioStream
+	p.mu.Unlock()
+
+	// Gathering starts with the local description
+	gathered := webrtc.GatheringCompletePromise(peerConn)
 	err = peerConn.SetLocalDescription(answer)
 	if err != nil {
-		return
+		return "", err
 	}
 
-	resAnswer := answer.SDP
-	if err != nil {
-		log.Fatal(err)
-		return
+	if signal == nil {
+		select {
+		case <-gathered:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		answerSDP = peerConn.LocalDescription().SDP
+		p.log.Debugf("Answer: %s", answerSDP)
+		return answerSDP, nil
 	}
 
-	payload, err := json.Marshal(newSessionResponse{
-		WSType: "SDP",
-		Answer: resAnswer,
+	answerSDP = answer.SDP
+	p.log.Debugf("Answer: %s", answerSDP)
+	err = signal(newSessionResponse{
+		WSType:  "SDP",
+		Answer:  answerSDP,
+		Session: p.id,
+		Role:    p.Role().String(),
 	})
 	if err != nil {
-		log.Fatal(err)
-		return
-	}
-
-	fmt.Println("Before sending to client")
-	if err := conn.WriteMessage(messageType, payload); err != nil {
-		panic(err)
+		return "", err
 	}
 
 	time.Sleep(2 * time.Second)
-	for i := 0; i < len(payloads); i++ {
-		fmt.Println("ICE :", string(payloads[i]))
-		if err = conn.WriteMessage(messageType, payloads[i]); err != nil {
-			panic(err)
+	candidatesMu.Lock()
+	defer candidatesMu.Unlock()
+	for _, candidate := range candidates {
+		p.log.Debugf("Local ICE candidate: %s", candidate.Candidate)
+		if err = signal(iceResponse{WSType: "ICE", Session: p.id, ICE: candidate}); err != nil {
+			return "", err
 		}
 	}
+	return answerSDP, nil
 }
 
-func (p *RemoteScreenPeerConn) ProcessICE(ICE webrtc.ICECandidateInit) {
+// ProcessICE adds a remote ICE candidate, a candidate the connection
+// refuses is an error of the viewer and leaves the session as it is
+func (p *RemoteScreenPeerConn) ProcessICE(ctx context.Context, ICE webrtc.ICECandidateInit) error {
+	_, span := rtrace.Tracer().Start(ctx, "ProcessICE", trace.WithAttributes(
+		attribute.String("session", p.id),
+		attribute.String("candidate_type", candidateType(ICE.Candidate)),
+	))
+	defer span.End()
+
 	// var candidate webrtc.ICECandidateInit
 	// if err := json.Unmarshal(ICE, &candidate); err != nil {
 	// 	log.Fatal(err)
 	// 	return
 	// }
-	fmt.Println("------------START----ICECANDIDATE------START------------------")
-	fmt.Println("ICE : ", ICE)
-	if ICE.Candidate != "" {
-		if err := p.connection.AddICECandidate(ICE); err != nil {
-			fmt.Println("Error occurred when add client ICE candidate")
-			panic(err)
-		} else {
-			fmt.Println("ICE added successfully")
+	p.log.Debugf("Remote ICE candidate: %s", ICE.Candidate)
+	if ICE.Candidate == "" {
+		return nil
+	}
+	connection := p.peerConnection()
+	if connection == nil {
+		err := fmt.Errorf("Session %s has no offer yet", p.id)
+		rtrace.Fail(span, err)
+		return err
+	}
+	if err := connection.AddICECandidate(ICE); err != nil {
+		err = fmt.Errorf("Can't add the remote ICE candidate: %v", err)
+		rtrace.Fail(span, err)
+		return err
+	}
+	return nil
+}
+
+// candidateType returns the typ of an ICE candidate line, the addresses are
+// left out of the traces
+func candidateType(candidate string) string {
+	fields := strings.Fields(candidate)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "typ" {
+			return fields[i+1]
+		}
+	}
+	return "none"
+}
+
+// addOutputTrack adds a send only track matching the direction the offer
+// asked for
+func addOutputTrack(peerConn *webrtc.PeerConnection, track webrtc.TrackLocal, direction webrtc.RTPTransceiverDirection) (*webrtc.RTPSender, error) {
+	if direction == webrtc.RTPTransceiverDirectionSendrecv {
+		return peerConn.AddTrack(track)
+	} else if direction == webrtc.RTPTransceiverDirectionRecvonly {
+		transceiver, err := peerConn.AddTransceiverFromTrack(track, webrtc.RtpTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionSendonly,
+		})
+		if err != nil {
+			return nil, err
 		}
+		return transceiver.Sender(), nil
+	}
+	return nil, fmt.Errorf("Unsupported transceiver direction")
+}
+
+// attachChannel sets up the handler of a data channel with mu held, so
+// close finds every handler it has to close. Once the session is closed the
+// channel is closed instead.
+func (p *RemoteScreenPeerConn) attachChannel(d *webrtc.DataChannel, attach func()) {
+	p.mu.Lock()
+	closed := p.closed
+	if !closed {
+		attach()
+	}
+	p.mu.Unlock()
+	if closed {
+		p.log.Debugf("Data channel %s opened after the session closed", d.Label())
+		d.Close()
 	}
 }
 
 func (p *RemoteScreenPeerConn) start() {
-	p.streamer.start()
+	p.mu.Lock()
+	streamer, audio, sampler := p.streamer, p.audio, p.sampler
+	p.mu.Unlock()
+	streamer.start()
+	if audio != nil {
+		audio.start()
+	}
+	sampler.start()
+}
+
+// currentFeed returns the screen feed of the session, nil until the offer
+// has been processed
+func (p *RemoteScreenPeerConn) currentFeed() *captureFeed {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.feed
+}
+
+// peerConnection returns the WebRTC connection of the session, nil until
+// the offer has been processed
+func (p *RemoteScreenPeerConn) peerConnection() *webrtc.PeerConnection {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.connection
+}
+
+// ID returns the identifier of the session
+func (p *RemoteScreenPeerConn) ID() string {
+	return p.id
 }
 
-// Close Stops the video streamer and closes the WebRTC peer connection
+// Role returns what the viewer is currently allowed to do
+func (p *RemoteScreenPeerConn) Role() Role {
+	return Role(atomic.LoadInt32(&p.role))
+}
+
+// setRole changes the role of the session, a controller losing control
+// releases whatever it still holds down on the host
+func (p *RemoteScreenPeerConn) setRole(role Role) {
+	previous := Role(atomic.SwapInt32(&p.role, int32(role)))
+	if previous != RoleController || role == RoleController {
+		return
+	}
+	p.mu.Lock()
+	input := p.input
+	p.mu.Unlock()
+	if input != nil {
+		input.release()
+	}
+}
+
+// Stats returns the frame counters of the session, zero until the offer
+// has been processed
+func (p *RemoteScreenPeerConn) Stats() StreamStats {
+	p.mu.Lock()
+	streamer := p.streamer
+	p.mu.Unlock()
+	if streamer == nil {
+		return StreamStats{}
+	}
+	return streamer.stats()
+}
+
+// Latency returns the glass-to-glass latency histograms of the session,
+// empty until the viewer reports rendered frames
+func (p *RemoteScreenPeerConn) Latency() LatencyStats {
+	p.mu.Lock()
+	latency := p.latency
+	p.mu.Unlock()
+	if latency == nil {
+		return LatencyStats{}
+	}
+	return latency.Stats()
+}
+
+// Transport returns the RTP counters of the video stream of the session,
+// zero until the offer has been processed
+func (p *RemoteScreenPeerConn) Transport() TransportStats {
+	p.mu.Lock()
+	transport := p.transport
+	p.mu.Unlock()
+	if transport == nil {
+		return TransportStats{}
+	}
+	return transport.Stats()
+}
+
+// Info describes the session
+func (p *RemoteScreenPeerConn) Info() SessionInfo {
+	info := SessionInfo{
+		ID:      p.id,
+		Viewer:  p.opts.Viewer,
+		Screen:  p.screen.Index,
+		Latency: profileLabel(p.opts.Latency),
+		Role:    p.Role(),
+		Started: p.started,
+		State:   webrtc.ICEConnectionState(atomic.LoadInt32(&p.iceState)).String(),
+	}
+	if feed := p.currentFeed(); feed != nil {
+		info.Codec = codecLabel(feed.key.codec)
+	}
+	return info
+}
+
+// SessionStats returns the last stats sample of the session, zero until the
+// viewer has been connected for statsEvery
+func (p *RemoteScreenPeerConn) SessionStats() SessionStats {
+	p.mu.Lock()
+	sampler := p.sampler
+	p.mu.Unlock()
+	if sampler == nil {
+		return SessionStats{}
+	}
+	return sampler.Stats()
+}
+
+// selectedPair returns the types of the ICE candidates the session sends
+// its media through, found is false until ICE selected a pair
+func (p *RemoteScreenPeerConn) selectedPair() (local string, remote string, protocol string, found bool) {
+	connection := p.peerConnection()
+	if connection == nil {
+		return "", "", "", false
+	}
+	pair, err := connection.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return "", "", "", false
+	}
+	return pair.Local.Typ.String(), pair.Remote.Typ.String(), pair.Local.Protocol.String(), true
+}
+
+// startRecording records the session feeds until stopRecording or Close
+func (p *RemoteScreenPeerConn) startRecording(config rrecord.Config, format rrecord.Format) error {
+	p.recordMu.Lock()
+	defer p.recordMu.Unlock()
+
+	p.mu.Lock()
+	feed, audioStream := p.feed, p.audio
+	p.mu.Unlock()
+	if feed == nil {
+		return fmt.Errorf("Session %s is not streaming yet", p.id)
+	}
+	if p.recorder != nil {
+		return fmt.Errorf("Session %s is already recording", p.id)
+	}
+	var audio *audioFeed
+	if audioStream != nil {
+		audio = audioStream.feed
+	}
+	recorder, err := newSessionRecorder(config, format, p.id, feed, audio, p.log)
+	if err != nil {
+		return err
+	}
+	p.recorder = recorder
+	p.recorder.start()
+	return nil
+}
+
+// stopRecording finishes the recording of the session and returns the
+// files it wrote
+func (p *RemoteScreenPeerConn) stopRecording() ([]string, error) {
+	p.recordMu.Lock()
+	defer p.recordMu.Unlock()
+
+	if p.recorder == nil {
+		return nil, fmt.Errorf("Session %s is not recording", p.id)
+	}
+	files := p.recorder.stop()
+	p.recorder = nil
+	return files, nil
+}
+
+// Close Stops the video streamer and closes the WebRTC peer connection,
+// only the first call does anything
 func (p *RemoteScreenPeerConn) Close() error {
+	p.closeOnce.Do(func() {
+		p.closeErr = p.close()
+	})
+	return p.closeErr
+}
+
+func (p *RemoteScreenPeerConn) close() error {
+
+	// The recorder goes first, it rides on the feeds of the streamers
+	p.recordMu.Lock()
+	if p.recorder != nil {
+		p.recorder.stop()
+		p.recorder = nil
+	}
+	p.recordMu.Unlock()
+
+	p.mu.Lock()
+	p.closed = true
+	streamer, audio, input, clipboard := p.streamer, p.audio, p.input, p.clipboard
+	transfer, gamepads := p.transfer, p.gamepads
+	sampler, latency, connection := p.sampler, p.latency, p.connection
+	p.mu.Unlock()
+
+	if streamer != nil {
+		streamer.close()
+	}
+
+	if audio != nil {
+		audio.close()
+	}
+
+	if input != nil {
+		input.close()
+	}
+
+	if clipboard != nil {
+		clipboard.close()
+	}
+
+	if transfer != nil {
+		transfer.close()
+	}
+
+	if gamepads != nil {
+		gamepads.close()
+	}
+
+	if sampler != nil {
+		sampler.close()
+	}
+
+	if latency != nil {
+		latency.close()
+		if stats := latency.Stats(); stats.Total.Count > 0 {
+			p.log.Infof("Latency over %d frames: capture %v, encode %v, network %v, decode %v, total %v",
+				stats.Total.Count, stats.Capture.Mean(), stats.Encode.Mean(), stats.Network.Mean(), stats.Decode.Mean(), stats.Total.Mean())
+		}
+	}
 
-	if p.streamer != nil {
-		p.streamer.close()
+	p.arbiter.unregister(p)
+	p.log.Infof("Session closed")
+	if p.watchers != nil {
+		p.watchers.leave(p.id)
 	}
 
-	if p.connection != nil {
-		return p.connection.Close()
+	if connection != nil {
+		return connection.Close()
 	}
 	return nil
 }
@@ -1,10 +1,25 @@
 package rtc
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"sync"
 
 	"oneplay-videostream-browser/internal/encoders"
+	"oneplay-videostream-browser/internal/raudio"
+	"oneplay-videostream-browser/internal/rbroadcast"
+	"oneplay-videostream-browser/internal/rclipboard"
+	"oneplay-videostream-browser/internal/rconsent"
 	"oneplay-videostream-browser/internal/rdisplay"
+	"oneplay-videostream-browser/internal/rgamepad"
+	"oneplay-videostream-browser/internal/rhls"
+	"oneplay-videostream-browser/internal/rinput"
+	"oneplay-videostream-browser/internal/rlog"
+	"oneplay-videostream-browser/internal/rmask"
+	"oneplay-videostream-browser/internal/rrecord"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // RemoteScreenService is our implementation of the rtc.Service
@@ -12,15 +27,96 @@ type RemoteScreenService struct {
 	stunServer      string
 	videoService    rdisplay.Service
 	encodingService encoders.Service
+	inputService    rinput.Service
+	clipService     rclipboard.Service
+	gamepadService  rgamepad.Service
+	gamepads        GamepadConfig
+	gamepadSlots    *gamepadSlots
+	files           FileTransferConfig
+	records         rrecord.Config
+	hub             *captureHub
+	arbiter         *controlArbiter
+	approver        rconsent.Approver
+	watchers        *watchers
+	masker          *rmask.Masker
+	metrics         *metricsCollector
+	log             *rlog.Logger
+
+	egressMu sync.Mutex
+	egresses map[string]*egress
+
+	hlsConfig  rhls.Config
+	hlsMu      sync.Mutex
+	hlsOutputs map[int]*hlsOutput
+	// hlsStarting holds the screens whose output is being approved and
+	// started, closed once it is done
+	hlsStarting map[int]chan struct{}
+}
+
+// ServiceConfig holds what a RemoteScreenService is made of. Video and
+// Encoders are required, the other services and settings enable a feature
+// each and turn it off when left zero.
+type ServiceConfig struct {
+	// STUN is the ICE server of the peer connections
+	STUN     string
+	Video    rdisplay.Service
+	Encoders encoders.Service
+	// Audio nil streams video only
+	Audio raudio.Service
+	// Input nil makes every session view-only
+	Input rinput.Service
+	// Clipboard nil disables clipboard sync
+	Clipboard rclipboard.Service
+	// Gamepad nil disables gamepads
+	Gamepad  rgamepad.Service
+	Gamepads GamepadConfig
+	// Files.Dir empty disables file transfers
+	Files FileTransferConfig
+	// Records.Dir empty disables recordings
+	Records rrecord.Config
+	// HLS.SegmentDuration zero disables HLS
+	HLS     rhls.Config
+	Consent ConsentConfig
+	// Masker nil disables privacy masking
+	Masker *rmask.Masker
+	// Log is what every session logs to, with its own fields
+	Log *rlog.Logger
 }
 
 // NewRemoteScreenService creates a new instances of RemoteScreenService
-func NewRemoteScreenService(stun string, video rdisplay.Service, enc encoders.Service) Service {
-	return &RemoteScreenService{
-		stunServer:      stun,
-		videoService:    video,
-		encodingService: enc,
+func NewRemoteScreenService(config ServiceConfig) Service {
+	svc := &RemoteScreenService{
+		stunServer:      config.STUN,
+		videoService:    config.Video,
+		encodingService: config.Encoders,
+		inputService:    config.Input,
+		clipService:     config.Clipboard,
+		gamepadService:  config.Gamepad,
+		gamepads:        config.Gamepads,
+		gamepadSlots:    newGamepadSlots(config.Gamepads.Slots),
+		files:           config.Files,
+		records:         config.Records,
+		hub:             newCaptureHub(config.Video, config.Encoders, config.Audio, config.Masker, config.Log),
+		arbiter:         newControlArbiter(),
+		egresses:        make(map[string]*egress),
+		hlsConfig:       config.HLS,
+		hlsOutputs:      make(map[int]*hlsOutput),
+		hlsStarting:     make(map[int]chan struct{}),
+		approver:        config.Consent.Approver,
+		masker:          config.Masker,
+		log:             config.Log,
+	}
+	if config.Consent.Indicator != nil {
+		svc.watchers = newWatchers(config.Consent.Indicator)
 	}
+	svc.metrics = newMetricsCollector(svc.arbiter, svc.hub)
+	return svc
+}
+
+// Metrics returns the collector of the session metrics and encode times,
+// to register with a Prometheus registry
+func (svc *RemoteScreenService) Metrics() prometheus.Collector {
+	return svc.metrics
 }
 
 func hasElement(haystack []string, needle string) bool {
@@ -33,30 +129,259 @@ func hasElement(haystack []string, needle string) bool {
 }
 
 // CreateRemoteScreenConnection creates and configures a new peer connection
-// that will stream the selected screen
-func (svc *RemoteScreenService) CreateRemoteScreenConnection(screenIx int, fps int) (RemoteScreenConnection, error) {
+// that will stream the selected screen. Viewers of the same screen with the
+// same parameters share a single capture and encode pipeline. The host
+// approver is asked first, ErrNotApproved is returned if it declines.
+func (svc *RemoteScreenService) CreateRemoteScreenConnection(screenIx int, fps int, opts SessionOptions) (RemoteScreenConnection, error) {
 	screens, err := svc.videoService.Screens()
 	if err != nil {
 		return nil, err
 	}
 
-	if screenIx < 0 || screenIx > len(screens) {
+	if len(screens) == 0 {
+		return nil, fmt.Errorf("No available screens")
+	}
+
+	if screenIx < 0 || screenIx >= len(screens) {
 		screenIx = 0
 	}
 	screen := screens[screenIx]
-	screenGrabber, err := svc.videoService.CreateScreenGrabber(screen, fps)
+
+	err = svc.approve(rconsent.Request{
+		Viewer: opts.Viewer,
+		Screen: screen.Index,
+		Role:   opts.Role.String(),
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	rtcPeer := newRemoteScreenPeerConn(svc.stunServer, screen, fps, opts, svc.hub, svc.encodingService, svc.inputService, svc.arbiter, svc.log)
+	if opts.Clipboard {
+		rtcPeer.clipSvc = svc.clipService
+	}
+	if opts.Gamepad {
+		rtcPeer.padSvc = svc.gamepadService
+		rtcPeer.padSlots = svc.gamepadSlots
+		rtcPeer.pads = svc.gamepads
+	}
+	rtcPeer.files = svc.files
+	svc.arbiter.register(rtcPeer, opts.Role)
+	rtcPeer.log.Infof("Session created as %s", rtcPeer.Role())
+	if svc.watchers != nil {
+		rtcPeer.watchers = svc.watchers
+		svc.watchers.join(rtcPeer.id, opts.Viewer)
+	}
+	return rtcPeer, nil
+}
+
+// RequestControl records that a viewer asks for control, it returns the
+// screen the session is watching so the request can be routed to whoever
+// approves it
+func (svc *RemoteScreenService) RequestControl(session string) (int, error) {
+	peer, err := svc.arbiter.request(session)
+	if err != nil {
+		return 0, err
+	}
+	return peer.screen.Index, nil
+}
+
+// GrantControl makes the session the controller of its screen, the previous
+// controller becomes a viewer
+func (svc *RemoteScreenService) GrantControl(session string) ([]RoleChange, error) {
+	return svc.arbiter.grant(session)
+}
+
+// DenyControl rejects a pending control request
+func (svc *RemoteScreenService) DenyControl(session string) error {
+	return svc.arbiter.deny(session)
+}
+
+// RevokeControl turns the session back into a viewer
+func (svc *RemoteScreenService) RevokeControl(session string) ([]RoleChange, error) {
+	return svc.arbiter.revoke(session)
+}
+
+// StartRecording records the session to a new file of the recordings
+// directory
+func (svc *RemoteScreenService) StartRecording(session string, format rrecord.Format) error {
+	if svc.records.Dir == "" {
+		return fmt.Errorf("Recording disabled")
+	}
+	peer, err := svc.arbiter.lookup(session)
+	if err != nil {
+		return err
+	}
+	return peer.startRecording(svc.records, format)
+}
+
+// Sessions lists the open sessions, oldest first
+func (svc *RemoteScreenService) Sessions() []SessionInfo {
+	peers := svc.arbiter.all()
+	sessions := make([]SessionInfo, len(peers))
+	for i, peer := range peers {
+		sessions[i] = peer.Info()
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Started.Before(sessions[j].Started)
+	})
+	return sessions
+}
+
+// Session describes an open session, ErrUnknownSession if there is none
+func (svc *RemoteScreenService) Session(session string) (SessionInfo, error) {
+	peer, err := svc.arbiter.lookup(session)
+	if err != nil {
+		return SessionInfo{}, err
+	}
+	return peer.Info(), nil
+}
+
+// CloseSession closes the session, its streamers and its peer connection,
+// the viewer sees the connection go away
+func (svc *RemoteScreenService) CloseSession(session string) error {
+	peer, err := svc.arbiter.lookup(session)
+	if err != nil {
+		return err
+	}
+	peer.log.Infof("Closing the session on request")
+	return peer.Close()
+}
+
+// SessionStats returns the last stats sample of the session, they are
+// sampled every second once the viewer is connected
+func (svc *RemoteScreenService) SessionStats(session string) (SessionStats, error) {
+	peer, err := svc.arbiter.lookup(session)
+	if err != nil {
+		return SessionStats{}, err
+	}
+	return peer.SessionStats(), nil
+}
+
+// StopRecording finishes the recording of the session, it returns the names
+// of the files written since StartRecording
+func (svc *RemoteScreenService) StopRecording(session string) ([]string, error) {
+	peer, err := svc.arbiter.lookup(session)
 	if err != nil {
 		return nil, err
 	}
+	return peer.stopRecording()
+}
 
-	if len(screens) == 0 {
-		return nil, fmt.Errorf("No available screens")
+// Recordings lists the recordings of every session, newest first
+func (svc *RemoteScreenService) Recordings() ([]rrecord.Recording, error) {
+	if svc.records.Dir == "" {
+		return nil, fmt.Errorf("Recording disabled")
 	}
+	return rrecord.List(svc.records.Dir)
+}
 
-	rtcPeer := newRemoteScreenPeerConn(svc.stunServer, screenGrabber, svc.encodingService)
-	return rtcPeer, nil
+// RecordingPath returns the path of a recording to download it
+func (svc *RemoteScreenService) RecordingPath(name string) (string, error) {
+	if svc.records.Dir == "" {
+		return "", fmt.Errorf("Recording disabled")
+	}
+	return rrecord.Path(svc.records.Dir, name)
+}
+
+// StartEgress publishes the screen to an RTMP or SRT target, it returns the
+// id of the egress. The screen is encoded with the quality profile and the
+// pointer drawn in, an egress shares the encoder with the viewers asking for
+// the same. fps goes from 1 to maxEgressFps.
+func (svc *RemoteScreenService) StartEgress(screenIx int, fps int, target string) (string, error) {
+	if fps <= 0 || fps > maxEgressFps {
+		return "", fmt.Errorf("Invalid egress frame rate %d, expected 1 to %d", fps, maxEgressFps)
+	}
+	if !svc.encodingService.Supports(encoders.H264Codec) {
+		return "", fmt.Errorf("Egress needs the H.264 encoder")
+	}
+	screens, err := svc.videoService.Screens()
+	if err != nil {
+		return "", err
+	}
+	if screenIx < 0 || screenIx >= len(screens) {
+		return "", fmt.Errorf("No screen %d", screenIx)
+	}
+	screen := screens[screenIx]
+	viewer := "Broadcast to " + rbroadcast.Redact(target)
+	err = svc.approve(rconsent.Request{
+		Viewer: viewer,
+		Screen: screen.Index,
+		Role:   RoleViewer.String(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	publisher, err := rbroadcast.Dial(target)
+	if err != nil {
+		return "", err
+	}
+	feed, err := svc.hub.acquire(context.Background(), screen, captureKey{
+		screen:  screen.Index,
+		fps:     fps,
+		cursor:  rdisplay.CursorComposite,
+		codec:   encoders.H264Codec,
+		profile: encoders.QualityProfile,
+	})
+	if err != nil {
+		publisher.Close()
+		return "", err
+	}
+
+	e := newEgress(screen.Index, target, svc.hub, feed, publisher, svc.log)
+	if svc.watchers != nil {
+		e.watchers = svc.watchers
+		svc.watchers.join(e.id, viewer)
+	}
+	svc.egressMu.Lock()
+	svc.egresses[e.id] = e
+	svc.egressMu.Unlock()
+	e.start()
+	e.log.Infof("Publishing to %s", e.target)
+	return e.id, nil
+}
+
+// StopEgress stops publishing, it also discards an egress that failed
+func (svc *RemoteScreenService) StopEgress(id string) error {
+	svc.egressMu.Lock()
+	e, found := svc.egresses[id]
+	delete(svc.egresses, id)
+	svc.egressMu.Unlock()
+	if !found {
+		return fmt.Errorf("Unknown egress %s", id)
+	}
+	e.close()
+	return nil
+}
+
+// Egresses lists the running and failed egresses, oldest first
+func (svc *RemoteScreenService) Egresses() []EgressInfo {
+	svc.egressMu.Lock()
+	infos := make([]EgressInfo, 0, len(svc.egresses))
+	for _, e := range svc.egresses {
+		infos = append(infos, e.info())
+	}
+	svc.egressMu.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Started.Before(infos[j].Started)
+	})
+	return infos
+}
+
+// MaskRules returns the privacy masking rules
+func (svc *RemoteScreenService) MaskRules() ([]rmask.Rule, error) {
+	if svc.masker == nil {
+		return nil, fmt.Errorf("Masking disabled")
+	}
+	return svc.masker.Rules(), nil
+}
+
+// SetMaskRules replaces the privacy masking rules, every running capture
+// applies them from its next frame
+func (svc *RemoteScreenService) SetMaskRules(rules []rmask.Rule) error {
+	if svc.masker == nil {
+		return fmt.Errorf("Masking disabled")
+	}
+	return svc.masker.SetRules(rules)
 }
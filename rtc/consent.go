@@ -0,0 +1,87 @@
+package rtc
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"oneplay-videostream-browser/internal/rconsent"
+	"oneplay-videostream-browser/internal/rlog"
+)
+
+// ErrNotApproved is returned by CreateRemoteScreenConnection, HLSHandler and
+// StartEgress when the host declined the viewer
+var ErrNotApproved = errors.New("Viewer not approved by the host")
+
+// ConsentConfig is how the host agrees to be watched
+type ConsentConfig struct {
+	// Approver is asked before a session starts capturing, nil accepts
+	// every viewer
+	Approver rconsent.Approver
+	// Indicator shows who is watching, nil shows nothing
+	Indicator rconsent.Indicator
+}
+
+// approve asks the host whether req may start capturing, ErrNotApproved
+// when it declines. Every output of a screen goes through it, viewers as
+// well as HLS and egresses.
+func (svc *RemoteScreenService) approve(req rconsent.Request) error {
+	if svc.approver == nil {
+		return nil
+	}
+	approved, err := svc.approver.Approve(req)
+	// An approver that can't ask the host fails closed
+	if err != nil {
+		svc.log.With(rlog.F("screen", req.Screen), rlog.F("peer", req.Viewer)).Errorf("Approval failed: %v", err)
+	}
+	if err != nil || !approved {
+		return ErrNotApproved
+	}
+	return nil
+}
+
+// watchers keeps the indicator in sync with the sessions
+type watchers struct {
+	indicator rconsent.Indicator
+
+	mu       sync.Mutex
+	sessions map[string]string
+}
+
+func newWatchers(indicator rconsent.Indicator) *watchers {
+	return &watchers{
+		indicator: indicator,
+		sessions:  make(map[string]string),
+	}
+}
+
+func (w *watchers) join(session string, viewer string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.sessions[session] = viewer
+	w.update()
+}
+
+func (w *watchers) leave(session string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, found := w.sessions[session]; !found {
+		return
+	}
+	delete(w.sessions, session)
+	w.update()
+}
+
+// update lists every viewer once, sorted so the indicator doesn't reshuffle
+func (w *watchers) update() {
+	seen := make(map[string]bool)
+	viewers := []string{}
+	for _, viewer := range w.sessions {
+		if !seen[viewer] {
+			seen[viewer] = true
+			viewers = append(viewers, viewer)
+		}
+	}
+	sort.Strings(viewers)
+	w.indicator.Watching(viewers)
+}
@@ -0,0 +1,183 @@
+package rtc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownSession is returned for a session that isn't open
+var ErrUnknownSession = errors.New("Unknown session")
+
+// Role is what a viewer is allowed to do in a session
+type Role int32
+
+const (
+	// RoleViewer can only watch, its input events are dropped
+	RoleViewer Role = iota
+	// RoleController drives the host with mouse and keyboard
+	RoleController
+)
+
+// ParseRole maps the signaling/API names to a Role, unknown values fall back
+// to RoleViewer
+func ParseRole(role string) Role {
+	if strings.ToLower(role) == "controller" {
+		return RoleController
+	}
+	return RoleViewer
+}
+
+func (r Role) String() string {
+	if r == RoleController {
+		return "controller"
+	}
+	return "viewer"
+}
+
+// RoleChange tells a session its role changed, the caller is expected to
+// notify the viewer through signaling
+type RoleChange struct {
+	Session string
+	Role    Role
+}
+
+// controlArbiter makes sure at most one session controls each screen and
+// keeps the control requests waiting for approval
+type controlArbiter struct {
+	mu          sync.Mutex
+	sessions    map[string]*RemoteScreenPeerConn
+	controllers map[int]*RemoteScreenPeerConn
+	pending     map[string]struct{}
+}
+
+func newControlArbiter() *controlArbiter {
+	return &controlArbiter{
+		sessions:    make(map[string]*RemoteScreenPeerConn),
+		controllers: make(map[int]*RemoteScreenPeerConn),
+		pending:     make(map[string]struct{}),
+	}
+}
+
+// register tracks a new session, a session asking to start as controller
+// only gets the role if nobody controls its screen yet
+func (a *controlArbiter) register(peer *RemoteScreenPeerConn, role Role) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.sessions[peer.id] = peer
+	if role == RoleController {
+		if _, taken := a.controllers[peer.screen.Index]; !taken {
+			a.controllers[peer.screen.Index] = peer
+			peer.setRole(RoleController)
+		}
+	}
+}
+
+func (a *controlArbiter) unregister(peer *RemoteScreenPeerConn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.sessions, peer.id)
+	delete(a.pending, peer.id)
+	if a.controllers[peer.screen.Index] == peer {
+		delete(a.controllers, peer.screen.Index)
+	}
+}
+
+// lookup returns the registered session, ErrUnknownSession if there is none
+func (a *controlArbiter) lookup(session string) (*RemoteScreenPeerConn, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	peer, found := a.sessions[session]
+	if !found {
+		return nil, ErrUnknownSession
+	}
+	return peer, nil
+}
+
+// all returns the registered sessions
+func (a *controlArbiter) all() []*RemoteScreenPeerConn {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	peers := make([]*RemoteScreenPeerConn, 0, len(a.sessions))
+	for _, peer := range a.sessions {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func (a *controlArbiter) request(session string) (*RemoteScreenPeerConn, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	peer, found := a.sessions[session]
+	if !found {
+		return nil, fmt.Errorf("Unknown session %s", session)
+	}
+	if peer.Role() != RoleController {
+		a.pending[session] = struct{}{}
+	}
+	return peer, nil
+}
+
+// grant hands control of the session's screen over to it, demoting the
+// current controller if there is one. Only a session that requested control
+// can be granted it.
+func (a *controlArbiter) grant(session string) ([]RoleChange, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	peer, found := a.sessions[session]
+	if !found {
+		return nil, fmt.Errorf("Unknown session %s", session)
+	}
+	if _, found := a.pending[session]; !found {
+		return nil, fmt.Errorf("No pending control request for session %s", session)
+	}
+	delete(a.pending, session)
+
+	var changes []RoleChange
+	if current, found := a.controllers[peer.screen.Index]; found {
+		if current == peer {
+			return nil, nil
+		}
+		current.setRole(RoleViewer)
+		changes = append(changes, RoleChange{Session: current.id, Role: RoleViewer})
+	}
+	a.controllers[peer.screen.Index] = peer
+	peer.setRole(RoleController)
+	return append(changes, RoleChange{Session: peer.id, Role: RoleController}), nil
+}
+
+// deny drops a pending control request
+func (a *controlArbiter) deny(session string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, found := a.pending[session]; !found {
+		return fmt.Errorf("No pending control request for session %s", session)
+	}
+	delete(a.pending, session)
+	return nil
+}
+
+// revoke turns a controller back into a viewer
+func (a *controlArbiter) revoke(session string) ([]RoleChange, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	peer, found := a.sessions[session]
+	if !found {
+		return nil, fmt.Errorf("Unknown session %s", session)
+	}
+	if a.controllers[peer.screen.Index] != peer {
+		return nil, nil
+	}
+	delete(a.controllers, peer.screen.Index)
+	peer.setRole(RoleViewer)
+	return []RoleChange{{Session: peer.id, Role: RoleViewer}}, nil
+}
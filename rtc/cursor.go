@@ -0,0 +1,129 @@
+package rtc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image/png"
+
+	"oneplay-videostream-browser/internal/rdisplay"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const cursorChannelLabel = "cursor"
+
+type cursorPositionMessage struct {
+	Type string  `json:"type"`
+	X    float64 `json:"x"`
+	Y    float64 `json:"y"`
+}
+
+type cursorShapeMessage struct {
+	Type         string `json:"type"`
+	Serial       uint32 `json:"serial"`
+	HotX         int    `json:"hotX"`
+	HotY         int    `json:"hotY"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	ScreenWidth  int    `json:"screenWidth"`
+	ScreenHeight int    `json:"screenHeight"`
+	PNG          string `json:"png"`
+}
+
+// cursorForwarder sends pointer updates of a session created with
+// rdisplay.CursorSeparate over the "cursor" data channel. Positions are
+// normalized to the screen size so the viewer can map them onto the video
+// element whatever size the stream was scaled to.
+type cursorForwarder struct {
+	channel *webrtc.DataChannel
+	peer    *RemoteScreenPeerConn
+	closed  chan struct{}
+}
+
+func newCursorForwarder(channel *webrtc.DataChannel, peer *RemoteScreenPeerConn) *cursorForwarder {
+	return &cursorForwarder{
+		channel: channel,
+		peer:    peer,
+		closed:  make(chan struct{}),
+	}
+}
+
+func (f *cursorForwarder) attach() {
+	f.channel.OnOpen(func() {
+		go f.forward()
+	})
+	f.channel.OnClose(func() {
+		close(f.closed)
+	})
+}
+
+func (f *cursorForwarder) forward() {
+	feed := f.peer.currentFeed()
+	if feed == nil {
+		return
+	}
+	updates, cancel := feed.subscribeCursor()
+	defer cancel()
+
+	var lastSerial uint32
+	shapeSent := false
+	for {
+		select {
+		case <-f.closed:
+			return
+		case cursor, ok := <-updates:
+			if !ok {
+				return
+			}
+			if !shapeSent || cursor.Serial != lastSerial {
+				if err := f.sendShape(cursor); err != nil {
+					f.peer.log.Warnf("Cursor: %v", err)
+					return
+				}
+				lastSerial = cursor.Serial
+				shapeSent = true
+			}
+			if err := f.sendPosition(cursor); err != nil {
+				f.peer.log.Warnf("Cursor: %v", err)
+				return
+			}
+		}
+	}
+}
+
+func (f *cursorForwarder) sendShape(cursor *rdisplay.Cursor) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, cursor.Image); err != nil {
+		return err
+	}
+	bounds := f.peer.screen.Bounds
+	return f.send(cursorShapeMessage{
+		Type:         "shape",
+		Serial:       cursor.Serial,
+		HotX:         cursor.Hotspot.X,
+		HotY:         cursor.Hotspot.Y,
+		Width:        cursor.Image.Bounds().Dx(),
+		Height:       cursor.Image.Bounds().Dy(),
+		ScreenWidth:  bounds.Dx(),
+		ScreenHeight: bounds.Dy(),
+		PNG:          base64.StdEncoding.EncodeToString(buf.Bytes()),
+	})
+}
+
+func (f *cursorForwarder) sendPosition(cursor *rdisplay.Cursor) error {
+	bounds := f.peer.screen.Bounds
+	return f.send(cursorPositionMessage{
+		Type: "position",
+		X:    float64(cursor.Position.X) / float64(bounds.Dx()),
+		Y:    float64(cursor.Position.Y) / float64(bounds.Dy()),
+	})
+}
+
+func (f *cursorForwarder) send(msg interface{}) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return f.channel.SendText(string(payload))
+}
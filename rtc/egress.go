@@ -0,0 +1,183 @@
+package rtc
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"oneplay-videostream-browser/internal/encoders"
+	"oneplay-videostream-browser/internal/rbroadcast"
+	"oneplay-videostream-browser/internal/rlog"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+const (
+	// maxEgressFps is the highest frame rate an egress can publish at
+	maxEgressFps = 60
+	// egressQueue is the number of frames an egress buffers while the
+	// network is slow, about a second of video
+	egressQueue = 60
+)
+
+// EgressInfo describes a screen published to a streaming platform, Target
+// has its stream key and secrets redacted. Err is set once publishing
+// failed, the egress stays listed until it is stopped.
+type EgressInfo struct {
+	ID      string
+	Screen  int
+	Target  string
+	Started time.Time
+	Sent    uint64
+	Dropped uint64
+	Err     error
+}
+
+// egressFrame is a queued frame and its time since the egress started
+type egressFrame struct {
+	data []byte
+	pts  time.Duration
+}
+
+// egress publishes the output of a capture feed. It subscribes to the feed
+// like one more viewer, a queue keeps a slow network from holding back the
+// viewers sharing the feed.
+type egress struct {
+	// accessed atomically, kept first for 64-bit alignment on 32-bit platforms
+	sent    uint64
+	dropped uint64
+
+	id        string
+	screen    int
+	target    string
+	started   time.Time
+	hub       *captureHub
+	feed      *captureFeed
+	publisher rbroadcast.Publisher
+	frames    chan egressFrame
+	watchers  *watchers
+	log       *rlog.Logger
+	// pts and resync are only used by WriteSample, the feed writes one
+	// sample at a time
+	pts    time.Duration
+	resync bool
+
+	mu   sync.Mutex
+	err  error
+	stop chan struct{}
+	once sync.Once
+	done chan struct{}
+}
+
+func newEgress(screen int, target string, hub *captureHub, feed *captureFeed, publisher rbroadcast.Publisher, log *rlog.Logger) *egress {
+	id := uuid.New().String()
+	return &egress{
+		id:        id,
+		screen:    screen,
+		target:    rbroadcast.Redact(target),
+		log:       log.With(rlog.F("egress", id), rlog.F("screen", screen)),
+		started:   time.Now(),
+		hub:       hub,
+		feed:      feed,
+		publisher: publisher,
+		frames:    make(chan egressFrame, egressQueue),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+func (e *egress) start() {
+	go e.run()
+	e.feed.subscribe(e)
+}
+
+// WriteSample queues the sample without blocking the feed. Once the queue
+// overflows the frames are dropped up to the next keyframe, the frames
+// after a gap can't be decoded without it.
+func (e *egress) WriteSample(sample media.Sample) error {
+	pts := e.pts
+	e.pts += sample.Duration
+	if e.resync {
+		if !encoders.SplitAccessUnit(sample.Data).StartsStream() {
+			atomic.AddUint64(&e.dropped, 1)
+			return nil
+		}
+		e.resync = false
+	}
+	select {
+	case e.frames <- egressFrame{data: sample.Data, pts: pts}:
+	default:
+		atomic.AddUint64(&e.dropped, 1)
+		e.resync = true
+		e.feed.requestKeyframe()
+	}
+	return nil
+}
+
+func (e *egress) run() {
+	defer close(e.done)
+	for {
+		select {
+		case <-e.stop:
+			return
+		case frame := <-e.frames:
+			if err := e.publisher.WriteVideo(frame.data, frame.pts); err != nil {
+				e.log.Errorf("Publishing to %s failed: %v", e.target, err)
+				e.fail(err)
+				return
+			}
+			atomic.AddUint64(&e.sent, 1)
+		}
+	}
+}
+
+// feedEnded fails the egress, the screen it publishes can't be captured
+// anymore
+func (e *egress) feedEnded(err error) {
+	e.log.Errorf("Publishing to %s stopped: %v", e.target, err)
+	e.fail(err)
+}
+
+// fail stops publishing after an error, the capture is released right away
+// but the egress is kept for its error to be reported
+func (e *egress) fail(err error) {
+	e.mu.Lock()
+	e.err = err
+	e.mu.Unlock()
+	e.release()
+}
+
+func (e *egress) release() {
+	e.once.Do(func() {
+		e.feed.unsubscribe(e)
+		e.hub.release(e.feed)
+		if err := e.publisher.Close(); err != nil {
+			e.log.Warnf("Closing %s: %v", e.target, err)
+		}
+		if e.watchers != nil {
+			e.watchers.leave(e.id)
+		}
+	})
+}
+
+func (e *egress) close() {
+	e.feed.unsubscribe(e)
+	close(e.stop)
+	<-e.done
+	e.release()
+}
+
+func (e *egress) info() EgressInfo {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return EgressInfo{
+		ID:      e.id,
+		Screen:  e.screen,
+		Target:  e.target,
+		Started: e.started,
+		Sent:    atomic.LoadUint64(&e.sent),
+		Dropped: atomic.LoadUint64(&e.dropped),
+		Err:     e.err,
+	}
+}
@@ -0,0 +1,417 @@
+package rtc
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	fileChannelLabel = "file"
+	// fileChunkSize keeps every message well under the SCTP message size
+	// limit once base64 encoded
+	fileChunkSize = 16 << 10
+	// fileProgressEvery is how many bytes are transferred between progress
+	// messages
+	fileProgressEvery = 1 << 20
+	// fileBufferHigh pauses downloads until the channel drains below
+	// fileBufferLow
+	fileBufferHigh = 4 << 20
+	fileBufferLow  = 1 << 20
+	// fileNameTries is how many "name (n).ext" variants an upload tries
+	// when its name is taken
+	fileNameTries = 100
+)
+
+// FileTransferConfig is the file transfer policy of the agent, transfers are
+// disabled when Dir is empty
+type FileTransferConfig struct {
+	// Dir is where uploads land and downloads are served from
+	Dir string
+	// MaxSize is the largest file accepted, in bytes
+	MaxSize int64
+}
+
+var transferIDPattern = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+
+// fileMessage is the control and data message of the "file" channel. An
+// upload starts with an "upload" message, the agent answers "ready" with the
+// offset to resume from and the viewer sends "chunk" messages from there. A
+// download starts with a "download" message, the agent answers "meta" and
+// streams "chunk" messages from the requested offset. Both directions report
+// "progress" and end with "complete" or "error". An upload completes with
+// the name it landed under, "report (1).pdf" if report.pdf was there already.
+// Dotfiles and partial uploads can't be transferred.
+//
+//	{"type":"upload","id":"7f1c","name":"report.pdf","size":1024,"sha256":"..."}
+//	{"type":"ready","id":"7f1c","offset":0}
+//	{"type":"chunk","id":"7f1c","offset":0,"data":"..."}
+//	{"type":"progress","id":"7f1c","offset":1024}
+//	{"type":"complete","id":"7f1c","sha256":"..."}
+//	{"type":"download","id":"8a2d","name":"report.pdf","offset":0}
+//	{"type":"meta","id":"8a2d","name":"report.pdf","size":1024,"sha256":"..."}
+type fileMessage struct {
+	Type    string `json:"type"`
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+	Offset  int64  `json:"offset"`
+	Data    string `json:"data,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type upload struct {
+	name     string
+	size     int64
+	checksum string
+	file     *os.File
+	received int64
+	reported int64
+}
+
+// fileTransfer serves the "file" data channel of a session. Only the
+// controller of the screen may transfer files.
+type fileTransfer struct {
+	channel *webrtc.DataChannel
+	peer    *RemoteScreenPeerConn
+	config  FileTransferConfig
+	drained chan struct{}
+
+	// mu guards uploads and closed
+	mu      sync.Mutex
+	uploads map[string]*upload
+	closed  bool
+}
+
+func newFileTransfer(channel *webrtc.DataChannel, peer *RemoteScreenPeerConn, config FileTransferConfig) *fileTransfer {
+	return &fileTransfer{
+		channel: channel,
+		peer:    peer,
+		config:  config,
+		uploads: make(map[string]*upload),
+		drained: make(chan struct{}, 1),
+	}
+}
+
+func (t *fileTransfer) attach() {
+	t.channel.SetBufferedAmountLowThreshold(fileBufferLow)
+	t.channel.OnBufferedAmountLow(func() {
+		select {
+		case t.drained <- struct{}{}:
+		default:
+		}
+	})
+	t.channel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var req fileMessage
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			t.peer.log.Warnf("File transfer: %v", err)
+			return
+		}
+		if err := t.handle(&req); err != nil {
+			t.peer.log.Warnf("File transfer: %v", err)
+			t.fail(req.ID, err)
+		}
+	})
+	t.channel.OnClose(func() {
+		t.close()
+	})
+}
+
+func (t *fileTransfer) handle(req *fileMessage) error {
+	if !transferIDPattern.MatchString(req.ID) {
+		return fmt.Errorf("Invalid transfer id")
+	}
+	if t.peer.Role() != RoleController {
+		return fmt.Errorf("Only the controller can transfer files")
+	}
+	switch req.Type {
+	case "upload":
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return t.startUpload(req)
+	case "chunk":
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return t.receiveChunk(req)
+	case "download":
+		go func() {
+			if err := t.download(req); err != nil {
+				t.peer.log.Warnf("File transfer: %v", err)
+				t.fail(req.ID, err)
+			}
+		}()
+		return nil
+	}
+	return fmt.Errorf("Unknown file message %s", req.Type)
+}
+
+// partialPath is where an upload is written until its checksum is verified,
+// keeping it around lets an interrupted upload resume
+func (t *fileTransfer) partialPath(id string) string {
+	return filepath.Join(t.config.Dir, "."+id+".part")
+}
+
+func (t *fileTransfer) startUpload(req *fileMessage) error {
+	if req.Size < 0 || req.Size > t.config.MaxSize {
+		return fmt.Errorf("File exceeds the %d bytes limit", t.config.MaxSize)
+	}
+	name, err := uploadName(req.Name)
+	if err != nil {
+		return err
+	}
+	if current, found := t.uploads[req.ID]; found {
+		current.file.Close()
+		delete(t.uploads, req.ID)
+	}
+
+	file, err := os.OpenFile(t.partialPath(req.ID), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	offset := info.Size()
+	if offset > req.Size {
+		// Leftover of a different file with the same id
+		offset = 0
+		if err = file.Truncate(0); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	t.uploads[req.ID] = &upload{
+		name:     name,
+		size:     req.Size,
+		checksum: strings.ToLower(req.SHA256),
+		file:     file,
+		received: offset,
+		reported: offset,
+	}
+	if offset == req.Size {
+		return t.finishUpload(req.ID)
+	}
+	return t.send(fileMessage{Type: "ready", ID: req.ID, Offset: offset})
+}
+
+func (t *fileTransfer) receiveChunk(req *fileMessage) error {
+	up, found := t.uploads[req.ID]
+	if !found {
+		return fmt.Errorf("Unknown upload %s", req.ID)
+	}
+	if req.Offset != up.received {
+		return fmt.Errorf("Unexpected chunk offset %d, expected %d", req.Offset, up.received)
+	}
+	data, err := base64.StdEncoding.DecodeString(req.Data)
+	if err != nil {
+		return err
+	}
+	if up.received+int64(len(data)) > up.size {
+		return fmt.Errorf("Upload larger than announced")
+	}
+	if _, err = up.file.WriteAt(data, up.received); err != nil {
+		return err
+	}
+	up.received += int64(len(data))
+
+	if up.received == up.size {
+		return t.finishUpload(req.ID)
+	}
+	if up.received-up.reported >= fileProgressEvery {
+		up.reported = up.received
+		return t.send(fileMessage{Type: "progress", ID: req.ID, Offset: up.received, Size: up.size})
+	}
+	return nil
+}
+
+// finishUpload verifies the checksum and moves the file in place, under
+// another name if one with the same name landed already
+func (t *fileTransfer) finishUpload(id string) error {
+	up := t.uploads[id]
+	delete(t.uploads, id)
+	defer up.file.Close()
+
+	if _, err := up.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, up.file); err != nil {
+		return err
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if up.checksum != "" && up.checksum != checksum {
+		os.Remove(t.partialPath(id))
+		return fmt.Errorf("Checksum mismatch")
+	}
+	name, err := landFile(t.config.Dir, t.partialPath(id), up.name)
+	if err != nil {
+		return err
+	}
+	return t.send(fileMessage{Type: "complete", ID: id, Name: name, Size: up.size, SHA256: checksum})
+}
+
+// download streams a file of the landing directory from the requested
+// offset, pausing while the channel buffer is full
+func (t *fileTransfer) download(req *fileMessage) error {
+	path, err := downloadPath(t.config.Dir, req.Name)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", req.Name)
+	}
+	if info.Size() > t.config.MaxSize {
+		return fmt.Errorf("File exceeds the %d bytes limit", t.config.MaxSize)
+	}
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return err
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	err = t.send(fileMessage{Type: "meta", ID: req.ID, Name: info.Name(), Size: info.Size(), SHA256: checksum})
+	if err != nil {
+		return err
+	}
+
+	offset := req.Offset
+	if offset < 0 || offset > info.Size() {
+		offset = 0
+	}
+	reported := offset
+	buf := make([]byte, fileChunkSize)
+	for offset < info.Size() {
+		if t.isClosed() {
+			return nil
+		}
+		for t.channel.BufferedAmount() > fileBufferHigh && !t.isClosed() {
+			<-t.drained
+		}
+		n, err := file.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		err = t.send(fileMessage{
+			Type:   "chunk",
+			ID:     req.ID,
+			Offset: offset,
+			Data:   base64.StdEncoding.EncodeToString(buf[:n]),
+		})
+		if err != nil {
+			return err
+		}
+		offset += int64(n)
+		if offset-reported >= fileProgressEvery {
+			reported = offset
+			t.send(fileMessage{Type: "progress", ID: req.ID, Offset: offset, Size: info.Size()})
+		}
+	}
+	return t.send(fileMessage{Type: "complete", ID: req.ID, Name: info.Name(), Size: info.Size(), SHA256: checksum})
+}
+
+// visibleName reports whether a file of the landing directory may be
+// transferred, dotfiles and the partial uploads stay hidden
+func visibleName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.HasSuffix(name, ".part")
+}
+
+// uploadName returns the name an upload lands under, any directory of name
+// is dropped
+func uploadName(name string) (string, error) {
+	base := filepath.Base(filepath.Clean("/" + name))
+	if base == string(filepath.Separator) || !visibleName(base) {
+		return "", fmt.Errorf("Invalid file name %q", name)
+	}
+	return base, nil
+}
+
+// downloadPath returns the path of the file name of dir, name can't leave
+// dir nor go through hidden files
+func downloadPath(dir string, name string) (string, error) {
+	clean := filepath.Clean("/" + name)
+	for _, element := range strings.Split(clean, string(filepath.Separator))[1:] {
+		if !visibleName(element) {
+			return "", fmt.Errorf("Invalid file name %q", name)
+		}
+	}
+	return filepath.Join(dir, clean), nil
+}
+
+// landFile moves the partial upload to name in dir, or to the first free
+// "name (n).ext" when name is taken, and returns the name it got. Linking
+// fails on an existing file, so two uploads can't land on the same name.
+func landFile(dir string, partial string, name string) (string, error) {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 0; i < fileNameTries; i++ {
+		landed := name
+		if i > 0 {
+			landed = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		}
+		err := os.Link(partial, filepath.Join(dir, landed))
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return landed, os.Remove(partial)
+	}
+	return "", fmt.Errorf("Too many files named %s", name)
+}
+
+func (t *fileTransfer) fail(id string, err error) {
+	t.send(fileMessage{Type: "error", ID: id, Message: err.Error()})
+}
+
+func (t *fileTransfer) send(msg fileMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return t.channel.SendText(string(payload))
+}
+
+func (t *fileTransfer) isClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
+
+// close keeps partial uploads on disk so they can be resumed
+func (t *fileTransfer) close() {
+	t.mu.Lock()
+	t.closed = true
+	for id, up := range t.uploads {
+		up.file.Close()
+		delete(t.uploads, id)
+	}
+	t.mu.Unlock()
+	select {
+	case t.drained <- struct{}{}:
+	default:
+	}
+}
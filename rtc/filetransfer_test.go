@@ -0,0 +1,132 @@
+package rtc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"docs/report.pdf", "report.pdf"},
+		{"../../etc/passwd", "passwd"},
+		{"/absolute/report.pdf", "report.pdf"},
+		{"", ""},
+		{"/", ""},
+		{"..", ""},
+		{".bashrc", ""},
+		{"docs/.ssh", ""},
+		{".7f1c.part", ""},
+		{"report.part", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := uploadName(test.name)
+			if test.want == "" {
+				if err == nil {
+					t.Fatalf("accepted as %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("rejected: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("uploadName(%q) = %q, want %q", test.name, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDownloadPath(t *testing.T) {
+	dir := filepath.Join("srv", "files")
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"report.pdf", filepath.Join(dir, "report.pdf")},
+		{"docs/report.pdf", filepath.Join(dir, "docs", "report.pdf")},
+		{"../../etc/passwd", filepath.Join(dir, "etc", "passwd")},
+		{"", ""},
+		{"docs/..", ""},
+		{".bashrc", ""},
+		{".ssh/id_ed25519", ""},
+		{".7f1c.part", ""},
+		{"docs/report.part", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := downloadPath(dir, test.name)
+			if test.want == "" {
+				if err == nil {
+					t.Fatalf("served %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("rejected: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("downloadPath(%q) = %q, want %q", test.name, got, test.want)
+			}
+		})
+	}
+}
+
+func TestLandFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []string
+		want     string
+	}{
+		{"report.pdf", nil, "report.pdf"},
+		{"report.pdf", []string{"report.pdf"}, "report (1).pdf"},
+		{"report.pdf", []string{"report.pdf", "report (1).pdf"}, "report (2).pdf"},
+		{"notes", []string{"notes"}, "notes (1)"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.want, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "filetransfer")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			for _, name := range test.existing {
+				if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("existing"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			partial := filepath.Join(dir, ".7f1c.part")
+			if err := ioutil.WriteFile(partial, []byte("upload"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := landFile(dir, partial, test.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("landed as %q, want %q", got, test.want)
+			}
+			if data, err := ioutil.ReadFile(filepath.Join(dir, got)); err != nil || string(data) != "upload" {
+				t.Errorf("landed file holds %q, %v", data, err)
+			}
+			for _, name := range test.existing {
+				if data, _ := ioutil.ReadFile(filepath.Join(dir, name)); string(data) != "existing" {
+					t.Errorf("%s overwritten", name)
+				}
+			}
+			if _, err := os.Stat(partial); !os.IsNotExist(err) {
+				t.Errorf("partial upload left behind")
+			}
+		})
+	}
+}
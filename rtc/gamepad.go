@@ -0,0 +1,228 @@
+package rtc
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"oneplay-videostream-browser/internal/rgamepad"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	gamepadChannelLabel = "gamepad"
+	// gamepadsPerViewer matches the number of gamepads browsers expose
+	gamepadsPerViewer = 4
+)
+
+// GamepadConfig is the gamepad policy of the agent
+type GamepadConfig struct {
+	// Slots is how many virtual controllers can be plugged at once, across
+	// every session
+	Slots int
+	// Viewers lets sessions without control play with a gamepad, for local
+	// multiplayer games
+	Viewers bool
+}
+
+// gamepadMessage is a gamepad event of the "gamepad" channel, Index is the
+// Gamepad.index of the browser. State messages follow the standard mapping.
+// The agent answers a connection with the host slot the controller got and
+// forwards the rumble games play.
+//
+//	{"type":"connected","index":0,"id":"Xbox Wireless Controller"}
+//	{"type":"slot","index":0,"slot":1}
+//	{"type":"state","index":0,"buttons":[0,1,0],"axes":[0.1,-0.5,0,0]}
+//	{"type":"disconnected","index":0}
+//	{"type":"rumble","index":0,"strong":0.8,"weak":0.2,"duration":200}
+type gamepadMessage struct {
+	Type     string    `json:"type"`
+	Index    int       `json:"index"`
+	ID       string    `json:"id,omitempty"`
+	Slot     int       `json:"slot"`
+	Buttons  []float64 `json:"buttons,omitempty"`
+	Axes     []float64 `json:"axes,omitempty"`
+	Strong   float64   `json:"strong,omitempty"`
+	Weak     float64   `json:"weak,omitempty"`
+	Duration int64     `json:"duration,omitempty"`
+	Message  string    `json:"message,omitempty"`
+}
+
+// gamepadSlots hands out the host controller slots shared by every session
+type gamepadSlots struct {
+	mu   sync.Mutex
+	used []bool
+}
+
+func newGamepadSlots(count int) *gamepadSlots {
+	if count < 0 {
+		count = 0
+	}
+	return &gamepadSlots{used: make([]bool, count)}
+}
+
+func (s *gamepadSlots) acquire() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for slot, used := range s.used {
+		if !used {
+			s.used[slot] = true
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("All %d gamepad slots are in use", len(s.used))
+}
+
+func (s *gamepadSlots) release(slot int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used[slot] = false
+}
+
+type pluggedGamepad struct {
+	slot    int
+	gamepad rgamepad.Gamepad
+}
+
+// gamepadForwarder plugs a virtual controller on the host for every gamepad
+// the viewer connects on the "gamepad" data channel
+type gamepadForwarder struct {
+	channel *webrtc.DataChannel
+	peer    *RemoteScreenPeerConn
+	service rgamepad.Service
+	slots   *gamepadSlots
+	config  GamepadConfig
+
+	mu      sync.Mutex
+	plugged map[int]*pluggedGamepad
+	closed  bool
+}
+
+func newGamepadForwarder(channel *webrtc.DataChannel, peer *RemoteScreenPeerConn, service rgamepad.Service, slots *gamepadSlots, config GamepadConfig) *gamepadForwarder {
+	return &gamepadForwarder{
+		channel: channel,
+		peer:    peer,
+		service: service,
+		slots:   slots,
+		config:  config,
+		plugged: make(map[int]*pluggedGamepad),
+	}
+}
+
+func (f *gamepadForwarder) attach() {
+	f.channel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var event gamepadMessage
+		if err := json.Unmarshal(msg.Data, &event); err != nil {
+			f.peer.log.Warnf("Gamepad: %v", err)
+			return
+		}
+		if err := f.handle(&event); err != nil {
+			f.peer.log.Warnf("Gamepad: %v", err)
+			f.send(gamepadMessage{Type: "error", Index: event.Index, Message: err.Error()})
+		}
+	})
+	f.channel.OnClose(func() {
+		f.close()
+	})
+}
+
+func (f *gamepadForwarder) handle(event *gamepadMessage) error {
+	if event.Index < 0 || event.Index >= gamepadsPerViewer {
+		return fmt.Errorf("Invalid gamepad index %d", event.Index)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+
+	switch event.Type {
+	case "connected":
+		return f.connect(event.Index)
+	case "disconnected":
+		f.disconnect(event.Index)
+		return nil
+	case "state":
+		pad, found := f.plugged[event.Index]
+		// Like keyboard and mouse events, the state of viewers without
+		// control is dropped until control is granted
+		if !found || !f.allowed() {
+			return nil
+		}
+		return pad.gamepad.Update(rgamepad.State{
+			Buttons: event.Buttons,
+			Axes:    event.Axes,
+		})
+	}
+	return fmt.Errorf("Unknown gamepad event %s", event.Type)
+}
+
+func (f *gamepadForwarder) allowed() bool {
+	return f.config.Viewers || f.peer.Role() == RoleController
+}
+
+func (f *gamepadForwarder) connect(index int) error {
+	if pad, found := f.plugged[index]; found {
+		return f.send(gamepadMessage{Type: "slot", Index: index, Slot: pad.slot})
+	}
+	slot, err := f.slots.acquire()
+	if err != nil {
+		return err
+	}
+	gamepad, err := f.service.CreateGamepad(slot)
+	if err != nil {
+		f.slots.release(slot)
+		return err
+	}
+	f.plugged[index] = &pluggedGamepad{slot: slot, gamepad: gamepad}
+	go f.forwardRumble(index, gamepad)
+	return f.send(gamepadMessage{Type: "slot", Index: index, Slot: slot})
+}
+
+// disconnect unplugs the controller, callers hold f.mu
+func (f *gamepadForwarder) disconnect(index int) {
+	pad, found := f.plugged[index]
+	if !found {
+		return
+	}
+	delete(f.plugged, index)
+	pad.gamepad.Close()
+	f.slots.release(pad.slot)
+}
+
+// forwardRumble sends the force feedback of the host controller back to
+// the viewer gamepad, until the controller is unplugged
+func (f *gamepadForwarder) forwardRumble(index int, gamepad rgamepad.Gamepad) {
+	for rumble := range gamepad.Rumble() {
+		err := f.send(gamepadMessage{
+			Type:     "rumble",
+			Index:    index,
+			Strong:   rumble.Strong,
+			Weak:     rumble.Weak,
+			Duration: int64(rumble.Duration / time.Millisecond),
+		})
+		if err != nil {
+			f.peer.log.Warnf("Gamepad: %v", err)
+		}
+	}
+}
+
+func (f *gamepadForwarder) send(msg gamepadMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return f.channel.SendText(string(payload))
+}
+
+// close unplugs every controller of the session
+func (f *gamepadForwarder) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for index := range f.plugged {
+		f.disconnect(index)
+	}
+}
@@ -0,0 +1,182 @@
+package rtc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"oneplay-videostream-browser/internal/encoders"
+	"oneplay-videostream-browser/internal/rconsent"
+	"oneplay-videostream-browser/internal/rdisplay"
+	"oneplay-videostream-browser/internal/rhls"
+	"oneplay-videostream-browser/internal/rlog"
+
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+const (
+	// hlsFps is the frame rate of the HLS streams
+	hlsFps = 30
+	// hlsIdleTimeout stops packaging a screen no player fetched for a while
+	hlsIdleTimeout = 30 * time.Second
+)
+
+// hlsOutput packages a screen for the players that can't use WebRTC, it
+// subscribes to the capture feed like a read-only viewer. The quality
+// profile is used, its periodic keyframes start the segments.
+type hlsOutput struct {
+	screen int
+	stream *rhls.Stream
+	svc    *RemoteScreenService
+	hub    *captureHub
+	feed   *captureFeed
+	// watchers lists the players as a single viewer, nil without indicator
+	watchers *watchers
+
+	once sync.Once
+	// done is closed once the output is closed
+	done chan struct{}
+}
+
+// hlsViewer is how the HLS players of a screen show to the host
+const hlsViewer = "HLS players"
+
+// watcherID is the key of the output in the watchers
+func (o *hlsOutput) watcherID() string {
+	return fmt.Sprintf("hls-%d", o.screen)
+}
+
+func (o *hlsOutput) WriteSample(sample media.Sample) error {
+	return o.stream.WriteVideo(sample.Data, sample.Duration)
+}
+
+// feedEnded drops the output, the next request packages the screen from
+// a new feed instead of serving a stale playlist
+func (o *hlsOutput) feedEnded(err error) {
+	o.svc.log.With(rlog.F("screen", o.screen)).Warnf("HLS packaging stopped: %v", err)
+	o.svc.dropHLS(o)
+}
+
+func (o *hlsOutput) close() {
+	o.once.Do(func() {
+		o.feed.unsubscribe(o)
+		o.hub.release(o.feed)
+		o.stream.Close()
+		if o.watchers != nil {
+			o.watchers.leave(o.watcherID())
+		}
+		close(o.done)
+	})
+}
+
+// HLSHandler returns the handler serving the LL-HLS stream of a screen,
+// packaging starts with the first request and stops once players are gone.
+// The host is asked without holding hlsMu, requests for a screen being
+// started wait for it instead of asking again.
+func (svc *RemoteScreenService) HLSHandler(screenIx int) (http.Handler, error) {
+	if svc.hlsConfig.SegmentDuration == 0 {
+		return nil, fmt.Errorf("HLS disabled")
+	}
+
+	for {
+		svc.hlsMu.Lock()
+		if output, found := svc.hlsOutputs[screenIx]; found {
+			svc.hlsMu.Unlock()
+			return output.stream, nil
+		}
+		starting, found := svc.hlsStarting[screenIx]
+		if !found {
+			svc.hlsStarting[screenIx] = make(chan struct{})
+			svc.hlsMu.Unlock()
+			break
+		}
+		svc.hlsMu.Unlock()
+		<-starting
+	}
+	defer func() {
+		svc.hlsMu.Lock()
+		close(svc.hlsStarting[screenIx])
+		delete(svc.hlsStarting, screenIx)
+		svc.hlsMu.Unlock()
+	}()
+
+	if !svc.encodingService.Supports(encoders.H264Codec) {
+		return nil, fmt.Errorf("HLS needs the H.264 encoder")
+	}
+	screens, err := svc.videoService.Screens()
+	if err != nil {
+		return nil, err
+	}
+	if screenIx < 0 || screenIx >= len(screens) {
+		return nil, fmt.Errorf("No screen %d", screenIx)
+	}
+	screen := screens[screenIx]
+	err = svc.approve(rconsent.Request{
+		Viewer: hlsViewer,
+		Screen: screen.Index,
+		Role:   RoleViewer.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	feed, err := svc.hub.acquire(context.Background(), screen, captureKey{
+		screen:  screen.Index,
+		fps:     hlsFps,
+		cursor:  rdisplay.CursorComposite,
+		codec:   encoders.H264Codec,
+		profile: encoders.QualityProfile,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	output := &hlsOutput{
+		screen: screenIx,
+		stream: rhls.NewStream(svc.hlsConfig, feed.requestKeyframe),
+		svc:    svc,
+		hub:    svc.hub,
+		feed:   feed,
+		done:   make(chan struct{}),
+	}
+	if svc.watchers != nil {
+		output.watchers = svc.watchers
+		svc.watchers.join(output.watcherID(), hlsViewer)
+	}
+	svc.hlsMu.Lock()
+	svc.hlsOutputs[screenIx] = output
+	svc.hlsMu.Unlock()
+	feed.subscribe(output)
+	go svc.expireHLS(output)
+	svc.log.With(rlog.F("screen", screenIx)).Infof("HLS packaging started")
+	return output.stream, nil
+}
+
+// expireHLS stops the output once its players are gone
+func (svc *RemoteScreenService) expireHLS(output *hlsOutput) {
+	ticker := time.NewTicker(hlsIdleTimeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-output.done:
+			return
+		case <-ticker.C:
+			if output.stream.Idle() >= hlsIdleTimeout {
+				svc.dropHLS(output)
+				svc.log.With(rlog.F("screen", output.screen)).Infof("HLS packaging stopped, no players left")
+				return
+			}
+		}
+	}
+}
+
+// dropHLS forgets and closes output, a newer output of its screen is kept
+func (svc *RemoteScreenService) dropHLS(output *hlsOutput) {
+	svc.hlsMu.Lock()
+	if svc.hlsOutputs[output.screen] == output {
+		delete(svc.hlsOutputs, output.screen)
+	}
+	svc.hlsMu.Unlock()
+	output.close()
+}
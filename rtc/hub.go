@@ -0,0 +1,437 @@
+package rtc
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"oneplay-videostream-browser/internal/encoders"
+	"oneplay-videostream-browser/internal/raudio"
+	"oneplay-videostream-browser/internal/rdisplay"
+	"oneplay-videostream-browser/internal/rlog"
+	"oneplay-videostream-browser/internal/rmask"
+	"oneplay-videostream-browser/internal/rreplay"
+	"oneplay-videostream-browser/internal/rtrace"
+
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// captureKey identifies a capture/encode pipeline that can be shared by
+// every viewer asking for the same screen with the same parameters
+type captureKey struct {
+	screen  int
+	fps     int
+	cursor  rdisplay.CursorMode
+	codec   encoders.VideoCodec
+	profile encoders.Profile
+	// marker embeds the capture time in every frame
+	marker bool
+}
+
+// sampleSink receives the encoded samples of a captureFeed
+type sampleSink interface {
+	WriteSample(sample media.Sample) error
+}
+
+// endingSink is a sampleSink told when its feed failed for good, it still
+// has to release the feed
+type endingSink interface {
+	sampleSink
+	feedEnded(err error)
+}
+
+// captureHub keeps one captureFeed per captureKey, and the audio feed,
+// alive for as long as at least one viewer holds a reference to it
+type captureHub struct {
+	videoService rdisplay.Service
+	encService   encoders.Service
+	audioService raudio.Service
+	// masker hides the masked areas of every captured frame, nil when
+	// masking is disabled
+	masker *rmask.Masker
+	// encodeTime is the time taken by the encoders, by codec and profile
+	encodeTime *prometheus.HistogramVec
+	log        *rlog.Logger
+
+	mu    sync.Mutex
+	feeds map[captureKey]*captureFeed
+	audio *audioFeed
+}
+
+func newCaptureHub(video rdisplay.Service, enc encoders.Service, audio raudio.Service, masker *rmask.Masker, log *rlog.Logger) *captureHub {
+	return &captureHub{
+		log:          log,
+		videoService: video,
+		encService:   enc,
+		audioService: audio,
+		masker:       masker,
+		encodeTime:   newEncodeTimeHistogram(),
+		feeds:        make(map[captureKey]*captureFeed),
+	}
+}
+
+// acquire returns the feed for key, creating the grabber and encoder if no
+// other viewer is using it yet. Every acquire must be paired with a release.
+func (h *captureHub) acquire(ctx context.Context, screen rdisplay.Screen, key captureKey) (*captureFeed, error) {
+	ctx, span := rtrace.Tracer().Start(ctx, "capture.acquire", trace.WithAttributes(
+		attribute.Int("screen", screen.Index),
+		attribute.Int("fps", key.fps),
+	))
+	defer span.End()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if feed, found := h.feeds[key]; found {
+		feed.refs++
+		span.SetAttributes(attribute.Bool("shared", true))
+		return feed, nil
+	}
+	span.SetAttributes(attribute.Bool("shared", false))
+
+	// A replay can't honour keyframe requests, every viewer gets its own
+	// to watch it from the start
+	if replay, ok := h.videoService.(rreplay.Service); ok {
+		player, err := replay.CreatePlayer(screen)
+		if err != nil {
+			rtrace.Fail(span, err)
+			return nil, err
+		}
+		feed := newReplayFeed(key, player)
+		feed.log = h.log.With(rlog.F("screen", screen.Index))
+		feed.refs = 1
+		return feed, nil
+	}
+
+	settings := settingsForProfile(key.profile)
+	grabber, err := h.videoService.CreateScreenGrabber(screen, key.fps, key.cursor, settings.captureQueue)
+	if err != nil {
+		rtrace.Fail(span, err)
+		return nil, err
+	}
+	sourceSize := image.Point{
+		screen.Bounds.Dx(),
+		screen.Bounds.Dy(),
+	}
+	encoder, size, err := h.newEncoder(ctx, key, sourceSize)
+	if err != nil {
+		grabber.Stop()
+		rtrace.Fail(span, err)
+		return nil, err
+	}
+
+	feed := newCaptureFeed(key, grabber, encoder, size)
+	feed.hub = h
+	feed.masker = h.masker
+	feed.origin = screen.Bounds.Min
+	feed.encodeTime = h.encodeTime.WithLabelValues(codecLabel(key.codec), profileLabel(key.profile))
+	feed.log = h.log.With(rlog.F("screen", screen.Index))
+	feed.refs = 1
+	h.feeds[key] = feed
+	return feed, nil
+}
+
+// newEncoder creates the encoder of key and returns the size of the video
+// it outputs
+func (h *captureHub) newEncoder(ctx context.Context, key captureKey, sourceSize image.Point) (encoders.Encoder, image.Point, error) {
+	_, span := rtrace.Tracer().Start(ctx, "encoder.create", trace.WithAttributes(
+		attribute.String("codec", codecLabel(key.codec)),
+		attribute.String("profile", profileLabel(key.profile)),
+		attribute.Int("width", sourceSize.X),
+		attribute.Int("height", sourceSize.Y),
+	))
+	defer span.End()
+
+	encoder, err := h.encService.NewEncoder(key.codec, sourceSize, key.fps, key.profile)
+	if err != nil {
+		rtrace.Fail(span, err)
+		return nil, image.Point{}, err
+	}
+	size, err := encoder.VideoSize()
+	if err != nil {
+		encoder.Close()
+		rtrace.Fail(span, err)
+		return nil, image.Point{}, err
+	}
+	return encoder, size, nil
+}
+
+// release drops a reference to feed, the last one stops capture and encoding
+func (h *captureHub) release(feed *captureFeed) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	feed.refs--
+	if feed.refs > 0 {
+		return
+	}
+	if h.feeds[feed.key] == feed {
+		delete(h.feeds, feed.key)
+	}
+	feed.close()
+}
+
+// evict forgets feed once its capture loop ended, the next viewer gets a
+// new one while the viewers of feed still release it
+func (h *captureHub) evict(feed *captureFeed) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.feeds[feed.key] == feed {
+		delete(h.feeds, feed.key)
+	}
+}
+
+// captureFeed runs a single capture and encode loop and fans the encoded
+// samples and pointer updates out to every subscribed viewer
+type captureFeed struct {
+	// accessed atomically, kept first for 64-bit alignment on 32-bit platforms
+	encoded uint64
+
+	key     captureKey
+	grabber rdisplay.ScreenGrabber
+	encoder encoders.Encoder
+	// player replaces the grabber and the encoder of a replay feed
+	player rreplay.Player
+	// hub is evicted from when the capture loop fails, nil for replays
+	hub    *captureHub
+	size   image.Point
+	masker *rmask.Masker
+	// origin is where the captured screen starts on the desktop
+	origin     image.Point
+	encodeTime prometheus.Observer
+	log        *rlog.Logger
+	// refs is guarded by captureHub.mu
+	refs int
+
+	mu         sync.Mutex
+	sinks      map[sampleSink]struct{}
+	cursorSubs map[chan *rdisplay.Cursor]struct{}
+	lastCursor *rdisplay.Cursor
+
+	startOnce sync.Once
+	stop      chan struct{}
+}
+
+func newCaptureFeed(key captureKey, grabber rdisplay.ScreenGrabber, encoder encoders.Encoder, size image.Point) *captureFeed {
+	return &captureFeed{
+		key:        key,
+		grabber:    grabber,
+		encoder:    encoder,
+		size:       size,
+		sinks:      make(map[sampleSink]struct{}),
+		cursorSubs: make(map[chan *rdisplay.Cursor]struct{}),
+		stop:       make(chan struct{}),
+	}
+}
+
+// subscribe starts delivering samples to sink, the capture loop starts
+// with the first subscriber
+func (f *captureFeed) subscribe(sink sampleSink) {
+	f.mu.Lock()
+	f.sinks[sink] = struct{}{}
+	f.mu.Unlock()
+
+	f.startOnce.Do(func() {
+		if f.player != nil {
+			f.player.Start()
+			go f.runReplay()
+			return
+		}
+		f.grabber.Start()
+		go f.run()
+		go f.fanOutCursor()
+	})
+	// A viewer joining a running feed can't decode anything until the
+	// next keyframe
+	f.requestKeyframe()
+}
+
+func (f *captureFeed) unsubscribe(sink sampleSink) {
+	f.mu.Lock()
+	delete(f.sinks, sink)
+	f.mu.Unlock()
+}
+
+// subscribeCursor returns a channel receiving pointer updates, the latest
+// known pointer is delivered right away
+func (f *captureFeed) subscribeCursor() (<-chan *rdisplay.Cursor, func()) {
+	ch := make(chan *rdisplay.Cursor, 1)
+	f.mu.Lock()
+	f.cursorSubs[ch] = struct{}{}
+	if f.lastCursor != nil {
+		ch <- f.lastCursor
+	}
+	f.mu.Unlock()
+
+	return ch, func() {
+		f.mu.Lock()
+		if _, found := f.cursorSubs[ch]; found {
+			delete(f.cursorSubs, ch)
+			close(ch)
+		}
+		f.mu.Unlock()
+	}
+}
+
+func (f *captureFeed) requestKeyframe() {
+	if f.encoder != nil {
+		f.encoder.RequestKeyframe()
+	}
+}
+
+func (f *captureFeed) stats() StreamStats {
+	if f.player != nil {
+		played := atomic.LoadUint64(&f.encoded)
+		return StreamStats{Captured: played, Encoded: played}
+	}
+	capture := f.grabber.Stats()
+	return StreamStats{
+		Captured: capture.Captured,
+		Dropped:  capture.Dropped,
+		Encoded:  atomic.LoadUint64(&f.encoded),
+	}
+}
+
+func (f *captureFeed) run() {
+	defer f.encoder.Close()
+	frames := f.grabber.Frames()
+	var lastSample time.Time
+	// timings of the frames given to the encoder, in order, the encoder
+	// outputs them in the same order once its lookahead is filled
+	var timings []frameTiming
+	for {
+		select {
+		case <-f.stop:
+			f.grabber.Stop()
+			return
+		case frame, ok := <-frames:
+			if !ok {
+				// The grabber gave up on its own
+				f.end(fmt.Errorf("Capture of screen %d stopped", f.key.screen))
+				return
+			}
+			timings = append(timings, frameTiming{
+				captured: frame.Captured,
+				encoding: time.Now(),
+			})
+			payload, err := f.encode(frame)
+			if err != nil {
+				f.log.Warnf("Streamer: %v", err)
+				f.grabber.Stop()
+				f.end(fmt.Errorf("Encoding of screen %d failed: %v", f.key.screen, err))
+				return
+			}
+			if payload == nil {
+				continue
+			}
+			atomic.AddUint64(&f.encoded, 1)
+			// Sample durations follow the real pacing so dropped frames
+			// don't skew RTP timestamps
+			now := time.Now()
+			duration := time.Second / time.Duration(f.grabber.Fps())
+			if !lastSample.IsZero() {
+				duration = now.Sub(lastSample)
+			}
+			lastSample = now
+			timing := timings[0]
+			timings = timings[1:]
+			timing.encoded = now
+			f.broadcast(media.Sample{
+				Data:     payload,
+				Duration: duration,
+			}, timing)
+		}
+	}
+}
+
+// end evicts the feed once its capture loop failed and tells the sinks
+// that care, the sinks are called without the lock as they may unsubscribe
+func (f *captureFeed) end(err error) {
+	f.hub.evict(f)
+
+	f.mu.Lock()
+	var ending []endingSink
+	for sink := range f.sinks {
+		if sink, ok := sink.(endingSink); ok {
+			ending = append(ending, sink)
+		}
+	}
+	f.mu.Unlock()
+	for _, sink := range ending {
+		sink.feedEnded(err)
+	}
+}
+
+func (f *captureFeed) encode(frame *rdisplay.Frame) ([]byte, error) {
+	// Masks are in desktop coordinates, they go on before scaling
+	if f.masker != nil {
+		f.masker.Apply(frame.Image, f.origin)
+	}
+	resized := resizeImage(frame.Image, f.size)
+	if f.key.marker {
+		drawLatencyMarker(resized, frame.Captured)
+	}
+	start := time.Now()
+	payload, err := f.encoder.Encode(resized)
+	if f.encodeTime != nil {
+		f.encodeTime.Observe(time.Since(start).Seconds())
+	}
+	return payload, err
+}
+
+// broadcast writes the sample to every sink, timing is the timing of the
+// frame the encoder just output, which lags behind with a lookahead
+func (f *captureFeed) broadcast(sample media.Sample, timing frameTiming) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for sink := range f.sinks {
+		var err error
+		if timed, ok := sink.(timedSink); ok {
+			err = timed.writeTimedSample(sample, timing)
+		} else {
+			err = sink.WriteSample(sample)
+		}
+		if err != nil {
+			f.log.Warnf("Streamer: %v", err)
+		}
+	}
+}
+
+func (f *captureFeed) fanOutCursor() {
+	for cursor := range f.grabber.Cursor() {
+		f.mu.Lock()
+		f.lastCursor = cursor
+		for ch := range f.cursorSubs {
+			// Only the newest pointer matters to a slow viewer
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- cursor
+		}
+		f.mu.Unlock()
+	}
+	f.mu.Lock()
+	for ch := range f.cursorSubs {
+		delete(f.cursorSubs, ch)
+		close(ch)
+	}
+	f.mu.Unlock()
+}
+
+func (f *captureFeed) close() {
+	close(f.stop)
+	f.startOnce.Do(func() {
+		// Never started, nothing will close the encoder otherwise
+		if f.encoder != nil {
+			f.encoder.Close()
+		}
+	})
+}
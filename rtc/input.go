@@ -0,0 +1,202 @@
+package rtc
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"sync"
+
+	"oneplay-videostream-browser/internal/rinput"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const inputChannelLabel = "input"
+
+// inputMessage is a viewer input event. Pointer coordinates are expressed in
+// pixels of the received video, wheel deltas in notches and keys with their
+// DOM KeyboardEvent.code.
+//
+//	{"type":"mousemove","x":640,"y":360}
+//	{"type":"mousemoverel","dx":4,"dy":-2}
+//	{"type":"mousedown","button":0}
+//	{"type":"mouseup","button":0}
+//	{"type":"wheel","dx":0,"dy":1}
+//	{"type":"keydown","code":"KeyA"}
+//	{"type":"keyup","code":"KeyA"}
+type inputMessage struct {
+	Type   string  `json:"type"`
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	DX     float64 `json:"dx"`
+	DY     float64 `json:"dy"`
+	Button int     `json:"button"`
+	Code   string  `json:"code"`
+}
+
+// inputHandler injects the events received on the "input" data channel
+// into the captured display
+type inputHandler struct {
+	channel  *webrtc.DataChannel
+	peer     *RemoteScreenPeerConn
+	service  rinput.Service
+	mu       sync.Mutex
+	injector rinput.Injector
+	// keys and buttons are held down on the host, they are released when
+	// the session loses control
+	keys    map[string]struct{}
+	buttons map[rinput.MouseButton]struct{}
+}
+
+func newInputHandler(channel *webrtc.DataChannel, peer *RemoteScreenPeerConn, service rinput.Service) *inputHandler {
+	return &inputHandler{
+		channel: channel,
+		peer:    peer,
+		service: service,
+		keys:    make(map[string]struct{}),
+		buttons: make(map[rinput.MouseButton]struct{}),
+	}
+}
+
+func (h *inputHandler) attach() {
+	h.channel.OnOpen(func() {
+		injector, err := h.service.CreateInjector()
+		if err != nil {
+			h.peer.log.Warnf("Input: %v", err)
+			return
+		}
+		h.mu.Lock()
+		h.injector = injector
+		h.mu.Unlock()
+	})
+	h.channel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var event inputMessage
+		if err := json.Unmarshal(msg.Data, &event); err != nil {
+			h.peer.log.Warnf("Input: %v", err)
+			return
+		}
+		if err := h.handle(&event); err != nil {
+			h.peer.log.Warnf("Input: %v", err)
+		}
+	})
+	h.channel.OnClose(func() {
+		h.close()
+	})
+}
+
+func (h *inputHandler) handle(event *inputMessage) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// Viewers without control are allowed to open the channel, their
+	// events are dropped until control is granted
+	if h.injector == nil || h.peer.Role() != RoleController {
+		return nil
+	}
+
+	switch event.Type {
+	case "mousemove":
+		target := h.toScreen(event.X, event.Y)
+		return h.injector.MouseMove(target.X, target.Y)
+	case "mousemoverel":
+		scaleX, scaleY := h.scale()
+		return h.injector.MouseMoveRelative(int(math.Round(event.DX*scaleX)), int(math.Round(event.DY*scaleY)))
+	case "mousedown", "mouseup":
+		button := rinput.MouseButton(event.Button)
+		pressed := event.Type == "mousedown"
+		if err := h.injector.MouseButton(button, pressed); err != nil {
+			return err
+		}
+		if pressed {
+			h.buttons[button] = struct{}{}
+		} else {
+			delete(h.buttons, button)
+		}
+		return nil
+	case "wheel":
+		return h.injector.Wheel(int(event.DX), int(event.DY))
+	case "keydown", "keyup":
+		pressed := event.Type == "keydown"
+		if err := h.injector.Key(event.Code, pressed); err != nil {
+			return err
+		}
+		if pressed {
+			h.keys[event.Code] = struct{}{}
+		} else {
+			delete(h.keys, event.Code)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown input event %s", event.Type)
+}
+
+// release lets go of the keys and buttons the viewer still holds down, the
+// events releasing them are dropped once it lost control
+func (h *inputHandler) release() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.releaseLocked()
+}
+
+func (h *inputHandler) releaseLocked() {
+	if h.injector == nil {
+		return
+	}
+	for code := range h.keys {
+		if err := h.injector.Key(code, false); err != nil {
+			h.peer.log.Warnf("Input: %v", err)
+		}
+		delete(h.keys, code)
+	}
+	for button := range h.buttons {
+		if err := h.injector.MouseButton(button, false); err != nil {
+			h.peer.log.Warnf("Input: %v", err)
+		}
+		delete(h.buttons, button)
+	}
+}
+
+// scale returns the ratio between the captured screen and the video the
+// viewer receives
+func (h *inputHandler) scale() (float64, float64) {
+	bounds := h.peer.screen.Bounds
+	feed := h.peer.currentFeed()
+	if feed == nil || feed.size.X == 0 || feed.size.Y == 0 {
+		return 1, 1
+	}
+	size := feed.size
+	return float64(bounds.Dx()) / float64(size.X), float64(bounds.Dy()) / float64(size.Y)
+}
+
+// toScreen maps a position on the video back to the screen bounds
+func (h *inputHandler) toScreen(x, y float64) image.Point {
+	bounds := h.peer.screen.Bounds
+	scaleX, scaleY := h.scale()
+	target := image.Point{
+		bounds.Min.X + int(math.Round(x*scaleX)),
+		bounds.Min.Y + int(math.Round(y*scaleY)),
+	}
+	if target.X >= bounds.Max.X {
+		target.X = bounds.Max.X - 1
+	}
+	if target.Y >= bounds.Max.Y {
+		target.Y = bounds.Max.Y - 1
+	}
+	if target.X < bounds.Min.X {
+		target.X = bounds.Min.X
+	}
+	if target.Y < bounds.Min.Y {
+		target.Y = bounds.Min.Y
+	}
+	return target
+}
+
+func (h *inputHandler) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.injector != nil {
+		h.releaseLocked()
+		h.injector.Close()
+		h.injector = nil
+	}
+}
@@ -0,0 +1,91 @@
+package rtc
+
+import (
+	"time"
+
+	"oneplay-videostream-browser/internal/encoders"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// playoutDelayURI is the header extension telling the browser how long it
+// may buffer video before rendering it
+const playoutDelayURI = "http://www.webrtc.org/experiments/rtp-hdrext/playout-delay"
+
+// latencySettings are the capture and transport settings of a latency
+// profile, the encoder settings live with each encoder
+type latencySettings struct {
+	// captureQueue is how many captured frames may wait for the encoder
+	captureQueue int
+	// minPlayout and maxPlayout bound the browser jitter buffer
+	minPlayout time.Duration
+	maxPlayout time.Duration
+}
+
+func settingsForProfile(profile encoders.Profile) latencySettings {
+	if profile == encoders.QualityProfile {
+		return latencySettings{
+			captureQueue: 2,
+			minPlayout:   50 * time.Millisecond,
+			maxPlayout:   500 * time.Millisecond,
+		}
+	}
+	// Only the newest captured frame waits for the encoder, and it is
+	// rendered as soon as it is decoded
+	return latencySettings{}
+}
+
+// registerPlayoutDelay negotiates the playout delay extension on video and
+// stamps every packet with the delay of the profile
+func registerPlayoutDelay(mediaEngine *webrtc.MediaEngine, interceptors *interceptor.Registry, settings latencySettings) error {
+	err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: playoutDelayURI}, webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		return err
+	}
+	interceptors.Add(&playoutDelayFactory{settings: settings})
+	return nil
+}
+
+type playoutDelayFactory struct {
+	settings latencySettings
+}
+
+func (f *playoutDelayFactory) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	return &playoutDelayInterceptor{payload: playoutDelayPayload(f.settings.minPlayout, f.settings.maxPlayout)}, nil
+}
+
+// playoutDelayInterceptor adds the playout delay extension to the streams
+// that negotiated it
+type playoutDelayInterceptor struct {
+	interceptor.NoOp
+	payload []byte
+}
+
+func (i *playoutDelayInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	var id uint8
+	for _, extension := range info.RTPHeaderExtensions {
+		if extension.URI == playoutDelayURI {
+			id = uint8(extension.ID)
+		}
+	}
+	if id == 0 {
+		return writer
+	}
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		if err := header.SetExtension(id, i.payload); err != nil {
+			return 0, err
+		}
+		return writer.Write(header, payload, attributes)
+	})
+}
+
+// playoutDelayPayload encodes the minimum and maximum delays as two 12-bit
+// counts of 10ms
+func playoutDelayPayload(min, max time.Duration) []byte {
+	minUnits := uint32(min / (10 * time.Millisecond))
+	maxUnits := uint32(max / (10 * time.Millisecond))
+	value := (minUnits&0xfff)<<12 | maxUnits&0xfff
+	return []byte{byte(value >> 16), byte(value >> 8), byte(value)}
+}
@@ -0,0 +1,352 @@
+package rtc
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"strings"
+	"sync"
+	"time"
+
+	"oneplay-videostream-browser/internal/rlog"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+const (
+	latencyChannelLabel = "latency"
+	// latencySyncEvery is how often the viewer clock offset is measured
+	latencySyncEvery = 2 * time.Second
+	// latencyFramesKept bounds the frames waiting for a render report
+	latencyFramesKept = 256
+	// markerBits and markerBlock are the size of the optional frame marker,
+	// one block per bit of the capture time in the top left corner
+	markerBits  = 32
+	markerBlock = 8
+)
+
+// latencyBuckets are the upper bounds of the latency histogram buckets
+var latencyBuckets = []time.Duration{
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	16 * time.Millisecond,
+	25 * time.Millisecond,
+	33 * time.Millisecond,
+	50 * time.Millisecond,
+	75 * time.Millisecond,
+	100 * time.Millisecond,
+	150 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// LatencyHistogram counts the samples of a latency phase, Counts[i] holds
+// the samples up to Buckets[i] and the last count those above every bucket
+type LatencyHistogram struct {
+	Buckets []time.Duration
+	Counts  []uint64
+	Count   uint64
+	Sum     time.Duration
+}
+
+func newLatencyHistogram() LatencyHistogram {
+	return LatencyHistogram{
+		Buckets: latencyBuckets,
+		Counts:  make([]uint64, len(latencyBuckets)+1),
+	}
+}
+
+func (h *LatencyHistogram) observe(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	i := 0
+	for i < len(h.Buckets) && d > h.Buckets[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+// Mean returns the average sample, zero without samples
+func (h LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+func (h LatencyHistogram) clone() LatencyHistogram {
+	h.Counts = append([]uint64(nil), h.Counts...)
+	return h
+}
+
+// LatencyStats splits the glass-to-glass latency of the frames a viewer
+// rendered: Capture is the screen grab and the wait for the encoder, Network
+// goes from the encoder output to the browser receiving the frame, Decode
+// ends when the browser decoded it and Total when it was displayed.
+type LatencyStats struct {
+	Capture LatencyHistogram
+	Encode  LatencyHistogram
+	Network LatencyHistogram
+	Decode  LatencyHistogram
+	Total   LatencyHistogram
+	// RoundTrip of the best clock synchronization with the viewer
+	RoundTrip time.Duration
+}
+
+// frameTiming is when a video frame went through each stage on the agent
+type frameTiming struct {
+	captured time.Time
+	encoding time.Time
+	encoded  time.Time
+}
+
+// timedSink is a sampleSink interested in the timing of every frame
+type timedSink interface {
+	sampleSink
+	writeTimedSample(sample media.Sample, timing frameTiming) error
+}
+
+// latencyMessage is a message of the "latency" channel. The agent pings
+// with its clock in milliseconds since the epoch, the viewer answers with
+// its own clock to measure their offset. The viewer reports every frame it
+// displayed with its RTP timestamp and when it was received, decoded and
+// rendered.
+//
+//	{"type":"ping","sent":1700000000000.5}
+//	{"type":"pong","sent":1700000000000.5,"viewer":1700000000012.25}
+//	{"type":"frame","rtp":3000,"received":1700000000020,"decoded":1700000000024,"rendered":1700000000030}
+type latencyMessage struct {
+	Type     string  `json:"type"`
+	Sent     float64 `json:"sent,omitempty"`
+	Viewer   float64 `json:"viewer,omitempty"`
+	RTP      uint32  `json:"rtp,omitempty"`
+	Received float64 `json:"received,omitempty"`
+	Decoded  float64 `json:"decoded,omitempty"`
+	Rendered float64 `json:"rendered,omitempty"`
+}
+
+// latencyProbe measures the glass-to-glass latency of a session. It sits
+// between the shared feed and the peer's video track to learn the timing
+// of each frame, maps it to the RTP timestamp the frame was sent with and
+// matches it with the render reports of the viewer.
+type latencyProbe struct {
+	track *webrtc.TrackLocalStaticSample
+
+	mu      sync.Mutex
+	pending *frameTiming
+	frames  map[uint32]frameTiming
+	order   []uint32
+	// offset is the viewer clock minus the agent clock, valid once synced
+	offset    time.Duration
+	roundTrip time.Duration
+	synced    bool
+	stats     LatencyStats
+	closed    chan struct{}
+	closeOnce sync.Once
+	log       *rlog.Logger
+}
+
+func newLatencyProbe(log *rlog.Logger) *latencyProbe {
+	return &latencyProbe{
+		log:    log,
+		frames: make(map[uint32]frameTiming, latencyFramesKept),
+		stats: LatencyStats{
+			Capture: newLatencyHistogram(),
+			Encode:  newLatencyHistogram(),
+			Network: newLatencyHistogram(),
+			Decode:  newLatencyHistogram(),
+			Total:   newLatencyHistogram(),
+		},
+		closed: make(chan struct{}),
+	}
+}
+
+// WriteSample forwards a sample without timing
+func (p *latencyProbe) WriteSample(sample media.Sample) error {
+	return p.track.WriteSample(sample)
+}
+
+// writeTimedSample writes the sample, the RTP packets of the frame are
+// stamped synchronously by the interceptor while the timing is pending
+func (p *latencyProbe) writeTimedSample(sample media.Sample, timing frameTiming) error {
+	p.mu.Lock()
+	p.pending = &timing
+	p.mu.Unlock()
+	err := p.track.WriteSample(sample)
+	p.mu.Lock()
+	p.pending = nil
+	p.mu.Unlock()
+	return err
+}
+
+// recordPacket remembers the timing of the frame an outgoing video packet
+// belongs to, retransmissions carry a known timestamp and are ignored
+func (p *latencyProbe) recordPacket(timestamp uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending == nil {
+		return
+	}
+	if _, found := p.frames[timestamp]; found {
+		return
+	}
+	p.frames[timestamp] = *p.pending
+	p.order = append(p.order, timestamp)
+	if len(p.order) > latencyFramesKept {
+		delete(p.frames, p.order[0])
+		p.order = p.order[1:]
+	}
+}
+
+func (p *latencyProbe) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	return &latencyInterceptor{probe: p}, nil
+}
+
+// latencyInterceptor reports the RTP timestamp of every outgoing video
+// packet to the probe
+type latencyInterceptor struct {
+	interceptor.NoOp
+	probe *latencyProbe
+}
+
+func (i *latencyInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if !strings.HasPrefix(strings.ToLower(info.MimeType), "video/") {
+		return writer
+	}
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		i.probe.recordPacket(header.Timestamp)
+		return writer.Write(header, payload, attributes)
+	})
+}
+
+// attach serves the "latency" data channel of the viewer
+func (p *latencyProbe) attach(channel *webrtc.DataChannel) {
+	channel.OnOpen(func() {
+		go p.syncClock(channel)
+	})
+	channel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var report latencyMessage
+		if err := json.Unmarshal(msg.Data, &report); err != nil {
+			p.log.Warnf("Latency: %v", err)
+			return
+		}
+		p.handle(&report)
+	})
+	channel.OnClose(func() {
+		p.close()
+	})
+}
+
+// syncClock pings the viewer until the probe is closed
+func (p *latencyProbe) syncClock(channel *webrtc.DataChannel) {
+	ticker := time.NewTicker(latencySyncEvery)
+	defer ticker.Stop()
+	for {
+		payload, err := json.Marshal(latencyMessage{Type: "ping", Sent: toMillis(time.Now())})
+		if err != nil {
+			return
+		}
+		if err = channel.SendText(string(payload)); err != nil {
+			p.log.Warnf("Latency: %v", err)
+			return
+		}
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *latencyProbe) handle(msg *latencyMessage) {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch msg.Type {
+	case "pong":
+		sent := fromMillis(msg.Sent)
+		roundTrip := now.Sub(sent)
+		if roundTrip < 0 || msg.Viewer == 0 {
+			return
+		}
+		// The exchange with the shortest round trip bounds the offset best
+		if p.synced && roundTrip > p.roundTrip {
+			return
+		}
+		p.roundTrip = roundTrip
+		p.offset = fromMillis(msg.Viewer).Sub(sent.Add(roundTrip / 2))
+		p.synced = true
+		p.stats.RoundTrip = roundTrip
+	case "frame":
+		timing, found := p.frames[msg.RTP]
+		if !found || !p.synced {
+			return
+		}
+		delete(p.frames, msg.RTP)
+		received := fromMillis(msg.Received).Add(-p.offset)
+		decoded := fromMillis(msg.Decoded).Add(-p.offset)
+		rendered := fromMillis(msg.Rendered).Add(-p.offset)
+		p.stats.Capture.observe(timing.encoding.Sub(timing.captured))
+		p.stats.Encode.observe(timing.encoded.Sub(timing.encoding))
+		p.stats.Network.observe(received.Sub(timing.encoded))
+		p.stats.Decode.observe(decoded.Sub(received))
+		p.stats.Total.observe(rendered.Sub(timing.captured))
+	}
+}
+
+// Stats returns a copy of the latency histograms
+func (p *latencyProbe) Stats() LatencyStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Capture = stats.Capture.clone()
+	stats.Encode = stats.Encode.clone()
+	stats.Network = stats.Network.clone()
+	stats.Decode = stats.Decode.clone()
+	stats.Total = stats.Total.clone()
+	return stats
+}
+
+func (p *latencyProbe) close() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+}
+
+func toMillis(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Millisecond)
+}
+
+func fromMillis(ms float64) time.Time {
+	return time.Unix(0, int64(ms*float64(time.Millisecond)))
+}
+
+// drawLatencyMarker writes the low 32 bits of the capture time in
+// milliseconds in the top left corner, one black or white block per bit
+// with the most significant bit first, so a camera or a screen reader can
+// match what is displayed with when it was captured
+func drawLatencyMarker(img *image.RGBA, captured time.Time) {
+	value := uint32(captured.UnixNano() / int64(time.Millisecond))
+	bounds := img.Bounds()
+	for bit := 0; bit < markerBits; bit++ {
+		c := color.RGBA{A: 0xff}
+		if value&(1<<uint(markerBits-1-bit)) != 0 {
+			c = color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+		}
+		x0 := bounds.Min.X + bit*markerBlock
+		for y := bounds.Min.Y; y < bounds.Min.Y+markerBlock && y < bounds.Max.Y; y++ {
+			for x := x0; x < x0+markerBlock && x < bounds.Max.X; x++ {
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package rtc
+
+import (
+	"strconv"
+
+	"oneplay-videostream-browser/internal/encoders"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricsNamespace prefixes the name of every metric of the agent
+const metricsNamespace = "oneplay"
+
+// sessionLabels identify the session of the per-session metrics
+var sessionLabels = []string{"session", "screen"}
+
+func newEncodeTimeHistogram() *prometheus.HistogramVec {
+	buckets := make([]float64, len(latencyBuckets))
+	for i, bucket := range latencyBuckets {
+		buckets[i] = bucket.Seconds()
+	}
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "encode_duration_seconds",
+		Help:      "Time taken to encode a frame.",
+		Buckets:   buckets,
+	}, []string{"codec", "profile"})
+}
+
+func codecLabel(codec encoders.VideoCodec) string {
+	switch codec {
+	case encoders.H264Codec:
+		return "h264"
+	case encoders.VP8Codec:
+		return "vp8"
+	}
+	return "none"
+}
+
+func profileLabel(profile encoders.Profile) string {
+	if profile == encoders.QualityProfile {
+		return "quality"
+	}
+	return "low"
+}
+
+// metricsCollector exports the sessions of the service to Prometheus. The
+// counters of the sessions are read on every scrape, nothing is kept once
+// a session is closed.
+type metricsCollector struct {
+	arbiter *controlArbiter
+	hub     *captureHub
+
+	sessions     *prometheus.Desc
+	captured     *prometheus.Desc
+	dropped      *prometheus.Desc
+	encoded      *prometheus.Desc
+	sent         *prometheus.Desc
+	packets      *prometheus.Desc
+	bytes        *prometheus.Desc
+	nacks        *prometheus.Desc
+	plis         *prometheus.Desc
+	firs         *prometheus.Desc
+	lost         *prometheus.Desc
+	fractionLost *prometheus.Desc
+	roundTrip    *prometheus.Desc
+	candidates   *prometheus.Desc
+}
+
+func newMetricsCollector(arbiter *controlArbiter, hub *captureHub) *metricsCollector {
+	session := func(name string, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "session", name), help, sessionLabels, nil)
+	}
+	return &metricsCollector{
+		arbiter: arbiter,
+		hub:     hub,
+		sessions: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "sessions_active"),
+			"Sessions currently open.", []string{"screen", "role"}, nil),
+		captured:     session("frames_captured_total", "Frames captured from the screen of the session."),
+		dropped:      session("frames_dropped_total", "Frames dropped because the encoder was busy."),
+		encoded:      session("frames_encoded_total", "Frames encoded for the session."),
+		sent:         session("frames_sent_total", "Frames sent to the viewer."),
+		packets:      session("packets_sent_total", "RTP packets of the video stream sent to the viewer."),
+		bytes:        session("bytes_sent_total", "Bytes of the video stream sent to the viewer, headers included."),
+		nacks:        session("nacks_total", "NACKs received from the viewer."),
+		plis:         session("plis_total", "Picture loss indications received from the viewer."),
+		firs:         session("firs_total", "Full intra requests received from the viewer."),
+		lost:         session("packets_lost", "Video packets lost, as last reported by the viewer."),
+		fractionLost: session("fraction_lost", "Share of the video packets lost between the last two viewer reports."),
+		roundTrip:    session("rtt_seconds", "Round trip time to the viewer, from the last RTCP receiver report."),
+		candidates: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "ice", "selected_pairs"),
+			"Sessions by the types of their selected ICE candidate pair.", []string{"local", "remote", "protocol"}, nil),
+	}
+}
+
+func (c *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.sessions
+	ch <- c.captured
+	ch <- c.dropped
+	ch <- c.encoded
+	ch <- c.sent
+	ch <- c.packets
+	ch <- c.bytes
+	ch <- c.nacks
+	ch <- c.plis
+	ch <- c.firs
+	ch <- c.lost
+	ch <- c.fractionLost
+	ch <- c.roundTrip
+	ch <- c.candidates
+	c.hub.encodeTime.Describe(ch)
+}
+
+func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	type roleKey struct {
+		screen int
+		role   Role
+	}
+	type pairKey struct {
+		local, remote, protocol string
+	}
+	roles := make(map[roleKey]int)
+	pairs := make(map[pairKey]int)
+
+	for _, peer := range c.arbiter.all() {
+		roles[roleKey{peer.screen.Index, peer.Role()}]++
+		if local, remote, protocol, found := peer.selectedPair(); found {
+			pairs[pairKey{local, remote, protocol}]++
+		}
+
+		labels := []string{peer.id, strconv.Itoa(peer.screen.Index)}
+		counter := func(desc *prometheus.Desc, value float64) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, labels...)
+		}
+		gauge := func(desc *prometheus.Desc, value float64) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+		}
+
+		stream := peer.Stats()
+		counter(c.captured, float64(stream.Captured))
+		counter(c.dropped, float64(stream.Dropped))
+		counter(c.encoded, float64(stream.Encoded))
+
+		transport := peer.Transport()
+		counter(c.sent, float64(transport.FramesSent))
+		counter(c.packets, float64(transport.PacketsSent))
+		counter(c.bytes, float64(transport.BytesSent))
+		counter(c.nacks, float64(transport.NACKs))
+		counter(c.plis, float64(transport.PLIs))
+		counter(c.firs, float64(transport.FIRs))
+		gauge(c.lost, float64(transport.PacketsLost))
+		gauge(c.fractionLost, transport.FractionLost)
+		gauge(c.roundTrip, transport.RoundTrip.Seconds())
+	}
+
+	for key, count := range roles {
+		ch <- prometheus.MustNewConstMetric(c.sessions, prometheus.GaugeValue, float64(count), strconv.Itoa(key.screen), key.role.String())
+	}
+	for key, count := range pairs {
+		ch <- prometheus.MustNewConstMetric(c.candidates, prometheus.GaugeValue, float64(count), key.local, key.remote, key.protocol)
+	}
+	c.hub.encodeTime.Collect(ch)
+}
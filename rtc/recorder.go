@@ -0,0 +1,141 @@
+package rtc
+
+import (
+	"sync/atomic"
+	"time"
+
+	"oneplay-videostream-browser/internal/encoders"
+	"oneplay-videostream-browser/internal/raudio"
+	"oneplay-videostream-browser/internal/rlog"
+	"oneplay-videostream-browser/internal/rrecord"
+
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// recorderQueue is the number of samples waiting for the disk, about a
+// second of video and its audio
+const recorderQueue = 120
+
+// sessionRecorder records what a session watches. It subscribes to the
+// session feeds like one more viewer, so the encoded samples are written
+// as they are and nothing is encoded twice. A queue keeps a slow disk from
+// holding back the viewers sharing the feeds.
+type sessionRecorder struct {
+	// accessed atomically, kept first for 64-bit alignment on 32-bit platforms
+	dropped uint64
+
+	recorder *rrecord.Recorder
+	video    *captureFeed
+	audio    *audioFeed
+	// videoSink and audioSink are the recorder subscriptions to each feed
+	videoSink *recordingSink
+	audioSink *recordingSink
+	queue     chan recordingSample
+	done      chan struct{}
+	log       *rlog.Logger
+}
+
+// recordingSample is a queued sample and the track it goes to
+type recordingSample struct {
+	write    func(data []byte, duration time.Duration) error
+	data     []byte
+	duration time.Duration
+}
+
+// recordingSink is the sampleSink of one track of a recording
+type recordingSink struct {
+	recorder *sessionRecorder
+	write    func(data []byte, duration time.Duration) error
+	// keyframe is set on the video sink, which drops the frames up to the
+	// next keyframe once the queue overflows. resync is only used by
+	// WriteSample, the feed writes one sample at a time.
+	keyframe func()
+	resync   bool
+}
+
+// WriteSample queues the sample without blocking the feed
+func (s *recordingSink) WriteSample(sample media.Sample) error {
+	if s.resync {
+		if !encoders.SplitAccessUnit(sample.Data).StartsStream() {
+			atomic.AddUint64(&s.recorder.dropped, 1)
+			return nil
+		}
+		s.resync = false
+	}
+	select {
+	case s.recorder.queue <- recordingSample{write: s.write, data: sample.Data, duration: sample.Duration}:
+	default:
+		atomic.AddUint64(&s.recorder.dropped, 1)
+		if s.keyframe != nil {
+			s.resync = true
+			s.keyframe()
+		}
+	}
+	return nil
+}
+
+// newSessionRecorder records the video feed and the audio one when audio
+// is not nil. Every file starts with a keyframe, so starting a recording or
+// a new file makes every viewer of the feed receive one.
+func newSessionRecorder(config rrecord.Config, format rrecord.Format, prefix string, video *captureFeed, audio *audioFeed, log *rlog.Logger) (*sessionRecorder, error) {
+	var track *rrecord.AudioTrack
+	if audio != nil {
+		track = &rrecord.AudioTrack{
+			SampleRate: raudio.SampleRate,
+			Channels:   raudio.Channels,
+		}
+	}
+	recorder, err := rrecord.NewRecorder(config, format, prefix, track, video.requestKeyframe)
+	if err != nil {
+		return nil, err
+	}
+	r := &sessionRecorder{
+		recorder: recorder,
+		video:    video,
+		audio:    audio,
+		queue:    make(chan recordingSample, recorderQueue),
+		done:     make(chan struct{}),
+		log:      log,
+	}
+	r.videoSink = &recordingSink{recorder: r, write: recorder.WriteVideo, keyframe: video.requestKeyframe}
+	if audio != nil {
+		r.audioSink = &recordingSink{recorder: r, write: recorder.WriteAudio}
+	}
+	return r, nil
+}
+
+func (r *sessionRecorder) start() {
+	go r.run()
+	r.video.subscribe(r.videoSink)
+	if r.audio != nil {
+		r.audio.subscribe(r.audioSink)
+	}
+}
+
+// run writes the queued samples until stop closes the queue
+func (r *sessionRecorder) run() {
+	defer close(r.done)
+	for sample := range r.queue {
+		if err := sample.write(sample.data, sample.duration); err != nil {
+			r.log.Warnf("Recorder: %v", err)
+		}
+	}
+}
+
+// stop finishes the recording and returns the files it wrote. The feeds
+// write under their lock, nothing is queued once they are unsubscribed.
+func (r *sessionRecorder) stop() []string {
+	r.video.unsubscribe(r.videoSink)
+	if r.audio != nil {
+		r.audio.unsubscribe(r.audioSink)
+	}
+	close(r.queue)
+	<-r.done
+	if dropped := atomic.LoadUint64(&r.dropped); dropped > 0 {
+		r.log.Warnf("Recorder dropped %d samples the disk couldn't keep up with", dropped)
+	}
+	if err := r.recorder.Close(); err != nil {
+		r.log.Warnf("Recorder: %v", err)
+	}
+	return r.recorder.Files()
+}
@@ -0,0 +1,51 @@
+package rtc
+
+import (
+	"sync/atomic"
+	"time"
+
+	"oneplay-videostream-browser/internal/rdisplay"
+	"oneplay-videostream-browser/internal/rreplay"
+
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// newReplayFeed creates a feed sending the samples of a recording as they
+// are, the latency marker can't be drawn on them
+func newReplayFeed(key captureKey, player rreplay.Player) *captureFeed {
+	return &captureFeed{
+		key:        key,
+		player:     player,
+		size:       player.Size(),
+		sinks:      make(map[sampleSink]struct{}),
+		cursorSubs: make(map[chan *rdisplay.Cursor]struct{}),
+		stop:       make(chan struct{}),
+	}
+}
+
+// runReplay forwards the samples at the pace the player plays them, they
+// count as captured and encoded when they are sent
+func (f *captureFeed) runReplay() {
+	samples := f.player.Samples()
+	for {
+		select {
+		case <-f.stop:
+			f.player.Stop()
+			return
+		case sample, ok := <-samples:
+			if !ok {
+				return
+			}
+			atomic.AddUint64(&f.encoded, 1)
+			now := time.Now()
+			f.broadcast(media.Sample{
+				Data:     sample.Data,
+				Duration: sample.Duration,
+			}, frameTiming{
+				captured: now,
+				encoding: now,
+				encoded:  now,
+			})
+		}
+	}
+}
@@ -1,25 +1,110 @@
 package rtc
 
 import (
+	"context"
 	"io"
+	"net/http"
+	"time"
+
+	"oneplay-videostream-browser/internal/encoders"
+	"oneplay-videostream-browser/internal/rdisplay"
+	"oneplay-videostream-browser/internal/rmask"
+	"oneplay-videostream-browser/internal/rrecord"
 
-	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type videoStreamer interface {
 	start()
+	stats() StreamStats
 	close()
 }
 
+// StreamStats frame counters of a session: frames captured from the screen,
+// frames dropped because the encoder was busy and frames sent to the peer
+type StreamStats struct {
+	Captured uint64
+	Dropped  uint64
+	Encoded  uint64
+}
+
+// SessionInfo describes an open session
+type SessionInfo struct {
+	ID string
+	// Viewer is who opened the session, empty for anonymous viewers
+	Viewer string
+	Screen int
+	// Codec of the video, empty until the offer has been processed
+	Codec   string
+	Latency string
+	Role    Role
+	Started time.Time
+	// State is the ICE connection state of the session
+	State string
+}
+
+// Signal sends a message to the viewer over the signaling connection, it
+// is encoded to JSON
+type Signal func(msg interface{}) error
+
 // RemoteScreenConnection Represents a WebRTC connection to a single peer
 type RemoteScreenConnection interface {
 	io.Closer
-	ProcessOffer(offer string, conn *websocket.Conn, messageType int)
-	ProcessICE(ICE webrtc.ICECandidateInit)
+	ProcessOffer(ctx context.Context, offer string, signal Signal) (string, error)
+	ProcessICE(ctx context.Context, ICE webrtc.ICECandidateInit) error
+	Stats() StreamStats
+	Latency() LatencyStats
+	Transport() TransportStats
+	SessionStats() SessionStats
+	Info() SessionInfo
+	ID() string
+	Role() Role
+}
+
+// SessionOptions holds the per-viewer settings requested when the session
+// is created
+type SessionOptions struct {
+	Cursor rdisplay.CursorMode
+	// Latency selects the capture, encoder and transport trade-offs, viewers
+	// sharing a feed must ask for the same profile
+	Latency encoders.Profile
+	// Role requested for the session, RoleController is only honoured if
+	// nobody controls the screen yet
+	Role Role
+	// LatencyMarker embeds the capture time of every frame in its top left
+	// corner, for glass-to-glass measurements with a camera
+	LatencyMarker bool
+	// Clipboard enables clipboard sync between the viewer and the host
+	Clipboard bool
+	// Gamepad forwards the viewer gamepads to virtual host controllers
+	Gamepad bool
+	// Viewer is who asks for the session, as authenticated by the API token
+	// or session grant. The host sees it in the approval prompt and in the
+	// watching indicator.
+	Viewer string
 }
 
 // Service WebRTC service
 type Service interface {
-	CreateRemoteScreenConnection(screenIx int, fps int) (RemoteScreenConnection, error)
+	CreateRemoteScreenConnection(screenIx int, fps int, opts SessionOptions) (RemoteScreenConnection, error)
+	RequestControl(session string) (int, error)
+	GrantControl(session string) ([]RoleChange, error)
+	DenyControl(session string) error
+	RevokeControl(session string) ([]RoleChange, error)
+	StartRecording(session string, format rrecord.Format) error
+	StopRecording(session string) ([]string, error)
+	Recordings() ([]rrecord.Recording, error)
+	RecordingPath(name string) (string, error)
+	StartEgress(screenIx int, fps int, target string) (string, error)
+	StopEgress(id string) error
+	Egresses() []EgressInfo
+	HLSHandler(screenIx int) (http.Handler, error)
+	MaskRules() ([]rmask.Rule, error)
+	SetMaskRules(rules []rmask.Rule) error
+	Sessions() []SessionInfo
+	Session(session string) (SessionInfo, error)
+	CloseSession(session string) error
+	SessionStats(session string) (SessionStats, error)
+	Metrics() prometheus.Collector
 }
@@ -0,0 +1,197 @@
+package rtc
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"oneplay-videostream-browser/internal/rlog"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	statsChannelLabel = "stats"
+	// statsEvery is how often the stats of a session are sampled and pushed
+	// to the viewer
+	statsEvery = time.Second
+)
+
+// SessionStats is a sample of the counters of a session, the rates are
+// computed over the period since the previous sample
+type SessionStats struct {
+	Time time.Time
+	// Width and Height are the size of the encoded video
+	Width  int
+	Height int
+	// CaptureFps, EncodeFps and SendFps are the frame rates of the capture,
+	// of the encoder and of the frames sent to the viewer
+	CaptureFps float64
+	EncodeFps  float64
+	SendFps    float64
+	// Bitrate of the video stream in bits per second, headers included
+	Bitrate   float64
+	Stream    StreamStats
+	Transport TransportStats
+	// ICERoundTrip is measured by the ICE connectivity checks of the
+	// selected candidate pair, Transport.RoundTrip by RTCP
+	ICERoundTrip    time.Duration
+	LocalCandidate  string
+	RemoteCandidate string
+}
+
+// RoundTrip returns the RTCP round trip time, or the ICE one until the
+// viewer sent a receiver report
+func (s SessionStats) RoundTrip() time.Duration {
+	if s.Transport.RoundTrip > 0 {
+		return s.Transport.RoundTrip
+	}
+	return s.ICERoundTrip
+}
+
+// statsMessage is the compact sample pushed over the stats data channel
+// for the viewer overlay
+type statsMessage struct {
+	Fps     float64 `json:"fps"`
+	Bitrate float64 `json:"bitrate"`
+	Width   int     `json:"width"`
+	Height  int     `json:"height"`
+	// RTT in milliseconds
+	RTT  float64 `json:"rtt"`
+	Loss float64 `json:"loss"`
+}
+
+// statsSampler samples the stats of a session every statsEvery, and sends
+// them to the viewer once it opened the stats data channel
+type statsSampler struct {
+	peer *RemoteScreenPeerConn
+	log  *rlog.Logger
+
+	mu      sync.Mutex
+	last    SessionStats
+	channel *webrtc.DataChannel
+
+	startOnce sync.Once
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newStatsSampler(peer *RemoteScreenPeerConn) *statsSampler {
+	return &statsSampler{
+		peer:   peer,
+		log:    peer.log,
+		closed: make(chan struct{}),
+	}
+}
+
+func (s *statsSampler) attach(channel *webrtc.DataChannel) {
+	channel.OnOpen(func() {
+		s.mu.Lock()
+		s.channel = channel
+		s.mu.Unlock()
+	})
+	channel.OnClose(func() {
+		s.mu.Lock()
+		if s.channel == channel {
+			s.channel = nil
+		}
+		s.mu.Unlock()
+	})
+}
+
+func (s *statsSampler) start() {
+	s.startOnce.Do(func() {
+		go s.run()
+	})
+}
+
+func (s *statsSampler) run() {
+	ticker := time.NewTicker(statsEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			// Only run writes last, GetStats doesn't need to hold readers up
+			stats := s.sample(now, s.Stats())
+			s.mu.Lock()
+			s.last = stats
+			channel := s.channel
+			s.mu.Unlock()
+			if channel != nil {
+				s.send(channel, stats)
+			}
+		}
+	}
+}
+
+// sample reads the counters of the session and the ICE stats of its peer
+// connection, prev is the previous sample
+func (s *statsSampler) sample(now time.Time, prev SessionStats) SessionStats {
+	stats := SessionStats{
+		Time:      now,
+		Stream:    s.peer.Stats(),
+		Transport: s.peer.Transport(),
+	}
+	if feed := s.peer.currentFeed(); feed != nil {
+		stats.Width, stats.Height = feed.size.X, feed.size.Y
+	}
+	if !prev.Time.IsZero() {
+		elapsed := now.Sub(prev.Time).Seconds()
+		stats.CaptureFps = float64(stats.Stream.Captured-prev.Stream.Captured) / elapsed
+		stats.EncodeFps = float64(stats.Stream.Encoded-prev.Stream.Encoded) / elapsed
+		stats.SendFps = float64(stats.Transport.FramesSent-prev.Transport.FramesSent) / elapsed
+		stats.Bitrate = float64(stats.Transport.BytesSent-prev.Transport.BytesSent) * 8 / elapsed
+	}
+
+	connection := s.peer.peerConnection()
+	if connection == nil {
+		return stats
+	}
+	report := connection.GetStats()
+	for _, value := range report {
+		pair, ok := value.(webrtc.ICECandidatePairStats)
+		if !ok || !pair.Nominated {
+			continue
+		}
+		stats.ICERoundTrip = time.Duration(pair.CurrentRoundTripTime * float64(time.Second))
+		if local, ok := report[pair.LocalCandidateID].(webrtc.ICECandidateStats); ok {
+			stats.LocalCandidate = local.CandidateType.String()
+		}
+		if remote, ok := report[pair.RemoteCandidateID].(webrtc.ICECandidateStats); ok {
+			stats.RemoteCandidate = remote.CandidateType.String()
+		}
+	}
+	return stats
+}
+
+func (s *statsSampler) send(channel *webrtc.DataChannel, stats SessionStats) {
+	payload, err := json.Marshal(statsMessage{
+		Fps:     stats.SendFps,
+		Bitrate: stats.Bitrate,
+		Width:   stats.Width,
+		Height:  stats.Height,
+		RTT:     float64(stats.RoundTrip()) / float64(time.Millisecond),
+		Loss:    stats.Transport.FractionLost,
+	})
+	if err != nil {
+		return
+	}
+	if err = channel.SendText(string(payload)); err != nil {
+		s.log.Debugf("Stats: %v", err)
+	}
+}
+
+// Stats returns the last sample, zero until the first one is taken
+func (s *statsSampler) Stats() SessionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+func (s *statsSampler) close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+}
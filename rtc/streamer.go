@@ -1,82 +1,68 @@
 package rtc
 
 import (
-	"fmt"
 	"image"
-	"time"
-
-	"oneplay-videostream-browser/internal/encoders"
-	"oneplay-videostream-browser/internal/rdisplay"
+	"sync"
 
 	"github.com/nfnt/resize"
+	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
-	"github.com/pion/webrtc/v3/pkg/media"
 )
 
 func resizeImage(src *image.RGBA, target image.Point) *image.RGBA {
 	return resize.Resize(uint(target.X), uint(target.Y), src, resize.Lanczos3).(*image.RGBA)
 }
 
+// rtcStreamer subscribes a peer's video sink to a shared captureFeed and
+// forwards the keyframe requests the peer sends back over RTCP
 type rtcStreamer struct {
-	track   *webrtc.TrackLocalStaticSample
-	stop    chan struct{}
-	screen  *rdisplay.ScreenGrabber
-	encoder *encoders.Encoder
-	size    image.Point
+	sink      sampleSink
+	sender    *webrtc.RTPSender
+	hub       *captureHub
+	feed      *captureFeed
+	closeOnce sync.Once
 }
 
-func newRTCStreamer(track *webrtc.TrackLocalStaticSample, screen *rdisplay.ScreenGrabber, encoder *encoders.Encoder, size image.Point) videoStreamer {
-	// p, err := webrtc.NewTrackLocalStaticSample(track.Codec(), track.ID(), track.StreamID())
-	// if err != nil {
-	// 	panic(err)
-	// }
+func newRTCStreamer(sink sampleSink, sender *webrtc.RTPSender, hub *captureHub, feed *captureFeed) videoStreamer {
 	return &rtcStreamer{
-		track:   track,
-		stop:    make(chan struct{}),
-		screen:  screen,
-		encoder: encoder,
-		size:    size,
+		sink:   sink,
+		sender: sender,
+		hub:    hub,
+		feed:   feed,
 	}
 }
 
 func (s *rtcStreamer) start() {
-	go s.startStream()
+	s.feed.subscribe(s.sink)
+	if s.sender != nil {
+		go s.readRTCP()
+	}
 }
 
-func (s *rtcStreamer) startStream() {
-	screen := *s.screen
-	screen.Start()
-	frames := screen.Frames()
+// readRTCP drains the sender's RTCP, PLI and FIR packets ask the shared
+// encoder for a keyframe. It returns once the sender is stopped.
+func (s *rtcStreamer) readRTCP() {
 	for {
-		select {
-		case <-s.stop:
-			screen.Stop()
+		packets, _, err := s.sender.ReadRTCP()
+		if err != nil {
 			return
-		case frame := <-frames:
-			err := s.stream(frame)
-			if err != nil {
-				fmt.Printf("Streamer: %v\n", err)
-				return
+		}
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				s.feed.requestKeyframe()
 			}
 		}
 	}
 }
 
-func (s *rtcStreamer) stream(frame *image.RGBA) error {
-	resized := resizeImage(frame, s.size)
-	payload, err := (*s.encoder).Encode(resized)
-	if err != nil {
-		return err
-	}
-	if payload == nil {
-		return nil
-	}
-	return s.track.WriteSample(media.Sample{
-		Data:     payload,
-		Duration: time.Second,
-	})
+func (s *rtcStreamer) stats() StreamStats {
+	return s.feed.stats()
 }
 
 func (s *rtcStreamer) close() {
-	close(s.stop)
+	s.closeOnce.Do(func() {
+		s.feed.unsubscribe(s.sink)
+		s.hub.release(s.feed)
+	})
 }
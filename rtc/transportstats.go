@@ -0,0 +1,168 @@
+package rtc
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// ntpEpochOffset is the number of seconds between 1900, the NTP epoch, and
+// the Unix epoch
+const ntpEpochOffset = 2208988800
+
+// TransportStats are the RTP counters of the video stream of a session and
+// what the viewer reports about it over RTCP
+type TransportStats struct {
+	PacketsSent uint64
+	BytesSent   uint64
+	// FramesSent counts the packets closing a frame, retransmissions aside
+	FramesSent uint64
+	// NACKs, PLIs and FIRs count the feedback packets of the viewer
+	NACKs uint64
+	PLIs  uint64
+	FIRs  uint64
+	// PacketsLost is the cumulative loss of the last receiver report and
+	// FractionLost the share of packets lost since the previous one
+	PacketsLost  int64
+	FractionLost float64
+	// RoundTrip is computed from the last receiver report referencing one
+	// of our sender reports, zero until there is one
+	RoundTrip time.Duration
+}
+
+// transportStats is an interceptor factory counting the outgoing video
+// packets and the RTCP feedback of a single peer connection, pion doesn't
+// keep statistics of outgoing RTP streams
+type transportStats struct {
+	mu    sync.Mutex
+	ssrcs map[uint32]struct{}
+	stats TransportStats
+}
+
+func newTransportStats() *transportStats {
+	return &transportStats{
+		ssrcs: make(map[uint32]struct{}),
+	}
+}
+
+// Stats returns a copy of the counters
+func (s *transportStats) Stats() TransportStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+func (s *transportStats) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	return &transportInterceptor{stats: s}, nil
+}
+
+func (s *transportStats) sent(header *rtp.Header, payload []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.PacketsSent++
+	s.stats.BytesSent += uint64(header.MarshalSize() + len(payload))
+	if header.Marker {
+		s.stats.FramesSent++
+	}
+}
+
+func (s *transportStats) received(packets []rtcp.Packet, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, packet := range packets {
+		switch packet := packet.(type) {
+		case *rtcp.ReceiverReport:
+			s.report(packet.Reports, now)
+		case *rtcp.SenderReport:
+			s.report(packet.Reports, now)
+		case *rtcp.TransportLayerNack:
+			if _, found := s.ssrcs[packet.MediaSSRC]; found {
+				s.stats.NACKs++
+			}
+		case *rtcp.PictureLossIndication:
+			if _, found := s.ssrcs[packet.MediaSSRC]; found {
+				s.stats.PLIs++
+			}
+		case *rtcp.FullIntraRequest:
+			if _, found := s.ssrcs[packet.MediaSSRC]; found {
+				s.stats.FIRs++
+			}
+		}
+	}
+}
+
+func (s *transportStats) report(reports []rtcp.ReceptionReport, now time.Time) {
+	for _, report := range reports {
+		if _, found := s.ssrcs[report.SSRC]; !found {
+			continue
+		}
+		// The cumulative loss is a signed 24-bit number, duplicates can
+		// make it negative
+		lost := int64(report.TotalLost & 0xffffff)
+		if lost&0x800000 != 0 {
+			lost -= 1 << 24
+		}
+		s.stats.PacketsLost = lost
+		s.stats.FractionLost = float64(report.FractionLost) / 256
+		if report.LastSenderReport == 0 {
+			continue
+		}
+		// RFC 3550 6.4.1, in 1/65536 seconds: arrival - LSR - DLSR
+		rtt := ntpCompact(now) - report.LastSenderReport - report.Delay
+		if rtt < 1<<31 {
+			s.stats.RoundTrip = time.Duration(rtt) * time.Second / 65536
+		}
+	}
+}
+
+// ntpCompact returns the middle 32 bits of the NTP timestamp of t, the
+// format of the LSR and DLSR fields of reception reports
+func ntpCompact(t time.Time) uint32 {
+	seconds := uint64(t.Unix()) + ntpEpochOffset
+	fraction := uint64(t.Nanosecond()) << 16 / uint64(time.Second)
+	return uint32(seconds<<16 | fraction)
+}
+
+// transportInterceptor reports the outgoing video packets and the RTCP
+// packets read by every sender to the stats
+type transportInterceptor struct {
+	interceptor.NoOp
+	stats *transportStats
+}
+
+func (i *transportInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if !strings.HasPrefix(strings.ToLower(info.MimeType), "video/") {
+		return writer
+	}
+	i.stats.mu.Lock()
+	i.stats.ssrcs[info.SSRC] = struct{}{}
+	i.stats.mu.Unlock()
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		n, err := writer.Write(header, payload, attributes)
+		if err == nil {
+			i.stats.sent(header, payload)
+		}
+		return n, err
+	})
+}
+
+func (i *transportInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, attributes interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attributes, err := reader.Read(b, attributes)
+		if err != nil {
+			return 0, nil, err
+		}
+		if attributes == nil {
+			attributes = make(interceptor.Attributes)
+		}
+		// Packets that don't parse are the business of the readers after us
+		if packets, err := attributes.GetRTCPPackets(b[:n]); err == nil {
+			i.stats.received(packets, time.Now())
+		}
+		return n, attributes, nil
+	})
+}
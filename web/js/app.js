@@ -18,17 +18,29 @@ function loadScreens() {
   }).catch(showError);
 }
 
-function startSession(offer, screen) {
+function startSession(offer, screen, cursor) {
+  const clipboard = true;
+  const gamepad = true;
+  // 'quality' trades a few frames of delay for a sharper picture
+  const latency = 'lowlatency';
   console.log("to agent")
   console.log(JSON.stringify({
       offer,
-      screen
+      screen,
+      cursor,
+      clipboard,
+      gamepad,
+      latency
     }))
   return fetch('/api/session', {
     method: 'POST',
     body: JSON.stringify({
       offer,
-      screen
+      screen,
+      cursor,
+      clipboard,
+      gamepad,
+      latency
     }),
     headers: {
       'Content-Type': 'application/json'
@@ -59,6 +71,302 @@ function createOffer(pc, { audio, video }) {
   });
 }
 
+// Renders the host pointer over the video from the "cursor" data channel,
+// positions arrive normalized to the captured screen size
+function attachCursorChannel(channel, remoteVideoNode, cursorNode) {
+  let shape = null;
+  channel.onmessage = evt => {
+    const msg = JSON.parse(evt.data);
+    if (msg.type === 'shape') {
+      shape = msg;
+      cursorNode.src = 'data:image/png;base64,' + msg.png;
+      return;
+    }
+    if (msg.type !== 'position' || !shape) {
+      return;
+    }
+    const scale = remoteVideoNode.clientWidth / shape.screenWidth;
+    cursorNode.style.width = (shape.width * scale) + 'px';
+    cursorNode.style.height = (shape.height * scale) + 'px';
+    cursorNode.style.left = (remoteVideoNode.offsetLeft + msg.x * remoteVideoNode.clientWidth - shape.hotX * scale) + 'px';
+    cursorNode.style.top = (remoteVideoNode.offsetTop + msg.y * remoteVideoNode.clientHeight - shape.hotY * scale) + 'px';
+    cursorNode.style.setProperty('visibility', 'visible');
+  };
+  channel.onclose = () => {
+    cursorNode.style.setProperty('visibility', 'collapse');
+  };
+}
+
+// Forwards pointer and keyboard events over the "input" data channel,
+// pointer positions are sent in pixels of the received video
+function attachInputChannel(channel, remoteVideoNode) {
+  const send = msg => {
+    if (channel.readyState === 'open') {
+      channel.send(JSON.stringify(msg));
+    }
+  };
+  const videoPosition = evt => ({
+    x: evt.offsetX * remoteVideoNode.videoWidth / remoteVideoNode.clientWidth,
+    y: evt.offsetY * remoteVideoNode.videoHeight / remoteVideoNode.clientHeight
+  });
+  const listeners = {
+    mousemove: evt => send(Object.assign({ type: 'mousemove' }, videoPosition(evt))),
+    mousedown: evt => {
+      evt.preventDefault();
+      send({ type: 'mousedown', button: evt.button });
+    },
+    mouseup: evt => {
+      evt.preventDefault();
+      send({ type: 'mouseup', button: evt.button });
+    },
+    wheel: evt => {
+      evt.preventDefault();
+      send({ type: 'wheel', dx: Math.sign(evt.deltaX), dy: Math.sign(evt.deltaY) });
+    },
+    contextmenu: evt => evt.preventDefault()
+  };
+  const keyListeners = {
+    keydown: evt => {
+      evt.preventDefault();
+      send({ type: 'keydown', code: evt.code });
+    },
+    keyup: evt => {
+      evt.preventDefault();
+      send({ type: 'keyup', code: evt.code });
+    }
+  };
+  Object.keys(listeners).forEach(name => remoteVideoNode.addEventListener(name, listeners[name]));
+  Object.keys(keyListeners).forEach(name => document.addEventListener(name, keyListeners[name]));
+  channel.onclose = () => {
+    Object.keys(listeners).forEach(name => remoteVideoNode.removeEventListener(name, listeners[name]));
+    Object.keys(keyListeners).forEach(name => document.removeEventListener(name, keyListeners[name]));
+  };
+}
+
+// Syncs text between the browser clipboard and the host over the
+// "clipboard" data channel, content is base64 encoded in 32KB chunks
+function attachClipboardChannel(channel) {
+  const chunkSize = 32 * 1024;
+  let received = '';
+  channel.onmessage = evt => {
+    const msg = JSON.parse(evt.data);
+    if (msg.type === 'error') {
+      showError(msg.message);
+      return;
+    }
+    if (msg.type !== 'clipboard' || msg.mime !== 'text/plain') {
+      return;
+    }
+    received += msg.data ? atob(msg.data) : '';
+    if (msg.last) {
+      const text = new TextDecoder().decode(Uint8Array.from(received, c => c.charCodeAt(0)));
+      received = '';
+      navigator.clipboard && navigator.clipboard.writeText(text).catch(showError);
+    }
+  };
+  const onPaste = evt => {
+    if (channel.readyState !== 'open') {
+      return;
+    }
+    const bytes = new TextEncoder().encode(evt.clipboardData.getData('text/plain'));
+    for (let offset = 0; offset < bytes.length || offset === 0; offset += chunkSize) {
+      const chunk = bytes.subarray(offset, offset + chunkSize);
+      channel.send(JSON.stringify({
+        type: 'clipboard',
+        mime: 'text/plain',
+        data: btoa(String.fromCharCode.apply(null, chunk)),
+        last: offset + chunkSize >= bytes.length
+      }));
+    }
+  };
+  document.addEventListener('paste', onPaste);
+  channel.onclose = () => document.removeEventListener('paste', onPaste);
+}
+
+// Reports every displayed frame over the "latency" data channel so the agent
+// can measure the glass-to-glass latency, and answers its clock sync pings.
+// Times are milliseconds since the epoch.
+function attachLatencyChannel(channel, remoteVideoNode) {
+  const epoch = t => performance.timeOrigin + t;
+  const onFrame = (now, metadata) => {
+    if (channel.readyState !== 'open') {
+      return;
+    }
+    if (metadata.rtpTimestamp !== undefined && metadata.receiveTime !== undefined) {
+      channel.send(JSON.stringify({
+        type: 'frame',
+        rtp: metadata.rtpTimestamp,
+        received: epoch(metadata.receiveTime),
+        decoded: epoch(metadata.receiveTime + (metadata.processingDuration || 0) * 1000),
+        rendered: epoch(metadata.expectedDisplayTime)
+      }));
+    }
+    remoteVideoNode.requestVideoFrameCallback(onFrame);
+  };
+  channel.onopen = () => {
+    if (remoteVideoNode.requestVideoFrameCallback) {
+      remoteVideoNode.requestVideoFrameCallback(onFrame);
+    }
+  };
+  channel.onmessage = evt => {
+    const msg = JSON.parse(evt.data);
+    if (msg.type === 'ping') {
+      channel.send(JSON.stringify({ type: 'pong', sent: msg.sent, viewer: epoch(performance.now()) }));
+    }
+  };
+}
+
+// Shows the stats the agent pushes every second over the "stats" data
+// channel in an overlay, for as long as the channel is open
+function attachStatsChannel(channel, overlayNode) {
+  const show = text => {
+    overlayNode.textContent = text;
+    overlayNode.style.setProperty('visibility', text ? 'visible' : 'collapse');
+  };
+  channel.onmessage = evt => {
+    const stats = JSON.parse(evt.data);
+    show([
+      stats.width + 'x' + stats.height + ' @ ' + stats.fps.toFixed(1) + ' fps',
+      (stats.bitrate / 1e6).toFixed(2) + ' Mbps',
+      'RTT ' + Math.round(stats.rtt) + ' ms',
+      'loss ' + (stats.loss * 100).toFixed(1) + ' %'
+    ].join('\n'));
+  };
+  channel.onclose = () => show('');
+}
+
+// Forwards the local gamepads over the "gamepad" data channel, the state
+// is polled every animation frame and only sent when it changed. Rumble
+// played by host games is replayed on the matching gamepad.
+function attachGamepadChannel(channel) {
+  const sent = {};
+  let frame = null;
+  const send = msg => channel.readyState === 'open' && channel.send(JSON.stringify(msg));
+  const connect = gamepad => {
+    if (gamepad.mapping === 'standard' && gamepad.index < 4) {
+      send({ type: 'connected', index: gamepad.index, id: gamepad.id });
+    }
+  };
+  const poll = () => {
+    Array.from(navigator.getGamepads()).forEach(gamepad => {
+      if (!gamepad || gamepad.mapping !== 'standard' || gamepad.index >= 4) {
+        return;
+      }
+      const state = {
+        type: 'state',
+        index: gamepad.index,
+        buttons: gamepad.buttons.map(button => button.value),
+        axes: Array.from(gamepad.axes)
+      };
+      const payload = JSON.stringify(state);
+      if (sent[gamepad.index] !== payload) {
+        sent[gamepad.index] = payload;
+        send(state);
+      }
+    });
+    frame = requestAnimationFrame(poll);
+  };
+  const onConnected = evt => connect(evt.gamepad);
+  const onDisconnected = evt => {
+    delete sent[evt.gamepad.index];
+    send({ type: 'disconnected', index: evt.gamepad.index });
+  };
+  channel.onopen = () => {
+    Array.from(navigator.getGamepads()).forEach(gamepad => gamepad && connect(gamepad));
+    frame = requestAnimationFrame(poll);
+  };
+  channel.onmessage = evt => {
+    const msg = JSON.parse(evt.data);
+    if (msg.type === 'error') {
+      showError(msg.message);
+      return;
+    }
+    const gamepad = navigator.getGamepads()[msg.index];
+    if (msg.type === 'slot') {
+      console.info('gamepad ' + msg.index + ' plugged as player ' + (msg.slot + 1));
+    } else if (msg.type === 'rumble' && gamepad && gamepad.vibrationActuator) {
+      if (!msg.duration) {
+        gamepad.vibrationActuator.reset();
+        return;
+      }
+      gamepad.vibrationActuator.playEffect('dual-rumble', {
+        duration: msg.duration,
+        strongMagnitude: msg.strong || 0,
+        weakMagnitude: msg.weak || 0
+      }).catch(showError);
+    }
+  };
+  window.addEventListener('gamepadconnected', onConnected);
+  window.addEventListener('gamepaddisconnected', onDisconnected);
+  channel.onclose = () => {
+    cancelAnimationFrame(frame);
+    window.removeEventListener('gamepadconnected', onConnected);
+    window.removeEventListener('gamepaddisconnected', onDisconnected);
+  };
+}
+
+// Uploads files dropped on the video over the agent's "file" data channel
+function attachFileChannel(channel, remoteVideoNode) {
+  const chunkSize = 16 * 1024;
+  const uploads = {};
+  const toHex = buffer => Array.from(new Uint8Array(buffer)).map(b => b.toString(16).padStart(2, '0')).join('');
+  const toBase64 = bytes => {
+    let binary = '';
+    bytes.forEach(b => binary += String.fromCharCode(b));
+    return btoa(binary);
+  };
+  const sendChunks = (id, offset) => {
+    const bytes = uploads[id];
+    for (; offset < bytes.length; offset += chunkSize) {
+      channel.send(JSON.stringify({
+        type: 'chunk',
+        id,
+        offset,
+        data: toBase64(bytes.subarray(offset, offset + chunkSize))
+      }));
+    }
+  };
+  channel.onmessage = evt => {
+    const msg = JSON.parse(evt.data);
+    if (msg.type === 'ready') {
+      sendChunks(msg.id, msg.offset);
+    } else if (msg.type === 'progress') {
+      console.info('upload ' + msg.id + ': ' + msg.offset + '/' + msg.size);
+    } else if (msg.type === 'complete') {
+      console.info('upload ' + msg.id + ' complete');
+      delete uploads[msg.id];
+    } else if (msg.type === 'error') {
+      delete uploads[msg.id];
+      showError(msg.message);
+    }
+  };
+  const onDrop = evt => {
+    evt.preventDefault();
+    Array.from(evt.dataTransfer.files).forEach(file => {
+      file.arrayBuffer().then(buffer => {
+        return crypto.subtle.digest('SHA-256', buffer).then(digest => {
+          const id = Date.now().toString(36) + '-' + Math.random().toString(36).slice(2);
+          uploads[id] = new Uint8Array(buffer);
+          channel.send(JSON.stringify({
+            type: 'upload',
+            id,
+            name: file.name,
+            size: buffer.byteLength,
+            sha256: toHex(digest)
+          }));
+        });
+      }).catch(showError);
+    });
+  };
+  const onDragOver = evt => evt.preventDefault();
+  remoteVideoNode.addEventListener('drop', onDrop);
+  remoteVideoNode.addEventListener('dragover', onDragOver);
+  channel.onclose = () => {
+    remoteVideoNode.removeEventListener('drop', onDrop);
+    remoteVideoNode.removeEventListener('dragover', onDragOver);
+  };
+}
+
 function startRemoteSession(screen, remoteVideoNode, stream) {
   let pc;
 
@@ -74,15 +382,26 @@ function startRemoteSession(screen, remoteVideoNode, stream) {
       remoteVideoNode.srcObject = evt.streams[0];
       remoteVideoNode.play();
     };
+    pc.ondatachannel = evt => {
+      if (evt.channel.label === 'file') {
+        attachFileChannel(evt.channel, remoteVideoNode);
+      }
+    };
 
     stream && stream.getTracks().forEach(track => {
       pc.addTrack(track, stream);
     })
-    return createOffer(pc, { audio: false, video: true });
+    attachCursorChannel(pc.createDataChannel('cursor'), remoteVideoNode, document.querySelector('#remote-cursor'));
+    attachInputChannel(pc.createDataChannel('input'), remoteVideoNode);
+    attachClipboardChannel(pc.createDataChannel('clipboard'));
+    attachGamepadChannel(pc.createDataChannel('gamepad'));
+    attachLatencyChannel(pc.createDataChannel('latency'), remoteVideoNode);
+    attachStatsChannel(pc.createDataChannel('stats'), document.querySelector('#stats-overlay'));
+    return createOffer(pc, { audio: true, video: true });
   }).then(offer => {
     console.info("offer");
     console.info(offer);
-    return startSession(offer, screen);
+    return startSession(offer, screen, 'separate');
   }).then(answer => {
     console.info(answer);
     return pc.setRemoteDescription(new RTCSessionDescription({
@@ -92,6 +411,31 @@ function startRemoteSession(screen, remoteVideoNode, stream) {
   }).then(() => pc);
 }
 
+// Read-only fallback for networks where WebRTC can't get through, the agent
+// packages the screen as LL-HLS
+function startHLSFallback(screen, remoteVideoNode) {
+  const url = '/hls/' + screen + '/index.m3u8';
+  remoteVideoNode.srcObject = null;
+  if (window.Hls && Hls.isSupported()) {
+    const hls = new Hls({ lowLatencyMode: true });
+    hls.loadSource(url);
+    hls.attachMedia(remoteVideoNode);
+    hls.on(Hls.Events.MANIFEST_PARSED, () => remoteVideoNode.play());
+    return { close: () => hls.destroy() };
+  }
+  if (remoteVideoNode.canPlayType('application/vnd.apple.mpegurl')) {
+    remoteVideoNode.src = url;
+    remoteVideoNode.play();
+    return {
+      close: () => {
+        remoteVideoNode.removeAttribute('src');
+        remoteVideoNode.load();
+      }
+    };
+  }
+  throw new Error('This browser can play neither WebRTC nor HLS');
+}
+
 let peerConnection = null;
 document.addEventListener('DOMContentLoaded', () => {
   let selectedScreen = 0;
@@ -150,9 +494,29 @@ document.addEventListener('DOMContentLoaded', () => {
       userMediaPromise.then(stream => {
         console.log("stream");
         console.log(stream);
+        const fallBack = () => {
+          if (peerConnection && peerConnection.close) {
+            peerConnection.close();
+          }
+          console.info('WebRTC failed, falling back to HLS');
+          peerConnection = startHLSFallback(selectedScreen, remoteVideo);
+          remoteVideo.style.setProperty('visibility', 'visible');
+        };
         return startRemoteSession(selectedScreen, remoteVideo, stream).then(pc => {
           remoteVideo.style.setProperty('visibility', 'visible');
           peerConnection = pc;
+          pc.addEventListener('iceconnectionstatechange', () => {
+            if (peerConnection === pc && pc.iceConnectionState === 'failed') {
+              try {
+                fallBack();
+              } catch (err) {
+                showError(err);
+              }
+            }
+          });
+        }).catch(err => {
+          console.error(err);
+          fallBack();
         }).catch(showError).then(() => {
           enableStartStop(true);
           setStartStopTitle('Stop');